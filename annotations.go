@@ -0,0 +1,69 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of '--annotate', which records
+// who applied an object, when, and with which build of kontemplate in
+// annotations of the object.
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/tazjin/kontemplate/templater"
+)
+
+const (
+	appliedByAnnotation = "kontemplate.io/applied-by"
+	appliedAtAnnotation = "kontemplate.io/applied-at"
+	gitCommitAnnotation = "kontemplate.io/git-commit"
+)
+
+// Returns the audit annotations for an apply at the given time. The
+// commit is omitted for builds without an embedded git hash, and the
+// user if it can not be determined.
+func auditAnnotations(now time.Time) map[string]string {
+	annotations := map[string]string{
+		appliedAtAnnotation: now.UTC().Format(time.RFC3339),
+	}
+
+	if name := currentUser(); name != "" {
+		annotations[appliedByAnnotation] = name
+	}
+
+	if gitHash != "" {
+		annotations[gitCommitAnnotation] = gitHash
+	}
+
+	return annotations
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+// Adds the audit annotations to every object of the rendered resource
+// sets. Annotations that a resource already sets are kept.
+func annotateResources(resources *[]templater.RenderedResourceSet) error {
+	annotations := auditAnnotations(time.Now())
+
+	for i := range *resources {
+		if err := templater.AddAnnotations(&(*resources)[i], annotations); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of 'template --emit-argocd-app',
+// which writes an ArgoCD Application next to the rendered resources of
+// every resource set, so that ArgoCD can sync them from a git repository.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/templater"
+)
+
+// Directory in the output directory that contains the Applications.
+const argoApplicationsDir = "applications"
+
+type argoApplication struct {
+	APIVersion string              `json:"apiVersion"`
+	Kind       string              `json:"kind"`
+	Metadata   argoMetadata        `json:"metadata"`
+	Spec       argoApplicationSpec `json:"spec"`
+}
+
+type argoMetadata struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type argoApplicationSpec struct {
+	Project     string          `json:"project"`
+	Source      argoSource      `json:"source"`
+	Destination argoDestination `json:"destination"`
+}
+
+type argoSource struct {
+	RepoURL        string `json:"repoURL"`
+	TargetRevision string `json:"targetRevision"`
+	Path           string `json:"path"`
+}
+
+type argoDestination struct {
+	Server    string `json:"server"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Settings of the generated Applications, from the command line.
+type argoSettings struct {
+	repoURL string
+
+	// Path of the output directory in the repository.
+	repoPath string
+
+	revision      string
+	project       string
+	namespace     string
+	destServer    string
+	destNamespace string
+}
+
+// Settings of --emit-argocd-app, if it is used.
+var argoApp *argoSettings
+
+func argoSettingsFromFlags() (*argoSettings, error) {
+	if *templateOutputDir == "" || *templateOutputMode != "per-file" || *templateFilenames != "" {
+		return nil, fmt.Errorf("--emit-argocd-app can only be used with --output and the default output mode")
+	}
+
+	if *templateArgoRepo == "" {
+		return nil, fmt.Errorf("--emit-argocd-app requires --argocd-repo-url")
+	}
+
+	// ArgoCD reads the files from the repository, so the path of
+	// the output directory in it must be known.
+	repoPath := *templateArgoPath
+	if repoPath == "" && path.IsAbs(*templateOutputDir) {
+		return nil, fmt.Errorf("--emit-argocd-app requires --argocd-path if --output is an absolute path")
+	} else if repoPath == "" {
+		repoPath = *templateOutputDir
+	}
+
+	return &argoSettings{
+		repoURL:       *templateArgoRepo,
+		repoPath:      path.Clean(repoPath),
+		revision:      *templateArgoRev,
+		project:       *templateArgoProj,
+		namespace:     *templateArgoNS,
+		destServer:    *templateDestServer,
+		destNamespace: *templateDestNS,
+	}, nil
+}
+
+// Renders the Application for a resource set whose files are written to
+// 'setPath' in the git repository. The name of the Application is the
+// name of the resource set (prefixed with 'prefix', e.g. the context, if
+// set), with slashes replaced by dashes.
+func argoApplicationFor(s *argoSettings, rs *templater.RenderedResourceSet, prefix string, setPath string) (string, string, error) {
+	name := strings.ToLower(strings.Replace(rs.Name, "/", "-", -1))
+	if prefix != "" {
+		name = strings.ToLower(prefix) + "-" + name
+	}
+
+	namespace := rs.Namespace
+	if namespace == "" {
+		namespace = s.destNamespace
+	}
+
+	app := argoApplication{
+		APIVersion: "argoproj.io/v1alpha1",
+		Kind:       "Application",
+		Metadata:   argoMetadata{Name: name, Namespace: s.namespace},
+		Spec: argoApplicationSpec{
+			Project:     s.project,
+			Source:      argoSource{RepoURL: s.repoURL, TargetRevision: s.revision, Path: setPath},
+			Destination: argoDestination{Server: s.destServer, Namespace: namespace},
+		},
+	}
+
+	out, err := yaml.Marshal(app)
+	if err != nil {
+		return "", "", err
+	}
+
+	return name, "---\n" + string(out), nil
+}
+
+// Writes the rendered files of the resource sets into one directory per
+// resource set, and an Application for each of them into the
+// 'applications' directory. 'subdir' is the subdirectory of the output
+// directory that outputDir refers to, if multiple contexts are written.
+func writeArgoApplications(s *argoSettings, outputDir string, subdir string, resourceSets []templater.RenderedResourceSet) error {
+	for _, rs := range resourceSets {
+		if rs.Name == argoApplicationsDir || strings.HasPrefix(rs.Name, argoApplicationsDir+"/") {
+			return fmt.Errorf("Resource set '%s' would be written to the directory of the ArgoCD Applications", rs.Name)
+		}
+	}
+
+	for _, rs := range resourceSets {
+		for _, r := range rs.Resources {
+			if err := writeOutputFile(path.Join(outputDir, rs.Name, r.Filename), r.Rendered); err != nil {
+				return err
+			}
+		}
+
+		name, app, err := argoApplicationFor(s, &rs, subdir, path.Join(s.repoPath, subdir, rs.Name))
+		if err != nil {
+			return fmt.Errorf("Could not create ArgoCD Application for resource set '%s': %v", rs.Name, err)
+		}
+
+		if err := writeOutputFile(path.Join(outputDir, argoApplicationsDir, name+".yaml"), app); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
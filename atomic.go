@@ -0,0 +1,287 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of atomic applies, which roll
+// back all resource sets that have already been applied if applying a
+// later one fails.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// An object declared in a rendered resource set.
+type object struct {
+	APIVersion string
+	Kind       string
+	Name       string
+	Namespace  string
+
+	// The YAML document declaring the object.
+	Document string
+}
+
+// Fields set by the API server that must not be re-applied when
+// restoring an object.
+var serverMetadataFields = []string{
+	"creationTimestamp",
+	"generation",
+	"managedFields",
+	"resourceVersion",
+	"selfLink",
+	"uid",
+}
+
+// The state of the objects of a resource set before it was applied.
+type snapshot struct {
+	resourceSet string
+
+	// Objects that existed before, serialised as JSON.
+	existing []string
+
+	// Objects that did not exist before.
+	created []object
+}
+
+// Returns the objects declared in the documents of a resource set.
+// Documents without a kind or name are skipped.
+func resourceSetObjects(rs *templater.RenderedResourceSet) ([]object, error) {
+	var objects []object
+
+	for _, r := range rs.Resources {
+		for _, doc := range util.SplitDocuments(r.Rendered) {
+			var o struct {
+				APIVersion string `json:"apiVersion"`
+				Kind       string `json:"kind"`
+				Metadata   struct {
+					Name      string `json:"name"`
+					Namespace string `json:"namespace"`
+				} `json:"metadata"`
+			}
+
+			if err := yaml.Unmarshal([]byte(doc), &o); err != nil {
+				return nil, fmt.Errorf("could not parse %s/%s: %v", rs.Name, r.Filename, err)
+			}
+
+			if o.Kind == "" || o.Metadata.Name == "" {
+				continue
+			}
+
+			namespace := o.Metadata.Namespace
+			if namespace == "" {
+				namespace = rs.Namespace
+			}
+
+			objects = append(objects, object{o.APIVersion, o.Kind, o.Metadata.Name, namespace, doc})
+		}
+	}
+
+	return objects, nil
+}
+
+func (o *object) resource() string {
+	return kubectlResourceName(o.APIVersion, o.Kind, o.Name)
+}
+
+// Applies resource sets one after another. If any of them fails, the
+// objects of all resource sets applied so far (including the failed
+// one) are restored to the state they were in before, and objects
+// that did not exist are deleted.
+func atomicApply(c *context.Context, kubectlArgs *[]string, resourceSets *[]templater.RenderedResourceSet, wait bool, waitTimeout time.Duration) error {
+	var snapshots []*snapshot
+
+	for _, rs := range *resourceSets {
+		start := time.Now()
+		s, err := takeSnapshot(c, &rs)
+		if err == nil {
+			snapshots = append(snapshots, s)
+			err = runKubectlWithResourceSet(c, kubectlArgs, &rs)
+		}
+
+		if err == nil && wait {
+			err = waitForWorkloads(c, &rs, waitTimeout)
+		}
+
+		recordResourceSet(rs.Name, start, err)
+
+		if err != nil {
+			util.Warnf("Applying resource set '%s' failed: %v", rs.Name, err)
+			rollBack(c, kubectlArgs, snapshots)
+
+			var names []string
+			for _, s := range snapshots {
+				names = append(names, s.resourceSet)
+			}
+
+			return fmt.Errorf("resource set '%s' failed to apply, rolled back: %s", rs.Name, strings.Join(names, ", "))
+		}
+	}
+
+	return nil
+}
+
+// Records the current state of all objects of a resource set.
+func takeSnapshot(c *context.Context, rs *templater.RenderedResourceSet) (*snapshot, error) {
+	objects, err := resourceSetObjects(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	s := snapshot{resourceSet: rs.Name}
+
+	for _, o := range objects {
+		current, found, err := getObject(c, o.resource(), o.Namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		if !found {
+			s.created = append(s.created, o)
+			continue
+		}
+
+		prior, err := priorState(current)
+		if err != nil {
+			return nil, fmt.Errorf("could not record state of %s: %v", o.resource(), err)
+		}
+
+		s.existing = append(s.existing, prior)
+	}
+
+	return &s, nil
+}
+
+// Removes the fields set by the API server from an object, so that it
+// can be applied again.
+func priorState(current []byte) (string, error) {
+	var o map[string]interface{}
+	if err := json.Unmarshal(current, &o); err != nil {
+		return "", err
+	}
+
+	// The builtin 'delete' is shadowed by the command of the same
+	// name in this package, so the fields are filtered by copying.
+	o = withoutFields(o, "status")
+	if metadata, ok := o["metadata"].(map[string]interface{}); ok {
+		o["metadata"] = withoutFields(metadata, serverMetadataFields...)
+	}
+
+	prior, err := json.Marshal(o)
+	return string(prior), err
+}
+
+func withoutFields(m map[string]interface{}, fields ...string) map[string]interface{} {
+	filtered := make(map[string]interface{}, len(m))
+
+outer:
+	for k, v := range m {
+		for _, field := range fields {
+			if k == field {
+				continue outer
+			}
+		}
+		filtered[k] = v
+	}
+
+	return filtered
+}
+
+// Restores snapshots in reverse order, applying the prior state with
+// the same arguments as the resource sets themselves. Failures are reported, but do
+// not stop the remaining snapshots from being restored.
+func rollBack(c *context.Context, kubectlArgs *[]string, snapshots []*snapshot) {
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := snapshots[i]
+		util.Warnf("Rolling back resource set '%s'", s.resourceSet)
+		recordRollback(s.resourceSet)
+
+		for j := len(s.created) - 1; j >= 0; j-- {
+			o := s.created[j]
+			if err := deleteObject(c, o.resource(), o.Namespace); err != nil {
+				util.Warnf("Could not delete %s: %v", o.resource(), err)
+			}
+		}
+
+		if len(s.existing) == 0 {
+			continue
+		}
+
+		restore := templater.RenderedResourceSet{Name: s.resourceSet}
+		for _, prior := range s.existing {
+			restore.Resources = append(restore.Resources, templater.RenderedResource{
+				Filename: "prior-state.json",
+				Rendered: "---\n" + prior,
+			})
+		}
+
+		if err := runKubectlWithResourceSet(c, kubectlArgs, &restore); err != nil {
+			util.Warnf("Could not restore the prior state of resource set '%s': %v", s.resourceSet, err)
+		}
+	}
+}
+
+// Fetches an object from the cluster as JSON. 'found' is false if the
+// object does not exist.
+func getObject(c *context.Context, resource string, namespace string) (current []byte, found bool, err error) {
+	args := []string{"get", resource, "-o", "json", "--ignore-not-found"}
+	if namespace != "" {
+		args = append(args, fmt.Sprintf("--namespace=%s", namespace))
+	}
+	args = append(args, clusterArgs(c)...)
+
+	output, err := runKubectlCommand(args)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not get %s: %v", resource, err)
+	}
+
+	if strings.TrimSpace(string(output)) == "" {
+		return nil, false, nil
+	}
+
+	return output, true, nil
+}
+
+func deleteObject(c *context.Context, resource string, namespace string) error {
+	args := []string{"delete", resource, "--ignore-not-found"}
+	if namespace != "" {
+		args = append(args, fmt.Sprintf("--namespace=%s", namespace))
+	}
+	args = append(args, clusterArgs(c)...)
+
+	_, err := runKubectlCommand(args)
+	return err
+}
+
+// Runs kubectl and returns its output, or an error including its
+// error output.
+func runKubectlCommand(args []string) ([]byte, error) {
+	util.Debugf("Running %s %s", *kubectlBin, strings.Join(args, " "))
+
+	var stdout, stderr bytes.Buffer
+	kubectl := exec.Command(*kubectlBin, args...)
+	kubectl.Stdout = &stdout
+	kubectl.Stderr = &stderr
+
+	if err := util.RunCommand(kubectl, *timeout); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
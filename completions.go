@@ -0,0 +1,163 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of shell completions. The
+// scripts printed by 'kontemplate completions' call kontemplate with
+// kingpin's hidden '--completion-bash' flag, which prints the possible
+// completions of the current command line.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Completion scripts by shell. Files are completed if kontemplate does
+// not suggest anything, e.g. for the cluster configuration argument.
+var completionScripts = map[string]string{
+	"bash": `_kontemplate_completions() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local opts=$( "${COMP_WORDS[0]}" --completion-bash ${COMP_WORDS[@]:1:$COMP_CWORD} 2>/dev/null )
+    COMPREPLY=( $(compgen -W "${opts}" -- "${cur}") )
+}
+complete -o default -F _kontemplate_completions kontemplate
+`,
+
+	"zsh": `#compdef kontemplate
+autoload -U +X bashcompinit && bashcompinit
+
+_kontemplate_completions() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local opts=$( "${COMP_WORDS[0]}" --completion-bash ${COMP_WORDS[@]:1:$COMP_CWORD} 2>/dev/null )
+    COMPREPLY=( $(compgen -W "${opts}" -- "${cur}") )
+}
+complete -o default -F _kontemplate_completions kontemplate
+`,
+
+	"fish": `function __kontemplate_completions
+    set -l tokens (commandline -opc)
+    set -e tokens[1]
+    kontemplate --completion-bash $tokens (commandline -ct) 2>/dev/null
+end
+complete -c kontemplate -a '(__kontemplate_completions)'
+`,
+}
+
+func completionsCommand() {
+	printCompletionScript(os.Stdout, *completionShell)
+}
+
+func printCompletionScript(w io.Writer, shell string) {
+	fmt.Fprint(w, completionScripts[shell])
+}
+
+// Suggests the names of the resource sets (and of their parents) in the
+// cluster configuration given on the command line, for completing
+// '--include' and '--exclude'. Nothing is suggested if there is no
+// cluster configuration or it can not be loaded.
+func resourceSetCompletions() []string {
+	files := completionContextFiles()
+	if len(files) == 0 {
+		return nil
+	}
+
+	// Completions are read from stdout, and diagnostics would clutter
+	// the terminal of the user.
+	util.LogOutput = ioutil.Discard
+
+	ctx, err := context.LoadContexts(files, &context.LoadOptions{
+		BaseDir:  *baseDir,
+		CacheDir: *cacheDir,
+	})
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, rs := range ctx.ResourceSets {
+		for _, name := range []string{rs.Parent, rs.Name} {
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Returns the cluster configuration files given to the command being
+// completed. Standard input can not be read while completing.
+func completionContextFiles() []string {
+	for _, files := range [][]string{
+		*templateFile, *applyFile, *replaceFile, *deleteFile, *createFile, *diffFile,
+		*planFile, *validateFile, *lintFile, *explainFile, *listFile,
+	} {
+		if len(files) > 0 {
+			for _, file := range files {
+				if file == "-" {
+					return nil
+				}
+			}
+
+			return files
+		}
+	}
+
+	return nil
+}
+
+// Kingpin only completes the values of flags given in their long form,
+// so short flags are expanded while completing, e.g. '-i' to
+// '--include'.
+func expandShortFlags(args []string) []string {
+	completing := false
+	for _, arg := range args {
+		completing = completing || arg == "--completion-bash"
+	}
+
+	if !completing {
+		return args
+	}
+
+	short := make(map[string]string)
+	model := app.Model()
+	for _, flag := range model.Flags {
+		if flag.Short != 0 {
+			short["-"+string(flag.Short)] = "--" + flag.Name
+		}
+	}
+
+	for _, cmd := range model.FlattenedCommands() {
+		for _, flag := range cmd.Flags {
+			if flag.Short != 0 {
+				short["-"+string(flag.Short)] = "--" + flag.Name
+			}
+		}
+	}
+
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		if long, ok := short[arg]; ok {
+			arg = long
+		}
+		expanded[i] = arg
+	}
+
+	return expanded
+}
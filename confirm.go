@@ -0,0 +1,50 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of the interactive confirmation
+// prompt shown before destructive operations.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Prints a summary of the resource sets affected by an operation and
+// asks the user for confirmation. Unless 'yes' is set, kontemplate
+// exits if the user declines or if stdin is not a terminal.
+func confirmOperation(operation string, c *context.Context, resources *[]templater.RenderedResourceSet, yes bool) {
+	if yes {
+		return
+	}
+
+	if !util.IsTerminal(os.Stdin) {
+		fail(exitUsage, "Refusing to %s resources without confirmation, please pass --yes\n", operation)
+	}
+
+	fmt.Fprintf(os.Stderr, "The following resource sets will be passed to 'kubectl %s' in context '%s':\n", operation, kubectlContext(c))
+	for _, rs := range *resources {
+		fmt.Fprintf(os.Stderr, "  %s (%d file(s))\n", rs.Name, len(rs.Resources))
+	}
+
+	fmt.Fprintf(os.Stderr, "Continue? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	if answer != "y" && answer != "yes" {
+		fail(exitUsage, "Aborted\n")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of loading variables from
+// ConfigMaps and Secrets in a cluster.
+
+package context
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/tazjin/kontemplate/util"
+)
+
+// A ConfigMap or Secret whose data is loaded as variables.
+type ClusterSource struct {
+	// Kind of the object, either 'configmap' or 'secret'.
+	Kind string `json:"kind"`
+
+	// Name of the object.
+	Name string `json:"name"`
+
+	// Namespace of the object. Defaults to the namespace of the kubectl context.
+	Namespace string `json:"namespace"`
+}
+
+func (s *ClusterSource) String() string {
+	if s.Namespace == "" {
+		return fmt.Sprintf("%s/%s", s.Kind, s.Name)
+	}
+
+	return fmt.Sprintf("%s/%s in namespace %s", s.Kind, s.Name, s.Namespace)
+}
+
+// Loads the data of all ConfigMaps and Secrets listed in 'fromCluster',
+// with later objects taking precedence.
+func (ctx *Context) loadClusterVariables(options *LoadOptions) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+
+	for _, source := range ctx.FromCluster {
+		data, err := ctx.loadClusterSource(&source, options)
+		if err != nil {
+			return nil, err
+		}
+
+		vars = *util.Merge(&vars, &data)
+	}
+
+	return vars, nil
+}
+
+func (ctx *Context) loadClusterSource(source *ClusterSource, options *LoadOptions) (map[string]interface{}, error) {
+	kind := strings.ToLower(source.Kind)
+	if kind != "configmap" && kind != "secret" {
+		return nil, fmt.Errorf("fromCluster entry %s must be of kind 'configmap' or 'secret'", source)
+	}
+
+	kubectl := options.Kubectl
+	if kubectl == "" {
+		kubectl = "kubectl"
+	}
+
+	kubeContext := options.KubeContext
+	if kubeContext == "" {
+		kubeContext = ctx.KubectlContext()
+	}
+
+	args := []string{"get", fmt.Sprintf("%s/%s", kind, source.Name), "-o", "json"}
+	if source.Namespace != "" {
+		args = append(args, fmt.Sprintf("--namespace=%s", source.Namespace))
+	}
+	if kubeContext != "" {
+		args = append(args, fmt.Sprintf("--context=%s", kubeContext))
+	}
+	if options.KubeConfig != "" {
+		args = append(args, fmt.Sprintf("--kubeconfig=%s", options.KubeConfig))
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(kubectl, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := util.RunCommand(cmd, options.Timeout); err != nil {
+		return nil, fmt.Errorf("could not read %s from the cluster: %v: %s", source, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var object struct {
+		Data map[string]string `json:"data"`
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), &object); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", source, err)
+	}
+
+	vars := make(map[string]interface{}, len(object.Data))
+	for key, value := range object.Data {
+		if kind == "secret" {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("could not decode key %s of %s: %v", key, source, err)
+			}
+			value = string(decoded)
+		}
+
+		vars[key] = value
+	}
+
+	return vars, nil
+}
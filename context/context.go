@@ -11,37 +11,107 @@ package context
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/tazjin/kontemplate/util"
 )
 
+// Filename that can be passed to LoadContext to read the context from
+// standard input instead of a file.
+const StdinFilename string = "-"
+
 type ResourceSet struct {
 	// Name of the resource set. This can be used in include/exclude statements during kontemplate runs.
 	Name string `json:"name"`
 
-	// Path to the folder containing the files for this resource set. This defaults to the value of the 'name' field
-	// if unset.
+	// Path to the folder containing the files for this resource set, which may be outside of the directory of the
+	// cluster configuration. Relative paths are resolved against the base directory (or the path of the parent
+	// for nested resource sets), absolute paths are used as they are. This defaults to the value of the 'name'
+	// field if unset.
 	Path string `json:"path"`
 
 	// Values to include when interpolating resources from this resource set.
 	Values map[string]interface{} `json:"values"`
 
-	// Args to pass on to kubectl for this resource set.
+	// Additional arguments to pass on to kubectl for this resource set, for example '--force-conflicts'.
+	KubectlArgs []string `json:"kubectlArgs"`
+
+	// Deprecated alias of KubectlArgs. It can not be combined with KubectlArgs.
 	Args []string `json:"args"`
 
+	// Whether the resource set was configured with the deprecated Args field, which is resolved into KubectlArgs
+	// while loading.
+	DeprecatedArgs bool `json:"-"`
+
+	// Namespace into which the resources of this resource set are deployed.
+	Namespace string `json:"namespace"`
+
 	// Nested resource sets to include
 	Include []ResourceSet `json:"include"`
 
+	// Glob patterns of file names to template from the resource set folder. If set, only matching files are
+	// templated.
+	IncludeFiles []string `json:"includeFiles"`
+
+	// Glob patterns of file names in the resource set folder that should not be templated.
+	ExcludeFiles []string `json:"excludeFiles"`
+
+	// Skip files whose names begin with '_' or '.', for example partials or editor files.
+	SkipPrefixedFiles bool `json:"skipPrefixedFiles"`
+
+	// Hide the rendered resources of this resource set in diagnostic output, for example if they contain
+	// secrets. They are still passed to kubectl.
+	Sensitive bool `json:"sensitive"`
+
+	// Type of the resource set. Resource sets of type "kustomize" are built with 'kubectl kustomize' from the
+	// kustomization in their path instead of being templated, and the files of resource sets of type "raw"
+	// are used verbatim.
+	Type string `json:"type"`
+
+	// Template files in subdirectories of the resource set folder as well.
+	Recursive bool `json:"recursive"`
+
+	// Remote git repository containing the templates of this resource set. If set, the path is resolved relative
+	// to the repository.
+	Git *GitSource `json:"git"`
+
+	// Optional position of this resource set when applying. Resource sets with an explicit order are applied in
+	// ascending order before all other resource sets.
+	Order *int `json:"order"`
+
+	// Condition under which this resource set is templated, either a boolean, the name of a boolean variable or a
+	// template evaluating to "true" or "false". Resource sets are enabled if this is unset.
+	Enabled interface{} `json:"enabled"`
+
+	// Left and right delimiters of the template actions in the files of this resource set, for example
+	// ["[[", "]]"]. Defaults to "{{" and "}}" if unset.
+	Delimiters []string `json:"delimiters"`
+
+	// Whether resources removed from this resource set are deleted when applying with '--prune'. Resource sets
+	// are pruned by default.
+	Prune *bool `json:"prune"`
+
 	// Parent resource set for flattened resource sets. Should not be manually specified.
 	Parent string
 }
 
 type Context struct {
-	// The name of the kubectl context
+	// The name of the cluster configuration, which is also used as the kubectl context unless KubeContext is set
 	Name string `json:"context"`
 
+	// The name of the kubectl context, if it differs from the name of the cluster configuration
+	KubeContext string `json:"kubeContext"`
+
+	// Names of kubectl contexts to which the resources are applied one after another, rendering them separately
+	// for each context. This takes precedence over KubeContext.
+	Contexts []string `json:"contexts"`
+
 	// Global variables that should be accessible by all resource sets
 	Global map[string]interface{} `json:"global"`
 
@@ -51,14 +121,105 @@ type Context struct {
 	// The resource sets to include in this context
 	ResourceSets []ResourceSet `json:"include"`
 
-	// Variables imported from additional files
+	// ConfigMaps and Secrets in the cluster whose data should be imported as variables
+	FromCluster []ClusterSource `json:"fromCluster"`
+
+	// Commands that templates can call as functions, keyed by function name. Relative command paths are resolved
+	// against the context base directory.
+	TemplateFunctions map[string]string `json:"templateFunctions"`
+
+	// Organisation-wide default variables (via `--global-vars` or a kontemplate.defaults.yaml file in the base
+	// directory), which have the lowest precedence of all variables
+	GlobalVars map[string]interface{}
+
+	// Variables imported from additional files and from the cluster
 	ImportedVars map[string]interface{}
 
+	// Variables from prefixed environment variables (via `--var-env-prefix`)
+	EnvValues []SetValue
+
 	// Explicitly set variables (via `--var`) that should override all others
 	ExplicitVars map[string]interface{}
 
+	// Variable overrides (via `--set` and `--set-string`) that are applied after all other variables are merged
+	SetValues []SetValue
+
 	// This field represents the absolute path to the context base directory and should not be manually specified.
 	BaseDir string
+
+	// Sources of the variables of each resource set, keyed by resource set name. Only recorded if the context is
+	// loaded with the RecordSources option.
+	Sources map[string][]ValueSource `json:"-"`
+}
+
+// Returns the name of the kubectl context to use, which is the
+// explicitly configured kubeContext or, for compatibility, the name
+// of the cluster configuration.
+func (ctx *Context) KubectlContext() string {
+	if ctx.KubeContext != "" {
+		return ctx.KubeContext
+	}
+
+	return ctx.Name
+}
+
+// Options that control how a context is loaded.
+type LoadOptions struct {
+	// Directory against which resource set paths and imports are resolved. Defaults to the directory containing the
+	// context file (or the current working directory for stdin).
+	BaseDir string
+
+	// Variables set explicitly on the command line (via `--var`) in the form `name=value`.
+	ExplicitVars []string
+
+	// Prefix of environment variables that are loaded as variables (via `--var-env-prefix`), see parseEnvValues.
+	VarEnvPrefix string
+
+	// Helm-style variable overrides (via `--set`) in the form `foo.bar=baz`. Values are converted to booleans or
+	// numbers where possible.
+	SetValues []string
+
+	// Helm-style variable overrides (via `--set-string`) whose values are always strings. These are applied after
+	// SetValues.
+	SetStringValues []string
+
+	// File of default variables that are merged into every resource set with the lowest precedence (via
+	// `--global-vars`). Defaults to the GlobalVarsFilename in the base directory, if it exists.
+	GlobalVarsFile string
+
+	// Directory in which remote git repositories of resource sets are cached. Defaults to DefaultCacheDir().
+	CacheDir string
+
+	// Fetch remote git repositories of resource sets again, even if they are cached.
+	RefreshGit bool
+
+	// Fail loading if the context references an unset environment variable, instead of expanding it to an empty string.
+	StrictEnv bool
+
+	// Render the context file as a template before parsing it, see templateContextFile.
+	TemplateContext bool
+
+	// Decrypt imported variable files that are encrypted with SOPS. Loading fails for such files if this is not set.
+	Decrypt bool
+
+	// Record where the variables of each resource set come from, which can be inspected with ExplainValue.
+	RecordSources bool
+
+	// Load variables from the cluster (see 'fromCluster'). If this is not set, 'fromCluster' is ignored and the
+	// cluster is not contacted.
+	LoadFromCluster bool
+
+	// Path of the kubectl binary used to load variables from the cluster. Defaults to "kubectl".
+	Kubectl string
+
+	// kubectl context from which variables are loaded, overriding the context of the cluster configuration.
+	KubeContext string
+
+	// kubeconfig file used to load variables from the cluster.
+	KubeConfig string
+
+	// Time after which loading variables from the cluster is aborted. Zero means no timeout.
+	Timeout time.Duration
 }
 
 func contextLoadingError(filename string, cause error) error {
@@ -66,62 +227,208 @@ func contextLoadingError(filename string, cause error) error {
 }
 
 // Attempt to load and deserialise a Context from the specified file.
-func LoadContext(filename string, explicitVars *[]string) (*Context, error) {
+//
+// If the filename is "-" the context is read from standard input
+// instead. Resource set paths and imports are resolved relative to the
+// base directory in the options if it is set, otherwise relative to the
+// directory containing the context file (or the current working
+// directory for stdin).
+func LoadContext(filename string, options *LoadOptions) (*Context, error) {
+	ctx, err := readContext(filename, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return prepareContext(ctx, filename, options)
+}
+
+// Reads a context file and expands the environment variables in it,
+// without resolving any of its contents.
+func readContext(filename string, options *LoadOptions) (*Context, error) {
 	var ctx Context
-	err := util.LoadData(filename, &ctx)
 
+	data, err := readContextFile(filename)
 	if err != nil {
 		return nil, contextLoadingError(filename, err)
 	}
 
-	ctx.BaseDir = path.Dir(filename)
+	// Templating the context file is opt-in, as it changes the
+	// meaning of '{{' in it.
+	if options.TemplateContext {
+		if data, err = templateContextFile(filename, data); err != nil {
+			return nil, contextLoadingError(filename, err)
+		}
+	}
+
+	if err = util.UnmarshalData(filename, data, &ctx); err != nil {
+		return nil, contextLoadingError(filename, err)
+	}
+
+	// Expand references to environment variables before any of
+	// the values are used.
+	if err = ctx.expandEnvVars(options.StrictEnv); err != nil {
+		return nil, contextLoadingError(filename, err)
+	}
+
+	return &ctx, nil
+}
+
+// Resolves the resource sets and variables of a context that has been
+// read from the specified file.
+func prepareContext(ctx *Context, filename string, options *LoadOptions) (*Context, error) {
+	var err error
+
+	ctx.BaseDir, err = resolveBaseDir(filename, options.BaseDir)
+	if err != nil {
+		return nil, contextLoadingError(filename, err)
+	}
+
+	cacheDir := options.CacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultCacheDir()
+	}
 
 	// Prepare the resource sets by resolving parents etc.
-	ctx.ResourceSets = flattenPrepareResourceSetPaths(&ctx.BaseDir, &ctx.ResourceSets)
+	ctx.ResourceSets = flattenPrepareResourceSetPaths(&ctx.BaseDir, cacheDir, &ctx.ResourceSets)
+	sortResourceSets(ctx.ResourceSets)
+
+	if err = resolveKubectlArgs(ctx.ResourceSets); err != nil {
+		return nil, contextLoadingError(filename, err)
+	}
+
+	if err = validateTemplateFunctions(ctx.TemplateFunctions); err != nil {
+		return nil, contextLoadingError(filename, err)
+	}
+
+	// Fetch resource sets from git before their default values
+	// are loaded.
+	if err = ctx.fetchGitSources(cacheDir, options.RefreshGit); err != nil {
+		return nil, contextLoadingError(filename, err)
+	}
 
 	// Add variables explicitly specified on the command line
-	ctx.ExplicitVars, err = loadExplicitVars(explicitVars)
+	ctx.ExplicitVars, err = loadExplicitVars(&options.ExplicitVars)
 	if err != nil {
 		return nil, fmt.Errorf("Error setting explicit variables: %v\n", err)
 	}
 
+	// Add variables from prefixed environment variables
+	ctx.EnvValues, err = parseEnvValues(os.Environ(), options.VarEnvPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading variables from the environment: %v\n", err)
+	}
+
+	// Add variable overrides specified on the command line
+	ctx.SetValues, err = loadSetValues(options)
+	if err != nil {
+		return nil, fmt.Errorf("Error setting variable overrides: %v\n", err)
+	}
+
+	// Add organisation-wide default variables
+	ctx.GlobalVars, err = loadGlobalVariables(ctx.BaseDir, options)
+	if err != nil {
+		return nil, contextLoadingError(filename, err)
+	}
+
 	// Add variables loaded from import files
-	ctx.ImportedVars, err = ctx.loadImportedVariables()
+	ctx.ImportedVars, err = ctx.loadImportedVariables(options.Decrypt)
 	if err != nil {
 		return nil, contextLoadingError(filename, err)
 	}
 
+	// Variables from the cluster take precedence over imported
+	// files.
+	if options.LoadFromCluster && len(ctx.FromCluster) > 0 {
+		clusterVars, err := ctx.loadClusterVariables(options)
+		if err != nil {
+			return nil, contextLoadingError(filename, err)
+		}
+
+		ctx.ImportedVars = *util.Merge(&ctx.ImportedVars, &clusterVars)
+	}
+
 	// Merge variables defined at different levels. The
 	// `mergeContextValues` function is documented with the merge
 	// hierarchy.
+	if options.RecordSources {
+		ctx.Sources = ctx.valueSources()
+	}
 	ctx.ResourceSets = ctx.mergeContextValues()
 
 	if err != nil {
 		return nil, contextLoadingError(filename, err)
 	}
 
-	return &ctx, nil
+	return ctx, nil
+}
+
+func readContextFile(filename string) ([]byte, error) {
+	if filename == StdinFilename {
+		return ioutil.ReadAll(os.Stdin)
+	}
+
+	return ioutil.ReadFile(filename)
+}
+
+// Determines the directory against which relative paths in the
+// context are resolved. An explicitly specified base directory always
+// takes precedence.
+func resolveBaseDir(filename string, baseDir string) (string, error) {
+	if baseDir != "" {
+		return baseDir, nil
+	}
+
+	if filename == StdinFilename {
+		return os.Getwd()
+	}
+
+	return path.Dir(filename), nil
 }
 
 // Kontemplate supports specifying additional variable files with the
 // `import` keyword. This function loads those variable files and
 // merges them together with the context's other global variables.
-func (ctx *Context) loadImportedVariables() (map[string]interface{}, error) {
+//
+// Variable files can themselves import further variable files using
+// an `import` key. Later imports override earlier ones and the values
+// in a file override the values it imports.
+func (ctx *Context) loadImportedVariables(decrypt bool) (map[string]interface{}, error) {
+	return loadVariableFiles(ctx.BaseDir, ctx.VariableImportFiles, []string{}, decrypt)
+}
+
+// Name of the file of organisation-wide default variables that is
+// loaded from the base directory if no --global-vars file is given.
+const GlobalVarsFilename = "kontemplate.defaults.yaml"
+
+// Loads the organisation-wide default variables. An explicitly given
+// file must exist and is resolved against the working directory, like
+// other files given on the command line.
+func loadGlobalVariables(baseDir string, options *LoadOptions) (map[string]interface{}, error) {
+	file := options.GlobalVarsFile
+	if file == "" {
+		file = path.Join(baseDir, GlobalVarsFilename)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+
+	return loadVariableFile(file, []string{}, options.Decrypt)
+}
+
+func loadVariableFiles(baseDir string, files []string, chain []string, decrypt bool) (map[string]interface{}, error) {
 	allImportedVars := make(map[string]interface{})
 
-	for _, file := range ctx.VariableImportFiles {
+	for _, file := range files {
 		// Ensure that the filename is not merged with the baseDir if
 		// it is set to an absolute path.
 		var filePath string
 		if path.IsAbs(file) {
 			filePath = file
 		} else {
-			filePath = path.Join(ctx.BaseDir, file)
+			filePath = path.Join(baseDir, file)
 		}
 
-		var importedVars map[string]interface{}
-		err := util.LoadData(filePath, &importedVars)
-
+		importedVars, err := loadVariableFile(filePath, chain, decrypt)
 		if err != nil {
 			return nil, err
 		}
@@ -132,46 +439,218 @@ func (ctx *Context) loadImportedVariables() (map[string]interface{}, error) {
 	return allImportedVars, nil
 }
 
+func loadVariableFile(filePath string, chain []string, decrypt bool) (map[string]interface{}, error) {
+	for _, imported := range chain {
+		if imported == filePath {
+			cycle := strings.Join(append(chain, filePath), " -> ")
+			return nil, fmt.Errorf("circular variable import: %s", cycle)
+		}
+	}
+
+	var importedVars map[string]interface{}
+	err := util.LoadData(filePath, &importedVars)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Files encrypted with SOPS are only decrypted if explicitly
+	// requested, so that secrets are not rendered by accident.
+	if isSopsEncrypted(importedVars) {
+		if !decrypt {
+			return nil, fmt.Errorf("%s is encrypted with SOPS, pass --decrypt to decrypt it", filePath)
+		}
+
+		importedVars, err = decryptSopsFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nested, ok := importedVars["import"]
+	if !ok {
+		return importedVars, nil
+	}
+
+	nestedFiles, err := parseImportList(nested)
+	if err != nil {
+		return nil, fmt.Errorf("invalid imports in %s: %v", filePath, err)
+	}
+
+	nestedVars, err := loadVariableFiles(path.Dir(filePath), nestedFiles, append(chain, filePath), decrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(importedVars, "import")
+	return *util.Merge(&nestedVars, &importedVars), nil
+}
+
+func parseImportList(v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'import' must be a list of file names")
+	}
+
+	files := make([]string, len(list))
+	for i, file := range list {
+		if files[i], ok = file.(string); !ok {
+			return nil, fmt.Errorf("'import' must be a list of file names")
+		}
+	}
+
+	return files, nil
+}
+
 // Correctly prepares the file paths for resource sets by inferring implicit paths and flattening resource set
 // collections, i.e. resource sets that themselves have an additional 'include' field set.
 // Those will be regarded as a short-hand for including multiple resource sets from a subfolder.
 // See https://github.com/tazjin/kontemplate/issues/9 for more information.
-func flattenPrepareResourceSetPaths(baseDir *string, rs *[]ResourceSet) []ResourceSet {
+func flattenPrepareResourceSetPaths(baseDir *string, cacheDir string, rs *[]ResourceSet) []ResourceSet {
 	flattened := make([]ResourceSet, 0)
 
 	for _, r := range *rs {
-		// If a path is not explicitly specified it should default to the resource set name.
-		// This is also the classic behaviour prior to kontemplate 1.2
-		if r.Path == "" {
-			r.Path = r.Name
-		}
+		if r.Git != nil {
+			// Resource sets from git are located in the
+			// checkout of their repository.
+			r.Path = path.Join(r.Git.checkoutDir(cacheDir), r.Git.Path)
+		} else {
+			// If a path is not explicitly specified it should default to the resource set name.
+			// This is also the classic behaviour prior to kontemplate 1.2
+			if r.Path == "" {
+				r.Path = r.Name
+			}
 
-		// Paths are made absolute by resolving them relative to the context base,
-		// unless absolute paths were specified.
-		if !path.IsAbs(r.Path) {
-			r.Path = path.Join(*baseDir, r.Path)
+			// Paths are made absolute by resolving them relative to the context base,
+			// unless absolute paths were specified.
+			if !path.IsAbs(r.Path) {
+				r.Path = path.Join(*baseDir, r.Path)
+			}
 		}
 
-		if len(r.Include) == 0 {
-			flattened = append(flattened, r)
+		flattened = append(flattened, flattenResourceSet(r, cacheDir)...)
+	}
+
+	return flattened
+}
+
+// Flattens a resource set that includes nested resource sets into the
+// list of its innermost resource sets. Nested resource sets can be
+// nested arbitrarily deep and inherit the variables, order, namespace
+// and enabled condition of their parents, which they can override.
+func flattenResourceSet(r ResourceSet, cacheDir string) []ResourceSet {
+	if len(r.Include) == 0 {
+		return []ResourceSet{r}
+	}
+
+	flattened := make([]ResourceSet, 0)
+
+	for _, subResourceSet := range r.Include {
+		if subResourceSet.Git != nil {
+			subResourceSet.Path = path.Join(subResourceSet.Git.checkoutDir(cacheDir), subResourceSet.Git.Path)
 		} else {
-			for _, subResourceSet := range r.Include {
-				if subResourceSet.Path == "" {
-					subResourceSet.Path = subResourceSet.Name
-				}
+			if subResourceSet.Path == "" {
+				subResourceSet.Path = subResourceSet.Name
+			}
 
-				subResourceSet.Parent = r.Name
-				subResourceSet.Name = path.Join(r.Name, subResourceSet.Name)
+			if !path.IsAbs(subResourceSet.Path) {
 				subResourceSet.Path = path.Join(r.Path, subResourceSet.Path)
-				subResourceSet.Values = *util.Merge(&r.Values, &subResourceSet.Values)
-				flattened = append(flattened, subResourceSet)
 			}
 		}
+
+		subResourceSet.Parent = r.Name
+		subResourceSet.Name = path.Join(r.Name, subResourceSet.Name)
+		subResourceSet.Values = *util.Merge(&r.Values, &subResourceSet.Values)
+
+		if subResourceSet.Order == nil {
+			subResourceSet.Order = r.Order
+		}
+
+		if subResourceSet.Namespace == "" {
+			subResourceSet.Namespace = r.Namespace
+		}
+
+		if subResourceSet.Enabled == nil {
+			subResourceSet.Enabled = r.Enabled
+		}
+
+		if subResourceSet.Prune == nil {
+			subResourceSet.Prune = r.Prune
+		}
+
+		if subResourceSet.Delimiters == nil {
+			subResourceSet.Delimiters = r.Delimiters
+		}
+
+		subResourceSet.Sensitive = subResourceSet.Sensitive || r.Sensitive
+
+		// Nested resource sets of a resource set from git are
+		// fetched from the same repository.
+		if subResourceSet.Git == nil && r.Git != nil {
+			subResourceSet.Git = r.Git
+		}
+
+		flattened = append(flattened, flattenResourceSet(subResourceSet, cacheDir)...)
 	}
 
 	return flattened
 }
 
+// Resolves the deprecated 'args' field of resource sets, which is an
+// alias of 'kubectlArgs' for all types of resource sets as every type
+// is passed to kubectl.
+func resolveKubectlArgs(rs []ResourceSet) error {
+	for i := range rs {
+		if rs[i].Args == nil {
+			continue
+		}
+
+		if rs[i].KubectlArgs != nil {
+			return fmt.Errorf("resource set '%s' sets both 'args' and 'kubectlArgs', please only use 'kubectlArgs'", rs[i].Name)
+		}
+
+		rs[i].KubectlArgs = rs[i].Args
+		rs[i].DeprecatedArgs = true
+	}
+
+	return nil
+}
+
+var functionName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Checks that template functions have names that can be called from
+// templates and a command to run.
+func validateTemplateFunctions(functions map[string]string) error {
+	for name, command := range functions {
+		if !functionName.MatchString(name) {
+			return fmt.Errorf("template function name '%s' is not a valid identifier", name)
+		}
+
+		if strings.TrimSpace(command) == "" {
+			return fmt.Errorf("template function '%s' has no command", name)
+		}
+	}
+
+	return nil
+}
+
+// Sorts resource sets by their explicit order. Resource sets without
+// an explicit order retain the order in which they were specified and
+// are placed after all ordered resource sets.
+func sortResourceSets(rs []ResourceSet) {
+	sort.SliceStable(rs, func(i, j int) bool {
+		if rs[i].Order == nil {
+			return false
+		}
+
+		if rs[j].Order == nil {
+			return true
+		}
+
+		return *rs[i].Order < *rs[j].Order
+	})
+}
+
 // Merges the context and resource set variables according in the
 // desired precedence order.
 //
@@ -179,11 +658,14 @@ func flattenPrepareResourceSetPaths(baseDir *string, rs *[]ResourceSet) []Resour
 // in relation to the cluster configuration, which means that the
 // precedence is (in ascending order):
 //
-// 1. Default values in resource sets.
-// 2. Values imported from files (via `import:`)
-// 3. Global values in a cluster configuration
-// 4. Values set in a resource set's `include`-section
-// 5. Explicit values set on the CLI (`--var`)
+// 1. Organisation-wide defaults (`--global-vars`)
+// 2. Default values in resource sets.
+// 3. Values imported from files (via `import:`)
+// 4. Global values in a cluster configuration
+// 5. Values set in a resource set's `include`-section
+// 6. Values from prefixed environment variables (`--var-env-prefix`)
+// 7. Explicit values set on the CLI (`--var`)
+// 8. Variable overrides set on the CLI (`--set`, then `--set-string`)
 //
 // For a discussion on the reasoning behind this order, please consult
 // https://github.com/tazjin/kontemplate/issues/142
@@ -199,7 +681,10 @@ func (ctx *Context) mergeContextValues() []ResourceSet {
 		// Resource sets are used across different cluster
 		// contexts and the default values in them have the
 		// lowest precedence.
-		defaultValues := loadDefaultValues(&rs, ctx)
+		//
+		// Only organisation-wide defaults, which apply to all
+		// resource sets, are less specific.
+		defaultValues := util.Merge(&ctx.GlobalVars, loadDefaultValues(&rs, ctx))
 
 		// Continue by merging default values with values
 		// imported from external files. Those values are also
@@ -214,11 +699,23 @@ func (ctx *Context) mergeContextValues() []ResourceSet {
 		// `include` section:
 		merged = util.Merge(merged, &rs.Values)
 
+		// Apply variables from the environment, which are nested
+		// like overrides:
+		if len(ctx.EnvValues) > 0 {
+			env := applySetValues(*merged, ctx.EnvValues)
+			merged = &env
+		}
+
 		// Merge values defined explicitly on the CLI:
 		merged = util.Merge(merged, &ctx.ExplicitVars)
 
-		// Continue with the newly merged resource set:
+		// Continue with the newly merged resource set after
+		// applying variable overrides, which may refer to
+		// nested values:
 		rs.Values = *merged
+		if len(ctx.SetValues) > 0 {
+			rs.Values = applySetValues(rs.Values, ctx.SetValues)
+		}
 		updated[i] = rs
 	}
 
@@ -248,6 +745,20 @@ func loadDefaultValues(rs *ResourceSet, c *Context) *map[string]interface{} {
 	return &rs.Values
 }
 
+func loadSetValues(options *LoadOptions) ([]SetValue, error) {
+	setValues, err := parseSetValues(options.SetValues, false)
+	if err != nil {
+		return nil, err
+	}
+
+	setStringValues, err := parseSetValues(options.SetStringValues, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(setValues, setStringValues...), nil
+}
+
 // Prepares the variables specified explicitly via `--var` when
 // executing kontemplate for adding to the context.
 func loadExplicitVars(vars *[]string) (map[string]interface{}, error) {
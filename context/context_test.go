@@ -10,14 +10,20 @@
 package context
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
-var noExplicitVars []string = make([]string, 0)
+var noOptions LoadOptions
 
 func TestLoadFlatContextFromFile(t *testing.T) {
-	ctx, err := LoadContext("testdata/flat-test.yaml", &noExplicitVars)
+	ctx, err := LoadContext("testdata/flat-test.yaml", &noOptions)
 
 	if err != nil {
 		t.Error(err)
@@ -55,28 +61,33 @@ func TestLoadFlatContextFromFile(t *testing.T) {
 }
 
 func TestLoadContextWithArgs(t *testing.T) {
-	ctx, err := LoadContext("testdata/flat-with-args-test.yaml", &noExplicitVars)
+	ctx, err := LoadContext("testdata/flat-with-args-test.yaml", &noOptions)
 
 	if err != nil {
 		t.Error(err)
 		t.Fail()
 	}
 
+	args := []string{
+		"--as=some-user",
+		"--as-group=hello:world",
+		"--as-banana",
+		"true",
+	}
+
+	// The deprecated 'args' field is an alias of 'kubectlArgs'.
 	expected := Context{
 		Name: "k8s.prod.mydomain.com",
 		ResourceSets: []ResourceSet{
 			{
-				Name:   "some-api",
-				Path:   "testdata/some-api",
-				Values: make(map[string]interface{}, 0),
-				Args: []string{
-					"--as=some-user",
-					"--as-group=hello:world",
-					"--as-banana",
-					"true",
-				},
-				Include: nil,
-				Parent:  "",
+				Name:        "some-api",
+				Path:        "testdata/some-api",
+				Values:      make(map[string]interface{}, 0),
+				KubectlArgs:    args,
+				Args:           args,
+				DeprecatedArgs: true,
+				Include:        nil,
+				Parent:         "",
 			},
 		},
 		BaseDir:      "testdata",
@@ -90,8 +101,42 @@ func TestLoadContextWithArgs(t *testing.T) {
 	}
 }
 
+func TestLoadContextWithKubectlArgs(t *testing.T) {
+	ctx, err := LoadContext("testdata/kubectl-args.yaml", &noOptions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := map[string][]string{
+		"some-api":   {"--force-conflicts"},
+		"kustomized": {"--record"},
+		"aliased":    {"--as=some-user"},
+		"no-args":    nil,
+	}
+
+	for _, rs := range ctx.ResourceSets {
+		if !reflect.DeepEqual(expected[rs.Name], rs.KubectlArgs) {
+			t.Errorf("Unexpected kubectl args of %s: %v\n", rs.Name, rs.KubectlArgs)
+		}
+	}
+}
+
+func TestLoadContextWithConflictingArgs(t *testing.T) {
+	_, err := LoadContext("testdata/conflicting-args.yaml", &noOptions)
+	if err == nil || !strings.Contains(err.Error(), "sets both 'args' and 'kubectlArgs'") {
+		t.Errorf("Expected resource set with 'args' and 'kubectlArgs' to fail, got: %v\n", err)
+	}
+}
+
+func TestInvalidTemplateFunctions(t *testing.T) {
+	_, err := LoadContext("testdata/invalid-template-functions.yaml", &noOptions)
+	if err == nil || !strings.Contains(err.Error(), "'dns-name' is not a valid identifier") {
+		t.Errorf("Expected invalid template function name to fail, got: %v\n", err)
+	}
+}
+
 func TestLoadContextWithResourceSetCollections(t *testing.T) {
-	ctx, err := LoadContext("testdata/collections-test.yaml", &noExplicitVars)
+	ctx, err := LoadContext("testdata/collections-test.yaml", &noOptions)
 
 	if err != nil {
 		t.Error(err)
@@ -140,7 +185,7 @@ func TestLoadContextWithResourceSetCollections(t *testing.T) {
 }
 
 func TestSubresourceVariableInheritance(t *testing.T) {
-	ctx, err := LoadContext("testdata/parent-variables.yaml", &noExplicitVars)
+	ctx, err := LoadContext("testdata/parent-variables.yaml", &noOptions)
 
 	if err != nil {
 		t.Error(err)
@@ -173,7 +218,7 @@ func TestSubresourceVariableInheritance(t *testing.T) {
 }
 
 func TestSubresourceVariableInheritanceOverride(t *testing.T) {
-	ctx, err := LoadContext("testdata/parent-variable-override.yaml", &noExplicitVars)
+	ctx, err := LoadContext("testdata/parent-variable-override.yaml", &noOptions)
 
 	if err != nil {
 		t.Error(err)
@@ -205,7 +250,7 @@ func TestSubresourceVariableInheritanceOverride(t *testing.T) {
 }
 
 func TestDefaultValuesLoading(t *testing.T) {
-	ctx, err := LoadContext("testdata/default-loading.yaml", &noExplicitVars)
+	ctx, err := LoadContext("testdata/default-loading.yaml", &noOptions)
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -224,7 +269,7 @@ func TestDefaultValuesLoading(t *testing.T) {
 }
 
 func TestImportValuesLoading(t *testing.T) {
-	ctx, err := LoadContext("testdata/import-vars-simple.yaml", &noExplicitVars)
+	ctx, err := LoadContext("testdata/import-vars-simple.yaml", &noOptions)
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -245,7 +290,7 @@ func TestImportValuesLoading(t *testing.T) {
 }
 
 func TestExplicitPathLoading(t *testing.T) {
-	ctx, err := LoadContext("testdata/explicit-path.yaml", &noExplicitVars)
+	ctx, err := LoadContext("testdata/explicit-path.yaml", &noOptions)
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -285,7 +330,7 @@ func TestExplicitPathLoading(t *testing.T) {
 }
 
 func TestExplicitSubresourcePathLoading(t *testing.T) {
-	ctx, err := LoadContext("testdata/explicit-subresource-path.yaml", &noExplicitVars)
+	ctx, err := LoadContext("testdata/explicit-subresource-path.yaml", &noOptions)
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -312,9 +357,33 @@ func TestExplicitSubresourcePathLoading(t *testing.T) {
 	}
 }
 
+func TestAbsoluteSubresourcePath(t *testing.T) {
+	baseDir := "testdata"
+	resourceSets := []ResourceSet{{
+		Name: "parent",
+		Include: []ResourceSet{
+			{Name: "relative"},
+			{Name: "shared", Path: "/srv/shared-lib/ingress"},
+		},
+	}}
+
+	flattened := flattenPrepareResourceSetPaths(&baseDir, "", &resourceSets)
+	if len(flattened) != 2 {
+		t.Fatalf("Expected two resource sets, got %v\n", flattened)
+	}
+
+	if flattened[0].Path != "testdata/parent/relative" {
+		t.Errorf("Expected relative path to be resolved against the parent, got %s\n", flattened[0].Path)
+	}
+
+	if flattened[1].Name != "parent/shared" || flattened[1].Path != "/srv/shared-lib/ingress" {
+		t.Errorf("Expected absolute path to be kept, got %s at %s\n", flattened[1].Name, flattened[1].Path)
+	}
+}
+
 func TestSetVariablesFromArguments(t *testing.T) {
 	vars := []string{"version=some-service-version"}
-	ctx, _ := LoadContext("testdata/default-loading.yaml", &vars)
+	ctx, _ := LoadContext("testdata/default-loading.yaml", &LoadOptions{ExplicitVars: vars})
 
 	if version := ctx.ExplicitVars["version"]; version != "some-service-version" {
 		t.Errorf(`Expected variable "version" to have value "some-service-version" but was "%s"`, version)
@@ -323,7 +392,7 @@ func TestSetVariablesFromArguments(t *testing.T) {
 
 func TestSetInvalidVariablesFromArguments(t *testing.T) {
 	vars := []string{"version: some-service-version"}
-	_, err := LoadContext("testdata/default-loading.yaml", &vars)
+	_, err := LoadContext("testdata/default-loading.yaml", &LoadOptions{ExplicitVars: vars})
 
 	if err == nil {
 		t.Error("Expected invalid variable to return an error")
@@ -334,7 +403,7 @@ func TestSetInvalidVariablesFromArguments(t *testing.T) {
 // Please consult the test data in `testdata/merging`.
 func TestValueMergePrecedence(t *testing.T) {
 	cliVars:= []string{"cliVar=cliVar"}
-	ctx, _ := LoadContext("testdata/merging/context.yaml", &cliVars)
+	ctx, _ := LoadContext("testdata/merging/context.yaml", &LoadOptions{ExplicitVars: cliVars})
 
 	expected := map[string]interface{}{
 		"defaultVar": "defaultVar",
@@ -351,3 +420,716 @@ func TestValueMergePrecedence(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestExplicitBaseDir(t *testing.T) {
+	ctx, err := LoadContext("testdata/flat-test.yaml", &LoadOptions{BaseDir: "/srv/kontemplate"})
+	if err != nil {
+		t.Error(err)
+		t.Fail()
+	}
+
+	if ctx.BaseDir != "/srv/kontemplate" {
+		t.Errorf("Expected explicit base directory to be used, but was %s", ctx.BaseDir)
+	}
+
+	if ctx.ResourceSets[0].Path != "/srv/kontemplate/some-api" {
+		t.Errorf("Resource set path was not resolved against base directory: %s", ctx.ResourceSets[0].Path)
+	}
+}
+
+func TestLoadContextFromStdin(t *testing.T) {
+	file, err := os.Open("testdata/flat-test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	stdin := os.Stdin
+	os.Stdin = file
+	defer func() { os.Stdin = stdin }()
+
+	ctx, err := LoadContext("-", &LoadOptions{BaseDir: "testdata"})
+	if err != nil {
+		t.Error(err)
+		t.Fail()
+	}
+
+	if ctx.Name != "k8s.prod.mydomain.com" {
+		t.Errorf("Context read from stdin has unexpected name %s", ctx.Name)
+	}
+
+	if ctx.ResourceSets[0].Path != "testdata/some-api" {
+		t.Errorf("Resource set path was not resolved against base directory: %s", ctx.ResourceSets[0].Path)
+	}
+}
+
+func TestResourceSetOrdering(t *testing.T) {
+	ctx, err := LoadContext("testdata/ordering.yaml", &noOptions)
+	if err != nil {
+		t.Error(err)
+		t.Fail()
+	}
+
+	expected := []string{
+		"namespaces",
+		"crds/certificates",
+		"crds/monitoring",
+		"deployments",
+		"unordered-first",
+		"unordered-second",
+	}
+
+	result := make([]string, len(ctx.ResourceSets))
+	for i, rs := range ctx.ResourceSets {
+		result[i] = rs.Name
+	}
+
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Resource sets were not ordered correctly: \n%v", result)
+		t.Fail()
+	}
+}
+
+func TestEnvVarExpansion(t *testing.T) {
+	os.Setenv("KONTEMPLATE_TEST_CONTEXT", "k8s.test.mydomain.com")
+	os.Setenv("KONTEMPLATE_TEST_TOKEN", "secret")
+	os.Unsetenv("KONTEMPLATE_TEST_MISSING")
+
+	ctx, err := LoadContext("testdata/env-vars.yaml", &noOptions)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if ctx.Name != "k8s.test.mydomain.com" {
+		t.Errorf("Context name was not expanded: %s", ctx.Name)
+	}
+
+	expected := map[string]interface{}{
+		"token":   "Bearer secret",
+		"literal": "$KONTEMPLATE_TEST_TOKEN",
+		"nested": map[string]interface{}{
+			"list":    []interface{}{"secret"},
+			"missing": "[]",
+		},
+	}
+
+	if !reflect.DeepEqual(expected, ctx.ResourceSets[0].Values) {
+		t.Errorf("Expanded values did not match expected result: \n%v", ctx.ResourceSets[0].Values)
+		t.Fail()
+	}
+}
+
+func TestStrictEnvVarExpansion(t *testing.T) {
+	os.Setenv("KONTEMPLATE_TEST_CONTEXT", "k8s.test.mydomain.com")
+	os.Setenv("KONTEMPLATE_TEST_TOKEN", "secret")
+	os.Unsetenv("KONTEMPLATE_TEST_MISSING")
+
+	_, err := LoadContext("testdata/env-vars.yaml", &LoadOptions{StrictEnv: true})
+	if err == nil {
+		t.Error("Expected missing environment variable to return an error")
+		t.FailNow()
+	}
+
+	if !strings.Contains(err.Error(), "KONTEMPLATE_TEST_MISSING") {
+		t.Errorf("Loading failed with unexpected error: %v", err)
+	}
+}
+
+func TestNamespaceInheritance(t *testing.T) {
+	ctx, err := LoadContext("testdata/namespaces.yaml", &noOptions)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if ns := ctx.ResourceSets[0].Namespace; ns != "monitoring" {
+		t.Errorf("Expected nested resource set to inherit namespace, but was '%s'", ns)
+	}
+
+	if ns := ctx.ResourceSets[1].Namespace; ns != "kube-system" {
+		t.Errorf("Expected nested resource set to override namespace, but was '%s'", ns)
+	}
+}
+
+func TestPruneInheritance(t *testing.T) {
+	ctx, err := LoadContext("testdata/prune.yaml", &noOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]*bool{
+		"rbac/roles":    boolPtr(false),
+		"rbac/bindings": boolPtr(true),
+		"app":           nil,
+	}
+
+	for _, rs := range ctx.ResourceSets {
+		if !reflect.DeepEqual(expected[rs.Name], rs.Prune) {
+			t.Errorf("Unexpected prune setting for resource set '%s': %v\n", rs.Name, rs.Prune)
+		}
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestNestedImportValuesLoading(t *testing.T) {
+	ctx, err := LoadContext("testdata/nested-imports.yaml", &noOptions)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := map[string]interface{}{
+		"registry":    "registry.example.com",
+		"replicas":    float64(3),
+		"environment": "prod",
+	}
+
+	if !reflect.DeepEqual(ctx.ImportedVars, expected) {
+		t.Errorf("Nested imported values did not match expected result: \n%v", ctx.ImportedVars)
+		t.Fail()
+	}
+}
+
+func TestCircularImports(t *testing.T) {
+	_, err := LoadContext("testdata/circular-imports.yaml", &noOptions)
+	if err == nil {
+		t.Error("Expected circular imports to return an error")
+		t.FailNow()
+	}
+
+	chain := "testdata/circular-imports/a.yaml -> testdata/circular-imports/b.yaml -> testdata/circular-imports/a.yaml"
+	if !strings.Contains(err.Error(), chain) {
+		t.Errorf("Loading failed with unexpected error: %v", err)
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+	cases := map[string]interface{}{
+		"true":                 true,
+		"false":                false,
+		"null":                 nil,
+		"5":                    float64(5),
+		"-3":                   float64(-3),
+		"1.10":                 "1.10",
+		"0123":                 "0123",
+		"+5":                   "+5",
+		"1e3":                  "1e3",
+		"nan":                  "nan",
+		"inf":                  "inf",
+		"12345678901234567890": "12345678901234567890",
+		"9007199254740993":     "9007199254740993",
+		"v2":                   "v2",
+	}
+
+	for input, expected := range cases {
+		if result := typedValue(input); result != expected {
+			t.Errorf("Expected '%s' to be converted to %#v, but got %#v\n", input, expected, result)
+		}
+	}
+}
+
+func TestSetValues(t *testing.T) {
+	ctx, err := LoadContext("testdata/set-values.yaml", &LoadOptions{
+		SetValues:       []string{"replicas=5", "image.tag=v2,debug=true", "labels.team=payments"},
+		SetStringValues: []string{"image.pullSecret=123", "note=a\\,b"},
+	})
+
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := map[string]interface{}{
+		"replicas": float64(5),
+		"debug":    true,
+		"note":     "a,b",
+		"image": map[string]interface{}{
+			"name":       "some-api",
+			"tag":        "v2",
+			"pullSecret": "123",
+		},
+		"labels": map[string]interface{}{
+			"team": "payments",
+		},
+	}
+
+	if !reflect.DeepEqual(expected, ctx.ResourceSets[0].Values) {
+		t.Errorf("Overridden values did not match expected result: \n%v", ctx.ResourceSets[0].Values)
+	}
+
+	if ctx.Global["image"].(map[string]interface{})["tag"] != "v1" {
+		t.Error("Variable overrides modified the global variables")
+	}
+}
+
+func TestInvalidSetValues(t *testing.T) {
+	_, err := LoadContext("testdata/set-values.yaml", &LoadOptions{
+		SetValues: []string{"image..tag=v2"},
+	})
+
+	if err == nil {
+		t.Error("Expected invalid variable override to return an error")
+	}
+}
+
+func TestDeeplyNestedResourceSets(t *testing.T) {
+	ctx, err := LoadContext("testdata/deep-nesting.yaml", &noOptions)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := []ResourceSet{
+		{
+			Name: "platform/monitoring/grafana",
+			Path: "testdata/platform/monitoring/grafana",
+			Values: map[string]interface{}{
+				"team":     "platform",
+				"replicas": float64(2),
+			},
+			Parent: "platform/monitoring",
+		},
+		{
+			Name: "platform/monitoring/prometheus",
+			Path: "testdata/platform/monitoring/prom",
+			Values: map[string]interface{}{
+				"team":     "platform",
+				"replicas": float64(3),
+			},
+			Parent: "platform/monitoring",
+		},
+	}
+
+	if !reflect.DeepEqual(expected, ctx.ResourceSets) {
+		t.Errorf("Nested resource sets did not match expected result: \n%v", ctx.ResourceSets)
+		t.Fail()
+	}
+}
+
+func TestGitSourceLoading(t *testing.T) {
+	repo, err := ioutil.TempDir("", "kontemplate-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+
+	cacheDir, err := ioutil.TempDir("", "kontemplate-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	os.MkdirAll(path.Join(repo, "resources/api"), 0775)
+	ioutil.WriteFile(path.Join(repo, "resources/api/default.yaml"), []byte("fromGit: true\n"), 0664)
+
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "test"},
+		{"tag", "v1"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", repo}, args...)...).CombinedOutput(); err != nil {
+			t.Skipf("git is not usable in this environment: %s (%v)", out, err)
+		}
+	}
+
+	os.Setenv("KONTEMPLATE_TEST_GIT_URL", repo)
+	ctx, err := LoadContext("testdata/git-source.yaml", &LoadOptions{CacheDir: cacheDir})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	rs := ctx.ResourceSets[0]
+	if !strings.HasPrefix(rs.Path, cacheDir) || !strings.HasSuffix(rs.Path, "resources/api") {
+		t.Errorf("Resource set from git has unexpected path %s", rs.Path)
+	}
+
+	if rs.Values["fromGit"] != true {
+		t.Error("Default values were not loaded from git checkout")
+	}
+}
+
+func TestLoadMultipleContexts(t *testing.T) {
+	ctx, err := LoadContexts([]string{"testdata/overlays/base.yaml", "testdata/overlays/prod.yaml"}, &noOptions)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if ctx.Name != "k8s.prod.local" {
+		t.Errorf("Expected overlay to override the kubectl context, but got %s\n", ctx.Name)
+	}
+
+	expectedGlobal := map[string]interface{}{
+		"image": map[string]interface{}{
+			"name": "some-api",
+			"tag":  "v2",
+		},
+		"replicas": float64(1),
+		"domains":  []interface{}{"prod.local"},
+	}
+
+	if !reflect.DeepEqual(expectedGlobal, ctx.Global) {
+		t.Errorf("Merged global variables did not match expected result: \n%v", ctx.Global)
+	}
+
+	var names []string
+	for _, rs := range ctx.ResourceSets {
+		names = append(names, rs.Name)
+	}
+
+	if !reflect.DeepEqual([]string{"some-api", "monitoring", "ingress"}, names) {
+		t.Errorf("Unexpected merged resource sets: %v\n", names)
+	}
+
+	api := ctx.ResourceSets[0]
+	expectedResources := map[string]interface{}{
+		"cpu":    "100m",
+		"memory": "1Gi",
+	}
+
+	if api.Namespace != "api" || !reflect.DeepEqual(expectedResources, api.Values["resources"]) {
+		t.Errorf("Resource set was not merged with overlay: %v\n", api)
+	}
+
+	if api.Values["region"] != "prod" || api.Values["owner"] != "infra" {
+		t.Errorf("Imports of overlay did not override imports of base: %v\n", api.Values)
+	}
+}
+
+func TestSopsEncryptedImportRequiresDecrypt(t *testing.T) {
+	_, err := LoadContext("testdata/sops.yaml", &noOptions)
+	if err == nil || !strings.Contains(err.Error(), "pass --decrypt") {
+		t.Errorf("Expected loading SOPS file without --decrypt to fail, but got %v\n", err)
+	}
+}
+
+func TestSopsEncryptedImport(t *testing.T) {
+	defer func(cmd string) { sopsCommand = cmd }(sopsCommand)
+	sopsCommand = "testdata/sops/fake-sops.sh"
+
+	ctx, err := LoadContext("testdata/sops.yaml", &LoadOptions{Decrypt: true})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := map[string]interface{}{
+		"dbPassword": "hunter2",
+	}
+
+	if !reflect.DeepEqual(expected, ctx.ImportedVars) {
+		t.Errorf("Decrypted variables did not match expected result: \n%v", ctx.ImportedVars)
+	}
+}
+
+func TestIsSopsEncrypted(t *testing.T) {
+	cases := []struct {
+		vars     map[string]interface{}
+		expected bool
+	}{
+		{map[string]interface{}{"sops": map[string]interface{}{"mac": "ENC[...]", "version": "3.7.3"}}, true},
+		{map[string]interface{}{"sops": true}, false},
+		{map[string]interface{}{"sops": map[string]interface{}{"enabled": true}}, false},
+		{map[string]interface{}{"sops": map[string]interface{}{"version": "3.7.3"}}, false},
+		{map[string]interface{}{"dbPassword": "hunter2"}, false},
+	}
+
+	for _, c := range cases {
+		if result := isSopsEncrypted(c.vars); result != c.expected {
+			t.Errorf("Expected isSopsEncrypted(%v) to be %v, but got %v\n", c.vars, c.expected, result)
+		}
+	}
+}
+
+func TestExplainValue(t *testing.T) {
+	ctx, err := LoadContext("testdata/explain.yaml", &LoadOptions{
+		SetValues:     []string{"music.track=Set Track"},
+		RecordSources: true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error loading context: %v", err)
+	}
+
+	origin, err := ctx.ExplainValue("default", "override")
+	if err != nil {
+		t.Fatalf("Unexpected error explaining value: %v", err)
+	}
+
+	if origin.Value != "resource-set" || origin.Source != "values of resource set 'default'" {
+		t.Errorf("Unexpected origin of 'override': %v\n", origin)
+	}
+
+	if len(origin.Overridden) != 3 || !strings.HasPrefix(origin.Overridden[0], "default values in") ||
+		origin.Overridden[1] != "imported variables" || origin.Overridden[2] != "global variables" {
+		t.Errorf("Unexpected overridden sources of 'override': %v\n", origin.Overridden)
+	}
+
+	origin, _ = ctx.ExplainValue("default", "music.artist")
+	expected := &ValueOrigin{
+		Value:      "Global Artist",
+		Source:     "global variables",
+		Overridden: []string{"imported variables"},
+	}
+	if !reflect.DeepEqual(expected, origin) {
+		t.Errorf("Unexpected origin of 'music.artist': %v\n", origin)
+	}
+
+	origin, _ = ctx.ExplainValue("default", "music.track")
+	if origin.Value != "Set Track" || origin.Source != "--set / --set-string" {
+		t.Errorf("Unexpected origin of 'music.track': %v\n", origin)
+	}
+
+	if origin, _ = ctx.ExplainValue("default", "music.album"); origin != nil {
+		t.Errorf("Expected unset variable to have no origin, but got %v\n", origin)
+	}
+
+	if _, err = ctx.ExplainValue("missing", "override"); err == nil {
+		t.Error("Expected explaining a value of an unknown resource set to fail")
+	}
+}
+
+func TestKubectlContext(t *testing.T) {
+	os.Setenv("KONTEMPLATE_TEST_CLUSTER", "prod-cluster")
+	defer os.Unsetenv("KONTEMPLATE_TEST_CLUSTER")
+
+	ctx, err := LoadContext("testdata/kube-context.yaml", &noOptions)
+	if err != nil {
+		t.Fatalf("Unexpected error loading context: %v", err)
+	}
+
+	if ctx.Name != "production" || ctx.KubectlContext() != "gke_project_region_prod-cluster" {
+		t.Errorf("Unexpected kubectl context %s of %s\n", ctx.KubectlContext(), ctx.Name)
+	}
+
+	legacy := Context{Name: "k8s.prod.mydomain.com"}
+	if legacy.KubectlContext() != "k8s.prod.mydomain.com" {
+		t.Errorf("Expected name to be used as kubectl context, but got %s\n", legacy.KubectlContext())
+	}
+}
+
+func TestLoadVariablesFromCluster(t *testing.T) {
+	ctx, err := LoadContext("testdata/from-cluster.yaml", &LoadOptions{
+		LoadFromCluster: true,
+		Kubectl:         "testdata/from-cluster/fake-kubectl.sh",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error loading context: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"override":   "true",
+		"music":      map[string]interface{}{"artist": "Pallida", "track": "Tractor Beam"},
+		"region":     "eu-west",
+		"tier":       "gold",
+		"dbPassword": "hunter2",
+	}
+
+	if !reflect.DeepEqual(expected, ctx.ImportedVars) {
+		t.Errorf("Variables from cluster did not match expected result: \n%v", ctx.ImportedVars)
+	}
+}
+
+func TestLoadVariablesFromMissingClusterObject(t *testing.T) {
+	_, err := LoadContext("testdata/from-cluster.yaml", &LoadOptions{
+		LoadFromCluster: true,
+		Kubectl:         "testdata/from-cluster/fake-kubectl.sh",
+		KubeContext:     "other",
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "could not read configmap/settings in namespace management") {
+		t.Errorf("Expected loading missing object to fail, but got %v\n", err)
+	}
+}
+
+func TestLoadVariablesFromClusterTimeout(t *testing.T) {
+	start := time.Now()
+	_, err := LoadContext("testdata/from-cluster.yaml", &LoadOptions{
+		LoadFromCluster: true,
+		Kubectl:         "testdata/from-cluster/fake-kubectl.sh",
+		KubeContext:     "slow",
+		Timeout:         100 * time.Millisecond,
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "did not finish within 100ms") {
+		t.Errorf("Expected loading from a slow cluster to time out, but got %v\n", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected loading to be aborted after the timeout, but it took %s\n", elapsed)
+	}
+}
+
+func TestSkipVariablesFromCluster(t *testing.T) {
+	// Without LoadFromCluster, kubectl must not be run at all:
+	ctx, err := LoadContext("testdata/from-cluster.yaml", &LoadOptions{
+		Kubectl: "testdata/from-cluster/does-not-exist",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error loading context: %v", err)
+	}
+
+	if _, ok := ctx.ImportedVars["region"]; ok {
+		t.Errorf("Expected variables from the cluster to be skipped, but got %v\n", ctx.ImportedVars)
+	}
+}
+
+func TestParseEnvValues(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"KT_VAR_REPLICAS=3",
+		"KT_VAR_IMAGE__TAG=v2",
+		"KT_VAR_LOG_LEVEL=debug",
+	}
+
+	result, err := parseEnvValues(environ, "KT_VAR_")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []SetValue{
+		{Path: []string{"image", "tag"}, Value: "v2"},
+		{Path: []string{"log_level"}, Value: "debug"},
+		{Path: []string{"replicas"}, Value: float64(3)},
+	}
+
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Unexpected values from environment: %v\n", result)
+	}
+
+	conflicts := [][]string{
+		{"KT_VAR_FOO=1", "KT_VAR_foo=2"},
+		{"KT_VAR_FOO=1", "KT_VAR_FOO__BAR=2"},
+		{"KT_VAR_FOO____BAR=1"},
+	}
+
+	for _, environ := range conflicts {
+		if _, err := parseEnvValues(environ, "KT_VAR_"); err == nil {
+			t.Errorf("Expected invalid environment %v to fail\n", environ)
+		}
+	}
+}
+
+func TestEnvValuesPrecedence(t *testing.T) {
+	os.Setenv("KONTEMPLATE_TEST_VAR_IMAGE__TAG", "from-env")
+	os.Setenv("KONTEMPLATE_TEST_VAR_REPLICAS", "2")
+	defer os.Unsetenv("KONTEMPLATE_TEST_VAR_IMAGE__TAG")
+	defer os.Unsetenv("KONTEMPLATE_TEST_VAR_REPLICAS")
+
+	ctx, err := LoadContext("testdata/set-values.yaml", &LoadOptions{
+		VarEnvPrefix: "KONTEMPLATE_TEST_VAR_",
+		ExplicitVars: []string{"replicas=from-var"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error loading context: %v", err)
+	}
+
+	values := ctx.ResourceSets[0].Values
+	expectedImage := map[string]interface{}{"name": "some-api", "tag": "from-env"}
+
+	if !reflect.DeepEqual(expectedImage, values["image"]) {
+		t.Errorf("Expected environment to override nested global variable, but got %v\n", values["image"])
+	}
+
+	if values["replicas"] != "from-var" {
+		t.Errorf("Expected --var to take precedence over environment, but got %v\n", values["replicas"])
+	}
+}
+
+func TestTemplatedContext(t *testing.T) {
+	os.Setenv("KONTEMPLATE_TEST_CLUSTER", "k8s.prod")
+	defer os.Unsetenv("KONTEMPLATE_TEST_CLUSTER")
+
+	ctx, err := LoadContext("testdata/templated-context.yaml", &LoadOptions{TemplateContext: true})
+	if err != nil {
+		t.Fatalf("Unexpected error loading templated context: %v\n", err)
+	}
+
+	if ctx.Name != "k8s.prod" || ctx.Global["environment"] != "dev" || ctx.ResourceSets[0].Namespace != "k8s.prod-apps" {
+		t.Errorf("Unexpected templated context: %s %v %s\n", ctx.Name, ctx.Global, ctx.ResourceSets[0].Namespace)
+	}
+
+	ctx, err = LoadContext("testdata/templated-context.yaml", &noOptions)
+	if err != nil {
+		t.Fatalf("Unexpected error loading context: %v\n", err)
+	}
+
+	if ctx.Name != `{{ env "KONTEMPLATE_TEST_CLUSTER" }}` {
+		t.Errorf("Expected context not to be templated without TemplateContext, but got %s\n", ctx.Name)
+	}
+
+	_, err = LoadContext("testdata/templated-context.yaml", &LoadOptions{TemplateContext: true, StrictEnv: true})
+	if err != nil {
+		t.Errorf("Expected unset environment variables to be empty in templates in strict mode, but got %v\n", err)
+	}
+}
+
+func TestTemplatedContextWithVariables(t *testing.T) {
+	// Unescaped 'enabled' templates refer to variables, which are not
+	// available when the context file is rendered.
+	_, err := LoadContext("testdata/templated-context-enabled.yaml", &LoadOptions{TemplateContext: true})
+	if err == nil || !strings.Contains(err.Error(), `map has no entry for key "env"`) {
+		t.Errorf("Expected variable reference in templated context to fail, but got %v\n", err)
+	}
+
+	ctx, err := LoadContext("testdata/templated-context-escaped.yaml", &LoadOptions{TemplateContext: true})
+	if err != nil {
+		t.Fatalf("Unexpected error loading templated context: %v\n", err)
+	}
+
+	if ctx.ResourceSets[0].Enabled != `{{ eq .env "staging" }}` {
+		t.Errorf("Expected escaped 'enabled' template to be kept, but got %v\n", ctx.ResourceSets[0].Enabled)
+	}
+}
+
+func TestGlobalVarsPrecedence(t *testing.T) {
+	ctx, err := LoadContext("testdata/global-vars/context.yaml", &LoadOptions{
+		SetValues: []string{"logLevel=warn"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := map[string]interface{}{
+		"registry": "registry.example.com",
+		"team":     "payments",
+		"replicas": float64(2),
+		"logLevel": "warn",
+	}
+
+	for _, rs := range ctx.ResourceSets {
+		if !reflect.DeepEqual(expected, rs.Values) {
+			t.Errorf("Merged values of %s did not match expected result: \n%v", rs.Name, rs.Values)
+		}
+	}
+}
+
+func TestGlobalVarsFile(t *testing.T) {
+	ctx, err := LoadContext("testdata/global-vars/context.yaml", &LoadOptions{
+		GlobalVarsFile: "testdata/global-vars/org-vars.yaml",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := map[string]interface{}{"registry": "registry.internal.example.com"}
+	if !reflect.DeepEqual(expected, ctx.GlobalVars) {
+		t.Errorf("Expected the given file to replace kontemplate.defaults.yaml, got %v\n", ctx.GlobalVars)
+	}
+
+	if ctx.ResourceSets[1].Values["logLevel"] != "debug" {
+		t.Errorf("Expected resource set values to override global defaults, got %v\n", ctx.ResourceSets[1].Values)
+	}
+
+	_, err = LoadContext("testdata/global-vars/context.yaml", &LoadOptions{
+		GlobalVarsFile: "testdata/global-vars/missing.yaml",
+	})
+	if err == nil {
+		t.Error("Expected loading a missing global variables file to fail")
+	}
+}
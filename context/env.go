@@ -0,0 +1,163 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of environment variable
+// expansion in the string values of a context.
+
+package context
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Expands `${ENV_VAR}` references in the string values of a context
+// and its resource sets. If strict is set, references to unset
+// variables are an error, otherwise they expand to an empty string.
+func (ctx *Context) expandEnvVars(strict bool) error {
+	var err error
+
+	if ctx.Name, err = expandEnvString(ctx.Name, strict); err != nil {
+		return err
+	}
+
+	if ctx.KubeContext, err = expandEnvString(ctx.KubeContext, strict); err != nil {
+		return err
+	}
+
+	if err = expandEnvStrings(ctx.Contexts, strict); err != nil {
+		return err
+	}
+
+	if err = expandEnvStrings(ctx.VariableImportFiles, strict); err != nil {
+		return err
+	}
+
+	if err = expandEnvMap(ctx.Global, strict); err != nil {
+		return err
+	}
+
+	for i := range ctx.FromCluster {
+		source := &ctx.FromCluster[i]
+		for _, field := range []*string{&source.Name, &source.Namespace} {
+			if *field, err = expandEnvString(*field, strict); err != nil {
+				return err
+			}
+		}
+	}
+
+	return expandEnvResourceSets(ctx.ResourceSets, strict)
+}
+
+func expandEnvResourceSets(rs []ResourceSet, strict bool) error {
+	var err error
+
+	for i := range rs {
+		if rs[i].Path, err = expandEnvString(rs[i].Path, strict); err != nil {
+			return err
+		}
+
+		if err = expandEnvStrings(rs[i].KubectlArgs, strict); err != nil {
+			return err
+		}
+
+		if err = expandEnvStrings(rs[i].Args, strict); err != nil {
+			return err
+		}
+
+		if git := rs[i].Git; git != nil {
+			for _, field := range []*string{&git.URL, &git.Ref, &git.Path} {
+				if *field, err = expandEnvString(*field, strict); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err = expandEnvMap(rs[i].Values, strict); err != nil {
+			return err
+		}
+
+		if err = expandEnvResourceSets(rs[i].Include, strict); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func expandEnvMap(m map[string]interface{}, strict bool) error {
+	for k, v := range m {
+		expanded, err := expandEnvValue(v, strict)
+		if err != nil {
+			return err
+		}
+
+		m[k] = expanded
+	}
+
+	return nil
+}
+
+func expandEnvStrings(s []string, strict bool) error {
+	var err error
+
+	for i := range s {
+		if s[i], err = expandEnvString(s[i], strict); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Expands environment variables in arbitrary values as produced by
+// the YAML/JSON deserialiser, recursing into maps and lists.
+func expandEnvValue(v interface{}, strict bool) (interface{}, error) {
+	switch value := v.(type) {
+	case string:
+		return expandEnvString(value, strict)
+	case map[string]interface{}:
+		return value, expandEnvMap(value, strict)
+	case []interface{}:
+		for i := range value {
+			expanded, err := expandEnvValue(value[i], strict)
+			if err != nil {
+				return nil, err
+			}
+
+			value[i] = expanded
+		}
+		return value, nil
+	default:
+		return v, nil
+	}
+}
+
+func expandEnvString(s string, strict bool) (string, error) {
+	var missing []string
+
+	expanded := envVarPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envVarPattern.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+
+		return value
+	})
+
+	if strict && len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", missing[0])
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of loading variables from
+// prefixed environment variables (`--var-env-prefix`).
+
+package context
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Separator of nested keys in the names of environment variables.
+const envNestingSeparator = "__"
+
+// Converts environment variables (in the 'KEY=value' form of
+// os.Environ) that start with the prefix into variable overrides. The
+// prefix is stripped, the rest of the name is lowercased and split on
+// '__' into nested keys, e.g. 'PREFIX_IMAGE__TAG' sets 'image.tag'.
+// Values are converted like those of `--set`.
+//
+// Variables that map to the same key, or to a key and one of its
+// nested keys, are an error.
+func parseEnvValues(environ []string, prefix string) ([]SetValue, error) {
+	if prefix == "" {
+		return nil, nil
+	}
+
+	var names []string
+	values := make(map[string]string)
+
+	for _, entry := range environ {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], prefix) {
+			continue
+		}
+
+		names = append(names, parts[0])
+		values[parts[0]] = parts[1]
+	}
+
+	sort.Strings(names)
+
+	var parsed []SetValue
+	keys := make(map[string]string)
+
+	for _, name := range names {
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(name, prefix)), envNestingSeparator)
+		for _, key := range path {
+			if key == "" {
+				return nil, fmt.Errorf("environment variable %s does not specify a valid variable name", name)
+			}
+		}
+
+		key := strings.Join(path, envNestingSeparator)
+		if other, ok := keys[key]; ok {
+			return nil, fmt.Errorf("environment variables %s and %s set the same variable", other, name)
+		}
+
+		for otherKey, other := range keys {
+			if strings.HasPrefix(key, otherKey+envNestingSeparator) || strings.HasPrefix(otherKey, key+envNestingSeparator) {
+				return nil, fmt.Errorf("environment variables %s and %s set conflicting variables", other, name)
+			}
+		}
+
+		keys[key] = name
+		parsed = append(parsed, SetValue{Path: path, Value: typedValue(values[name])})
+	}
+
+	return parsed, nil
+}
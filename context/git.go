@@ -0,0 +1,123 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of resource sets that are
+// fetched from remote git repositories.
+
+package context
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+)
+
+// A git repository from which the templates of a resource set are
+// fetched.
+type GitSource struct {
+	// URL of the repository to clone.
+	URL string `json:"url"`
+
+	// Branch, tag or commit to check out. Defaults to the default branch of the repository.
+	Ref string `json:"ref"`
+
+	// Path to the resource set inside of the repository. Defaults to the repository root.
+	Path string `json:"path"`
+}
+
+// Returns the default directory in which git repositories are cached,
+// which is located in $XDG_CACHE_HOME on Linux.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return path.Join(dir, "kontemplate")
+}
+
+// Determines the directory into which a git source is checked out.
+// Checkouts are keyed on the URL and ref, so that they can be reused
+// across runs.
+func (g *GitSource) checkoutDir(cacheDir string) string {
+	hash := sha256.Sum256([]byte(g.URL + "\x00" + g.Ref))
+	return path.Join(cacheDir, "git", hex.EncodeToString(hash[:16]))
+}
+
+// Fetches the git sources of all resource sets into the cache
+// directory, unless they have been fetched before. If refresh is set,
+// cached checkouts are fetched again.
+func (ctx *Context) fetchGitSources(cacheDir string, refresh bool) error {
+	fetched := make(map[string]bool)
+
+	for _, rs := range ctx.ResourceSets {
+		if rs.Git == nil {
+			continue
+		}
+
+		dir := rs.Git.checkoutDir(cacheDir)
+		if fetched[dir] {
+			continue
+		}
+		fetched[dir] = true
+
+		if _, err := os.Stat(dir); err == nil && !refresh {
+			continue
+		}
+
+		if err := fetchGitSource(rs.Git, dir); err != nil {
+			return fmt.Errorf("Could not fetch resource set '%s' from %s: %v", rs.Name, rs.Git.URL, err)
+		}
+	}
+
+	return nil
+}
+
+// Performs a shallow fetch of a single ref into a temporary directory,
+// which then replaces the previous checkout.
+func fetchGitSource(g *GitSource, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0775); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	ref := g.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	commands := [][]string{
+		{"init", "--quiet"},
+		{"fetch", "--quiet", "--depth", "1", g.URL, ref},
+		{"checkout", "--quiet", "FETCH_HEAD"},
+	}
+
+	for _, args := range commands {
+		cmd := exec.Command("git", append([]string{"-C", tmp}, args...)...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s failed: %s (%v)", args[0], output, err)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dir)
+}
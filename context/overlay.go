@@ -0,0 +1,171 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of merging multiple context
+// files, such as a base configuration and per-cluster overlays.
+
+package context
+
+import (
+	"fmt"
+
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Loads several context files and merges them in order, with later
+// files overriding earlier ones (see mergeContexts). Relative paths in
+// all files are resolved against the base directory of the first file.
+func LoadContexts(filenames []string, options *LoadOptions) (*Context, error) {
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("No context file specified")
+	}
+
+	ctx, err := readContext(filenames[0], options)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, filename := range filenames[1:] {
+		overlay, err := readContext(filename, options)
+		if err != nil {
+			return nil, err
+		}
+
+		mergeContexts(ctx, overlay)
+	}
+
+	return prepareContext(ctx, filenames[0], options)
+}
+
+// Merges an overlay into a context:
+//
+//   - The name and kubectl context are replaced if the overlay specifies them.
+//   - Global variables are merged recursively: nested maps are merged,
+//     while scalars and lists in the overlay replace those in the context.
+//   - Imports and fromCluster objects are appended, so that the overlay's
+//     take precedence.
+//   - Template functions are merged by name.
+//   - Resource sets are merged by name (see mergeResourceSets).
+func mergeContexts(ctx *Context, overlay *Context) {
+	if overlay.Name != "" {
+		ctx.Name = overlay.Name
+	}
+
+	if overlay.KubeContext != "" {
+		ctx.KubeContext = overlay.KubeContext
+	}
+
+	if overlay.Contexts != nil {
+		ctx.Contexts = overlay.Contexts
+	}
+
+	for name, command := range overlay.TemplateFunctions {
+		if ctx.TemplateFunctions == nil {
+			ctx.TemplateFunctions = make(map[string]string)
+		}
+
+		ctx.TemplateFunctions[name] = command
+	}
+
+	ctx.Global = util.DeepMerge(ctx.Global, overlay.Global)
+	ctx.VariableImportFiles = append(ctx.VariableImportFiles, overlay.VariableImportFiles...)
+	ctx.FromCluster = append(ctx.FromCluster, overlay.FromCluster...)
+	ctx.ResourceSets = mergeResourceSets(ctx.ResourceSets, overlay.ResourceSets)
+}
+
+// Merges resource sets by name. Resource sets that only exist in the
+// overlay are appended. For resource sets that exist in both, values
+// are merged recursively and all other fields set in the overlay
+// replace those of the original resource set.
+func mergeResourceSets(sets []ResourceSet, overlay []ResourceSet) []ResourceSet {
+	merged := make([]ResourceSet, len(sets))
+	copy(merged, sets)
+
+	for _, o := range overlay {
+		found := false
+
+		for i := range merged {
+			if merged[i].Name == o.Name {
+				merged[i] = mergeResourceSet(merged[i], o)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			merged = append(merged, o)
+		}
+	}
+
+	return merged
+}
+
+func mergeResourceSet(rs ResourceSet, o ResourceSet) ResourceSet {
+	rs.Values = util.DeepMerge(rs.Values, o.Values)
+	rs.Include = mergeResourceSets(rs.Include, o.Include)
+	rs.SkipPrefixedFiles = rs.SkipPrefixedFiles || o.SkipPrefixedFiles
+	rs.Recursive = rs.Recursive || o.Recursive
+	rs.Sensitive = rs.Sensitive || o.Sensitive
+
+	if o.Path != "" {
+		rs.Path = o.Path
+	}
+
+	if o.Namespace != "" {
+		rs.Namespace = o.Namespace
+	}
+
+	if o.Type != "" {
+		rs.Type = o.Type
+	}
+
+	// Arguments given in either field replace those of the base
+	// resource set, whichever field it uses.
+	if o.Args != nil {
+		rs.Args = o.Args
+		rs.KubectlArgs = nil
+	}
+
+	if o.KubectlArgs != nil {
+		rs.KubectlArgs = o.KubectlArgs
+		if o.Args == nil {
+			rs.Args = nil
+		}
+	}
+
+	if o.Git != nil {
+		rs.Git = o.Git
+	}
+
+	if o.Order != nil {
+		rs.Order = o.Order
+	}
+
+	if o.Enabled != nil {
+		rs.Enabled = o.Enabled
+	}
+
+	if o.Prune != nil {
+		rs.Prune = o.Prune
+	}
+
+	if o.Delimiters != nil {
+		rs.Delimiters = o.Delimiters
+	}
+
+	if o.IncludeFiles != nil {
+		rs.IncludeFiles = o.IncludeFiles
+	}
+
+	if o.ExcludeFiles != nil {
+		rs.ExcludeFiles = o.ExcludeFiles
+	}
+
+	return rs
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of Helm-style variable
+// overrides (`--set foo.bar=baz`) on the command line.
+
+package context
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A single variable override. The path contains the keys leading to a
+// (possibly nested) variable.
+type SetValue struct {
+	Path  []string
+	Value interface{}
+}
+
+// Parses variable overrides in the form `foo.bar=baz`. Multiple
+// overrides can be separated by commas, literal commas can be escaped
+// with a backslash.
+//
+// Unless forceString is set, values that look like booleans, numbers
+// or null are converted to the corresponding type.
+func parseSetValues(values []string, forceString bool) ([]SetValue, error) {
+	var parsed []SetValue
+
+	for _, v := range values {
+		for _, assignment := range splitAssignments(v) {
+			parts := strings.SplitN(assignment, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, fmt.Errorf(`invalid variable override provided (%s), path and value should be separated with "="`, assignment)
+			}
+
+			path := strings.Split(parts[0], ".")
+			for _, key := range path {
+				if key == "" {
+					return nil, fmt.Errorf("invalid variable path provided (%s)", parts[0])
+				}
+			}
+
+			var value interface{} = parts[1]
+			if !forceString {
+				value = typedValue(parts[1])
+			}
+
+			parsed = append(parsed, SetValue{Path: path, Value: value})
+		}
+	}
+
+	return parsed, nil
+}
+
+func splitAssignments(s string) []string {
+	var assignments []string
+	var current strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == ',':
+			current.WriteByte(',')
+			i++
+		case s[i] == ',':
+			assignments = append(assignments, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(s[i])
+		}
+	}
+
+	return append(assignments, current.String())
+}
+
+// Integers are represented as float64, as they would be when loaded
+// from a YAML or JSON file. Everything else that looks like a number,
+// e.g. the version '1.10' or '0123', is kept as a string, as converting
+// it would change how it is rendered.
+func typedValue(s string) interface{} {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+
+	// Only integers that a float64 represents exactly are converted.
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && strconv.FormatInt(i, 10) == s && i >= -(1<<53) && i <= 1<<53 {
+		return float64(i)
+	}
+
+	return s
+}
+
+// Applies variable overrides to a map of variables. Maps along the
+// path of an override are copied, so that maps shared with other
+// resource sets are never modified.
+func applySetValues(values map[string]interface{}, overrides []SetValue) map[string]interface{} {
+	for _, override := range overrides {
+		values = setPath(values, override.Path, override.Value)
+	}
+
+	return values
+}
+
+func setPath(m map[string]interface{}, path []string, value interface{}) map[string]interface{} {
+	updated := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		updated[k] = v
+	}
+
+	if len(path) == 1 {
+		updated[path[0]] = value
+		return updated
+	}
+
+	// Intermediate values that are not maps are replaced.
+	nested, _ := updated[path[0]].(map[string]interface{})
+	updated[path[0]] = setPath(nested, path[1:], value)
+
+	return updated
+}
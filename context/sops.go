@@ -0,0 +1,63 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of importing variable files
+// that are encrypted with SOPS.
+
+package context
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// Top-level key in which SOPS stores the metadata of encrypted files.
+const sopsMetadataKey = "sops"
+
+// Command used to decrypt SOPS files.
+var sopsCommand = "sops"
+
+// Checks whether a variable file was encrypted by SOPS, which stores
+// (at least) a MAC and its version in the metadata. A variable that
+// happens to be called 'sops' does not mark a file as encrypted.
+func isSopsEncrypted(vars map[string]interface{}) bool {
+	metadata, ok := vars[sopsMetadataKey].(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	_, hasMac := metadata["mac"]
+	_, hasVersion := metadata["version"]
+	return hasMac && hasVersion
+}
+
+// Decrypts a variable file with the 'sops' command. The decrypted
+// values are only ever held in memory.
+func decryptSopsFile(filePath string) (map[string]interface{}, error) {
+	var stdout, stderr bytes.Buffer
+
+	sops := exec.Command(sopsCommand, "--decrypt", filePath)
+	sops.Stdout = &stdout
+	sops.Stderr = &stderr
+
+	if err := sops.Run(); err != nil {
+		return nil, fmt.Errorf("could not decrypt %s with sops: %v: %s", filePath, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var vars map[string]interface{}
+	if err := yaml.Unmarshal(stdout.Bytes(), &vars); err != nil {
+		return nil, fmt.Errorf("could not parse decrypted %s: %v", filePath, err)
+	}
+
+	return vars, nil
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of tracking where the values
+// of resource set variables come from, which is used to explain the
+// result of merging them.
+
+package context
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/tazjin/kontemplate/util"
+)
+
+// A source of variables of a resource set, such as global variables or
+// a default values file.
+type ValueSource struct {
+	Name   string
+	Values map[string]interface{}
+}
+
+// Where the value of a variable of a resource set comes from.
+type ValueOrigin struct {
+	// The merged value of the variable.
+	Value interface{}
+
+	// Name of the source whose value was used.
+	Source string
+
+	// Names of other sources that set the same variable, but were
+	// overridden.
+	Overridden []string
+}
+
+// Determines the sources of the variables of every resource set, in
+// ascending order of precedence (see mergeContextValues). This must be
+// called before the values are merged.
+func (ctx *Context) valueSources() map[string][]ValueSource {
+	sources := make(map[string][]ValueSource, len(ctx.ResourceSets))
+
+	for _, rs := range ctx.ResourceSets {
+		var s []ValueSource
+
+		if len(ctx.GlobalVars) > 0 {
+			s = append(s, ValueSource{"organisation-wide defaults", ctx.GlobalVars})
+		}
+
+		for _, filename := range util.DefaultFilenames {
+			var defaults map[string]interface{}
+			file := path.Join(rs.Path, filename)
+
+			if err := util.LoadData(file, &defaults); err == nil {
+				s = append(s, ValueSource{fmt.Sprintf("default values in %s", file), defaults})
+				break
+			}
+		}
+
+		s = append(s,
+			ValueSource{"imported variables", ctx.ImportedVars},
+			ValueSource{"global variables", ctx.Global},
+			ValueSource{fmt.Sprintf("values of resource set '%s'", rs.Name), rs.Values},
+		)
+
+		if len(ctx.EnvValues) > 0 {
+			s = append(s, ValueSource{"environment variables", applySetValues(nil, ctx.EnvValues)})
+		}
+
+		s = append(s, ValueSource{"--var", ctx.ExplicitVars})
+
+		if len(ctx.SetValues) > 0 {
+			s = append(s, ValueSource{"--set / --set-string", applySetValues(nil, ctx.SetValues)})
+		}
+
+		sources[rs.Name] = s
+	}
+
+	return sources
+}
+
+// Explains where the value of a (dotted) variable path of a resource
+// set comes from. Requires the context to be loaded with the
+// RecordSources option.
+func (ctx *Context) ExplainValue(resourceSet string, variable string) (*ValueOrigin, error) {
+	sources, ok := ctx.Sources[resourceSet]
+	if !ok {
+		return nil, fmt.Errorf("no sources recorded for resource set '%s'", resourceSet)
+	}
+
+	var values map[string]interface{}
+	for _, rs := range ctx.ResourceSets {
+		if rs.Name == resourceSet {
+			values = rs.Values
+		}
+	}
+
+	keys := strings.Split(variable, ".")
+	value, ok := lookupPath(values, keys)
+	if !ok {
+		return nil, nil
+	}
+
+	origin := ValueOrigin{Value: value}
+
+	for _, source := range sources {
+		if _, ok := lookupPath(source.Values, keys); !ok {
+			continue
+		}
+
+		if origin.Source != "" {
+			origin.Overridden = append(origin.Overridden, origin.Source)
+		}
+		origin.Source = source.Name
+	}
+
+	return &origin, nil
+}
+
+func lookupPath(values map[string]interface{}, keys []string) (interface{}, bool) {
+	var current interface{} = values
+
+	for _, key := range keys {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if current, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of templating context files
+// before they are parsed, which is enabled with --template-context.
+
+package context
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"text/template"
+)
+
+// Functions available when templating a context file. Variables are not
+// loaded at this stage, so only the environment can be accessed.
+var contextTemplateFuncs = template.FuncMap{
+	// Returns the value of an environment variable, or an empty
+	// string if it is unset.
+	"env": os.Getenv,
+
+	// Returns the given value, or the default if it is empty,
+	// e.g. '{{ env "CLUSTER" | default "dev" }}'.
+	"default": func(defaultVal interface{}, value interface{}) interface{} {
+		if value == nil || value == "" {
+			return defaultVal
+		}
+
+		return value
+	},
+}
+
+// Renders the raw contents of a context file as a template. There are no
+// variables, so references to variables (e.g. in 'enabled' templates of
+// resource sets that were not escaped) fail instead of silently
+// rendering as empty values.
+func templateContextFile(filename string, data []byte) ([]byte, error) {
+	tpl, err := template.New(path.Base(filename)).Funcs(contextTemplateFuncs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	if err = tpl.Execute(&rendered, map[string]interface{}{}); err != nil {
+		return nil, err
+	}
+
+	return rendered.Bytes(), nil
+}
@@ -0,0 +1,19 @@
+#!/bin/sh
+# Fake kubectl that serves a ConfigMap and a Secret from a fixed context.
+
+case "$*" in
+  "get configmap/settings -o json --namespace=management --context=mgmt")
+    echo '{"kind": "ConfigMap", "data": {"region": "eu-west", "tier": "gold"}}'
+    ;;
+  "get secret/credentials -o json --namespace=management --context=mgmt")
+    # "hunter2"
+    echo '{"kind": "Secret", "data": {"dbPassword": "aHVudGVyMg=="}}'
+    ;;
+  *--context=slow*)
+    sleep 5
+    ;;
+  *)
+    echo "Error from server (NotFound): $*" >&2
+    exit 1
+    ;;
+esac
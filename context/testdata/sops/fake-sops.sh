@@ -0,0 +1,3 @@
+#!/bin/sh
+# Stands in for 'sops --decrypt' in tests.
+echo "dbPassword: hunter2"
@@ -0,0 +1,83 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the exit codes of kontemplate. They are part of its
+// interface to scripts and CI systems, and are documented in the README,
+// so existing codes must not change meaning.
+
+package main
+
+import (
+	"os"
+)
+
+const (
+	// Invalid command-line flags or arguments, or a declined
+	// confirmation. Kingpin also exits with this code on parse errors.
+	exitUsage = 1
+
+	// The cluster configuration could not be loaded, resources could
+	// not be rendered or output could not be written.
+	exitTemplate = 2
+
+	// Kubectl failed, including waiting for workloads and rollbacks.
+	exitKubectl = 3
+
+	// Rendered resources failed validation, linting or a schema check.
+	exitValidation = 4
+
+	// 'kontemplate diff' found differences to the cluster state.
+	exitDifferences = 5
+)
+
+// An error that determines the exit code kontemplate fails with.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// Attaches an exit code to an error, unless it already has one.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*exitError); ok {
+		return err
+	}
+
+	return &exitError{code, err}
+}
+
+// Returns the exit code for an error. Errors without an explicit code
+// are treated as configuration or templating errors.
+func exitCode(err error) int {
+	if e, ok := err.(*exitError); ok {
+		return e.code
+	}
+
+	return exitTemplate
+}
+
+// Exits kontemplate with the given status after writing the summary.
+// This is also used by kingpin to terminate after errors and --help.
+func exit(status int) {
+	writeSummary(status == 0)
+	os.Exit(status)
+}
+
+// Prints an error message like app.Fatalf, but exits with the given code.
+func fail(code int, format string, args ...interface{}) {
+	app.Errorf(format, args...)
+	exit(code)
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of 'template --filename-template',
+// which names the files written to the output directory after the
+// resource set, template file, kind and name of each rendered document.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Parsed --filename-template, if one was given.
+var filenameTemplate *texttemplate.Template
+
+// Fields available in the --filename-template for every document.
+type outputFilename struct {
+	// Full name of the resource set, e.g. 'monitoring/grafana'.
+	SetName string
+
+	// Name of the template file in the resource set folder.
+	Filename string
+
+	// Kind and name of the document, empty if they can not be parsed.
+	Kind string
+	Name string
+}
+
+func parseFilenameTemplate(text string) (*texttemplate.Template, error) {
+	tmpl, err := texttemplate.New("filename-template").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid --filename-template: %v", err)
+	}
+
+	return tmpl, nil
+}
+
+// Renders the output file name of every document of the resource sets
+// and groups the documents by file name. Documents with the same file
+// name are written to the same file, so templates that do not use the
+// kind or name keep multi-document files together.
+func templatedOutputFiles(tmpl *texttemplate.Template, resourceSets []templater.RenderedResourceSet) ([]string, map[string][]string, error) {
+	var names []string
+	files := make(map[string][]string)
+
+	for _, rs := range resourceSets {
+		for _, r := range rs.Resources {
+			for _, doc := range util.SplitDocuments(r.Rendered) {
+				var object struct {
+					Kind     string `json:"kind"`
+					Metadata struct {
+						Name string `json:"name"`
+					} `json:"metadata"`
+				}
+
+				// Documents that can not be parsed are still
+				// written, without a kind and name.
+				yaml.Unmarshal([]byte(doc), &object)
+
+				name, err := outputFilePath(tmpl, outputFilename{
+					SetName:  rs.Name,
+					Filename: r.Filename,
+					Kind:     object.Kind,
+					Name:     object.Metadata.Name,
+				})
+				if err != nil {
+					return nil, nil, fmt.Errorf("Could not name output file for %s/%s: %v", rs.Name, r.Filename, err)
+				}
+
+				if _, ok := files[name]; !ok {
+					names = append(names, name)
+				}
+
+				files[name] = append(files[name], doc)
+			}
+		}
+	}
+
+	return names, files, nil
+}
+
+// Renders a file name and ensures that it stays within the output
+// directory.
+func outputFilePath(tmpl *texttemplate.Template, data outputFilename) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	name := path.Clean(strings.TrimSpace(b.String()))
+	if name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("file name '%s' is not a relative path within the output directory", b.String())
+	}
+
+	return name, nil
+}
+
+func writeTemplatedFiles(outputDir string, resourceSets []templater.RenderedResourceSet) error {
+	names, files, err := templatedOutputFiles(filenameTemplate, resourceSets)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var b strings.Builder
+		for _, doc := range files[name] {
+			fmt.Fprintf(&b, "---\n%s\n", doc)
+		}
+
+		if err := writeOutputFile(path.Join(outputDir, name), b.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of 'apply --incremental', which
+// records a hash of every successfully applied resource set in a state
+// file and skips resource sets whose hash has not changed since.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Name of the state file in the base directory of the cluster
+// configuration, unless --state-file is set.
+const defaultStateFile = "kontemplate.lock"
+
+// Version of the state file format. State files of other versions are
+// ignored, which causes all resource sets to be applied again.
+const stateVersion = 1
+
+// Hashes of the resource sets that were last applied successfully, by
+// kubectl context and resource set name.
+type applyState struct {
+	Version  int                          `json:"version"`
+	Contexts map[string]map[string]string `json:"contexts"`
+}
+
+// Serialises access to the state file when applying to multiple
+// contexts concurrently.
+var stateLock sync.Mutex
+
+func stateFilePath(c *context.Context) string {
+	if *applyStateFile != "" {
+		return *applyStateFile
+	}
+
+	return path.Join(c.BaseDir, defaultStateFile)
+}
+
+// Returns a hash of everything that determines the result of applying a
+// resource set: its rendered files and the arguments passed to kubectl.
+func resourceSetHash(rs *templater.RenderedResourceSet, kubectlArgs []string) string {
+	input, _ := json.Marshal(struct {
+		KubectlArgs []string
+		Args        []string
+		Resources   []templater.RenderedResource
+	}{kubectlArgs, rs.Args, rs.Resources})
+
+	hash := sha256.Sum256(input)
+	return hex.EncodeToString(hash[:])
+}
+
+// Reads the state file. A missing state file is empty, while an
+// unreadable or outdated one is returned as empty with an error.
+func loadApplyState(file string) (applyState, error) {
+	state := applyState{Version: stateVersion}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+
+	var loaded applyState
+	if err == nil {
+		err = json.Unmarshal(data, &loaded)
+	}
+
+	if err == nil && loaded.Version != stateVersion {
+		err = fmt.Errorf("unsupported version %d", loaded.Version)
+	}
+
+	if err != nil {
+		return state, err
+	}
+
+	return loaded, nil
+}
+
+// Removes the resource sets whose hash exactly matches the hash recorded
+// for the last successful apply, and returns the hashes of the remaining
+// resource sets.
+func skipUnchangedResourceSets(c *context.Context, resources *[]templater.RenderedResourceSet, kubectlArgs []string) map[string]string {
+	stateLock.Lock()
+	state, err := loadApplyState(stateFilePath(c))
+	stateLock.Unlock()
+
+	// Without a usable state, every resource set is applied.
+	if err != nil {
+		util.Warnf("Ignoring state file %s: %v", stateFilePath(c), err)
+	}
+
+	applied := state.Contexts[kubectlContext(c)]
+
+	hashes := make(map[string]string)
+	var changed []templater.RenderedResourceSet
+
+	for _, rs := range *resources {
+		hash := resourceSetHash(&rs, kubectlArgs)
+
+		if applied[rs.Name] == hash && !*applyForce {
+			util.Infof("Skipping resource set '%s', which has not changed since it was last applied", rs.Name)
+			continue
+		}
+
+		hashes[rs.Name] = hash
+		changed = append(changed, rs)
+	}
+
+	if len(changed) == 0 {
+		util.Infof("No resource set has changed since it was last applied")
+	}
+
+	*resources = changed
+	return hashes
+}
+
+// Records the hashes of successfully applied resource sets in the state
+// file. The file is read again before writing, so that the results of
+// other contexts are kept.
+func recordAppliedResourceSets(c *context.Context, hashes map[string]string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	// A state file that can not be read is replaced.
+	file := stateFilePath(c)
+	state, _ := loadApplyState(file)
+
+	if state.Contexts == nil {
+		state.Contexts = make(map[string]map[string]string)
+	}
+
+	kubectlCtx := kubectlContext(c)
+	if state.Contexts[kubectlCtx] == nil {
+		state.Contexts[kubectlCtx] = make(map[string]string)
+	}
+
+	for name, hash := range hashes {
+		state.Contexts[kubectlCtx][name] = hash
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The state is replaced atomically, so that an interrupted write
+	// does not leave a corrupt state file behind.
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(data, '\n'), 0664); err == nil {
+		err = os.Rename(tmp, file)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Could not write state file %s: %v", file, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Package kontemplate is the API for embedding Kontemplate in other Go
+// programs. It renders the resource sets of a cluster configuration
+// without invoking kubectl.
+//
+// A minimal example:
+//
+//	ctx, err := context.LoadContext("prod-cluster.yaml", &context.LoadOptions{})
+//	if err != nil {
+//		return err
+//	}
+//
+//	resourceSets, err := kontemplate.Render(ctx, nil, nil)
+package kontemplate
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+)
+
+// Options for rendering resource sets that go beyond templating.
+type Options struct {
+	// Number of resource sets to template concurrently. Defaults to
+	// the number of CPUs.
+	Jobs int
+
+	// Labels to add to every rendered resource, unless already set.
+	Labels map[string]string
+
+	// Label selector that rendered resources must match, e.g. 'app=foo'.
+	Selector string
+
+	// Kinds of resources to keep, e.g. 'Deployment'. All kinds are kept if empty.
+	IncludeKinds []string
+
+	// Kinds of resources to remove, e.g. 'CustomResourceDefinition'.
+	ExcludeKinds []string
+
+	// Fields to set in rendered resources, in the form
+	// '[Kind:]path.to.field=value'. They are applied in order.
+	SetFields []string
+}
+
+// Renders all resource sets of a context that are selected by the
+// given includes and excludes. Empty includes select all resource sets.
+func Render(ctx *context.Context, includes []string, excludes []string) ([]templater.RenderedResourceSet, error) {
+	return RenderWithOptions(ctx, includes, excludes, &Options{})
+}
+
+// Renders resource sets like Render and then applies the additional
+// options to the rendered resources.
+func RenderWithOptions(ctx *context.Context, includes []string, excludes []string, options *Options) ([]templater.RenderedResourceSet, error) {
+	jobs := options.Jobs
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+
+	resources, err := templater.LoadAndApplyTemplates(&includes, &excludes, ctx, jobs)
+	if err != nil {
+		return nil, fmt.Errorf("Error templating resource sets: %v", err)
+	}
+
+	if options.Selector != "" {
+		selector, err := templater.ParseSelector(options.Selector)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range resources {
+			if err := templater.FilterResources(&resources[i], selector); err != nil {
+				return nil, fmt.Errorf("Error filtering resources: %v", err)
+			}
+		}
+	}
+
+	if len(options.IncludeKinds) > 0 || len(options.ExcludeKinds) > 0 {
+		for i := range resources {
+			templater.FilterKinds(&resources[i], options.IncludeKinds, options.ExcludeKinds)
+		}
+	}
+
+	if len(options.Labels) > 0 {
+		for i := range resources {
+			if err := templater.AddLabels(&resources[i], options.Labels); err != nil {
+				return nil, fmt.Errorf("Error adding labels: %v", err)
+			}
+		}
+	}
+
+	if len(options.SetFields) > 0 {
+		transforms, err := templater.ParseFieldTransforms(options.SetFields)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range resources {
+			if err := templater.SetFields(&resources[i], transforms); err != nil {
+				return nil, fmt.Errorf("Error setting fields: %v", err)
+			}
+		}
+	}
+
+	return resources, nil
+}
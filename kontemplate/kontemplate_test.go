@@ -0,0 +1,67 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package kontemplate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tazjin/kontemplate/context"
+)
+
+func loadTestContext(t *testing.T) *context.Context {
+	ctx, err := context.LoadContext("testdata/cluster.yaml", &context.LoadOptions{})
+	if err != nil {
+		t.Fatalf("Could not load context: %v\n", err)
+	}
+
+	return ctx
+}
+
+func TestRender(t *testing.T) {
+	resources, err := Render(loadTestContext(t), nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if len(resources) != 1 || resources[0].Name != "some-api" || len(resources[0].Resources) != 1 {
+		t.Fatalf("Unexpected rendered resources: %v\n", resources)
+	}
+
+	if !strings.Contains(resources[0].Resources[0].Rendered, "name: api") {
+		t.Errorf("Resources were not templated: %s\n", resources[0].Resources[0].Rendered)
+	}
+}
+
+func TestRenderWithExcludes(t *testing.T) {
+	_, err := Render(loadTestContext(t), nil, []string{"some-api"})
+	if err == nil || !strings.Contains(err.Error(), "No valid resource sets included") {
+		t.Errorf("Expected rendering without resource sets to fail, but got %v\n", err)
+	}
+}
+
+func TestRenderWithOptions(t *testing.T) {
+	options := Options{
+		Jobs:      1,
+		Labels:    map[string]string{"team": "infra"},
+		Selector:  "app=api",
+		SetFields: []string{"ConfigMap:data.mode=production"},
+	}
+
+	resources, err := RenderWithOptions(loadTestContext(t), nil, nil, &options)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	rendered := resources[0].Resources[0].Rendered
+	if strings.Contains(rendered, "kind: Secret") || !strings.Contains(rendered, "team: infra") || !strings.Contains(rendered, "mode: production") {
+		t.Errorf("Options were not applied to rendered resources: %s\n", rendered)
+	}
+}
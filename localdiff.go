@@ -0,0 +1,145 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of diffing rendered resources
+// against the configuration last applied to the cluster, without
+// relying on 'kubectl diff'.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// Diffs every document of a resource set against the last applied
+// configuration of the corresponding object and prints the unified
+// diffs. Returns whether any differences were found.
+func localDiffResourceSet(c *context.Context, rs *templater.RenderedResourceSet, contextLines int) (bool, error) {
+	differences := false
+
+	objects, err := resourceSetObjects(rs)
+	if err != nil {
+		return differences, err
+	}
+
+	for _, o := range objects {
+		resource := o.resource()
+		applied, found, err := lastAppliedConfiguration(c, resource, o.Namespace)
+		if err != nil {
+			return differences, err
+		}
+
+		if found && applied == "" {
+			util.Infof("Notice: %s has no %s annotation, skipping", resource, lastAppliedAnnotation)
+			continue
+		}
+
+		rendered, err := normaliseYAML([]byte(o.Document))
+		if err != nil {
+			return differences, fmt.Errorf("could not parse %s in %s: %v", resource, rs.Name, err)
+		}
+
+		diff := util.UnifiedDiff(applied, rendered, "applied/"+resource, "rendered/"+resource, contextLines)
+		if diff != "" && rs.Sensitive {
+			differences = true
+			fmt.Printf("%s differs (hidden as resource set '%s' is sensitive)\n", resource, rs.Name)
+		} else if diff != "" {
+			differences = true
+			printDiff(diff)
+		}
+	}
+
+	return differences, nil
+}
+
+// Returns the name under which kubectl can retrieve an object,
+// qualified with its API group and version to avoid ambiguities, e.g.
+// 'deployment.v1.apps/foo'.
+func kubectlResourceName(apiVersion string, kind string, name string) string {
+	resource := strings.ToLower(kind)
+
+	if parts := strings.SplitN(apiVersion, "/", 2); len(parts) == 2 {
+		resource = fmt.Sprintf("%s.%s.%s", resource, parts[1], parts[0])
+	}
+
+	return resource + "/" + name
+}
+
+// Fetches the last applied configuration of an object from the
+// cluster. 'found' is false if the object does not exist, and the
+// configuration is empty if the object has no such annotation.
+func lastAppliedConfiguration(c *context.Context, resource string, namespace string) (applied string, found bool, err error) {
+	current, found, err := getObject(c, resource, namespace)
+	if err != nil || !found {
+		return "", found, err
+	}
+
+	var object struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+
+	if err = json.Unmarshal(current, &object); err != nil {
+		return "", true, fmt.Errorf("could not parse %s: %v", resource, err)
+	}
+
+	annotation, ok := object.Metadata.Annotations[lastAppliedAnnotation]
+	if !ok {
+		return "", true, nil
+	}
+
+	applied, err = normaliseYAML([]byte(annotation))
+	return applied, true, err
+}
+
+// Re-serialises YAML or JSON with sorted keys and consistent
+// formatting, so that only semantic differences are shown.
+func normaliseYAML(data []byte) (string, error) {
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return "", err
+	}
+
+	y, err := yaml.JSONToYAML(j)
+	return string(y), err
+}
+
+// Prints a unified diff, colouring it if stdout is a terminal.
+func printDiff(diff string) {
+	if !util.ColorEnabled(os.Stdout) {
+		fmt.Print(diff)
+		return
+	}
+
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			fmt.Print(util.Colorize(os.Stdout, util.Bold, line))
+		case strings.HasPrefix(line, "@@"):
+			fmt.Print(util.Colorize(os.Stdout, util.Cyan, line))
+		case strings.HasPrefix(line, "+"):
+			fmt.Print(util.Colorize(os.Stdout, util.Green, line))
+		case strings.HasPrefix(line, "-"):
+			fmt.Print(util.Colorize(os.Stdout, util.Red, line))
+		default:
+			fmt.Print(line)
+		}
+	}
+}
@@ -16,18 +16,37 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ghodss/yaml"
 	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/kontemplate"
+	"github.com/tazjin/kontemplate/schema"
 	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 const version string = "1.8.0"
 
+// Labels added to all resources when pruning is enabled.
+const (
+	managedByLabel   string = "app.kubernetes.io/managed-by"
+	resourceSetLabel string = "kontemplate.works/resource-set"
+)
+
 // This variable will be initialised by the Go linker during the builder
 var gitHash string
 
@@ -35,36 +54,157 @@ var (
 	app = kingpin.New("kontemplate", "simple Kubernetes resource templating")
 
 	// Global flags
-	includes   = app.Flag("include", "Resource sets to include explicitly").Short('i').Strings()
-	excludes   = app.Flag("exclude", "Resource sets to exclude explicitly").Short('e').Strings()
-	variables  = app.Flag("var", "Provide variables to templates explicitly").Strings()
-	kubectlBin = app.Flag("kubectl", "Path to the kubectl binary (default 'kubectl')").Default("kubectl").String()
+	includes      = app.Flag("include", "Resource sets to include explicitly").Short('i').HintAction(resourceSetCompletions).Strings()
+	excludes      = app.Flag("exclude", "Resource sets to exclude explicitly").Short('e').HintAction(resourceSetCompletions).Strings()
+	includeFrom   = app.Flag("include-from", "File listing resource sets to include, one per line (can be repeated)").Strings()
+	excludeFrom   = app.Flag("exclude-from", "File listing resource sets to exclude, one per line (can be repeated)").Strings()
+	variables     = app.Flag("var", "Provide variables to templates explicitly").Strings()
+	globalVars    = app.Flag("global-vars", "File of default variables for every resource set, with the lowest precedence (defaults to 'kontemplate.defaults.yaml' in the base directory)").String()
+	labels        = app.Flag("label", "Add a label (key=value) to all rendered resources").StringMap()
+	setFields     = app.Flag("set-field", "Set a field of rendered resources, e.g. 'Deployment:spec.replicas=3' (can be repeated)").Strings()
+	setValues     = app.Flag("set", "Override (possibly nested) variables, e.g. 'image.tag=v2'").Strings()
+	setStrings    = app.Flag("set-string", "Override (possibly nested) variables with string values").Strings()
+	kubectlBin    = app.Flag("kubectl", "Path to the kubectl binary (default 'kubectl')").Default("kubectl").String()
+	kubeContext   = app.Flag("kube-context", "Override the kubectl context specified in the cluster configuration").String()
+	kubeconfig    = app.Flag("kubeconfig", "Path to the kubeconfig file passed to kubectl (defaults to $KUBECONFIG)").String()
+	namespace     = app.Flag("namespace", "Namespace to pass to kubectl and to templates as '.namespace'").Short('n').String()
+	ignoreMissing = app.Flag("ignore-missing", "Skip resource sets whose path does not exist instead of failing").Bool()
+	cacheDir      = app.Flag("cache-dir", "Directory in which git repositories of resource sets are cached").Default(context.DefaultCacheDir()).String()
+	refresh       = app.Flag("refresh", "Fetch git repositories of resource sets again, even if they are cached").Bool()
+	selector      = app.Flag("selector", "Only pass resources whose labels match this label selector to kubectl, e.g. 'app=foo'").Short('l').String()
+	retries       = app.Flag("retries", "Number of times to retry kubectl after transient errors such as connection timeouts").Default("0").Int()
+	retryDelay    = app.Flag("retry-delay", "Delay before the first retry, doubled after every attempt").Default("2s").Duration()
+	timeout       = app.Flag("timeout", "Kill kubectl invocations that take longer than this (e.g. '2m', 0 means no timeout)").Default("0").Duration()
+	funcTimeout   = app.Flag("function-timeout", "Kill commands of template functions from 'templateFunctions' that take longer than this").Default("10s").Duration()
+	decrypt       = app.Flag("decrypt", "Decrypt imported variable files that are encrypted with SOPS").Bool()
+	logLevel      = app.Flag("log-level", "Amount of diagnostic output: 'quiet' only shows warnings, 'verbose' adds resolved paths and timings").Default("normal").Enum("quiet", "normal", "verbose")
+	verbose       = app.Flag("verbose", "Shorthand for --log-level=verbose").Short('v').Bool()
+	quiet         = app.Flag("quiet", "Shorthand for --log-level=quiet").Short('q').Bool()
+	includeKinds  = app.Flag("include-kind", "Only use resources of these kinds, e.g. 'Deployment,Service' (can be repeated)").Strings()
+	excludeKinds  = app.Flag("exclude-kind", "Do not use resources of these kinds, e.g. 'CustomResourceDefinition' (can be repeated)").Strings()
+	clusterJobs   = app.Flag("parallel-clusters", "Number of contexts to apply to concurrently if the cluster configuration lists 'contexts'").Default("1").Int()
+	keepGoing     = app.Flag("keep-going", "Continue with the remaining contexts if applying to one of them fails").Bool()
+	summaryOutput = app.Flag("summary-output", "File to which a JSON summary of apply, create, replace and delete is written").String()
+	dumpRendered  = app.Flag("dump-rendered", "Directory to which apply, create, replace and delete write the resources passed to kubectl").String()
+	noColor       = app.Flag("no-color", "Do not colour diagnostic output, even if stderr is a terminal (also set by $NO_COLOR)").Bool()
+	varEnvPrefix  = app.Flag("var-env-prefix", "Load variables from environment variables with this prefix, e.g. 'KONTEMPLATE_VAR_'").String()
+	postRenderCmd = app.Flag("post-render", "Command through which the rendered resources of every resource set are piped before they are used").String()
+	postRenderArg = app.Flag("post-render-arg", "Argument to pass to the post-render command (can be repeated)").Strings()
+	jobs          = app.Flag("jobs", "Number of resource sets to template concurrently").Short('j').Default(strconv.Itoa(runtime.NumCPU())).Int()
+	strictEnv     = app.Flag("strict-env", "Fail if the context references unset environment variables").Bool()
+	templateCtx   = app.Flag("template-context", "Render the cluster configuration as a template (with the functions 'env' and 'default') before parsing it").Bool()
+	baseDir       = app.Flag("base-dir", "Directory to resolve resource set paths and imports against (defaults to the context file's directory)").Short('C').String()
 
 	// Commands
-	template          = app.Command("template", "Template resource sets and print them")
-	templateFile      = template.Arg("file", "Cluster configuration file to use").Required().String()
-	templateOutputDir = template.Flag("output", "Output directory in which to save templated files instead of printing them").Short('o').String()
+	template           = app.Command("template", "Template resource sets and print them")
+	templateFile       = template.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
+	templateOutputDir  = template.Flag("output", "Output directory in which to save templated files instead of printing them").Short('o').String()
+	templateFormat     = template.Flag("output-format", "Format of printed output: 'raw' prints files as rendered, 'yaml' prints a clean multi-document stream, 'json' prints a JSON array of all documents").Default("raw").Enum("raw", "yaml", "json")
+	templateJSONLines  = template.Flag("json-lines", "Print one JSON document per line instead of an array when using '--output-format json'").Bool()
+	templateOutputMode = template.Flag("output-mode", "Files written to the output directory: 'per-file' writes one file per template, 'per-set' one file per resource set and 'single' one file for everything").Default("per-file").Enum("per-file", "per-set", "single")
+	templateFilenames  = template.Flag("filename-template", "Go template for the names of files in the output directory, e.g. '{{ .SetName }}/{{ .Kind }}-{{ .Name }}.yaml'").String()
+	templateLayout     = template.Flag("output-layout", "Layout of the output directory: 'flat' prefixes file names with the resource set name, 'tree' creates a directory per resource set").Default("flat").Enum("flat", "tree")
+	templateValidate   = template.Flag("validate-schema", "Validate rendered resources against the Kubernetes JSON schemas").Bool()
+	templateSchemaVer  = template.Flag("schema-version", "Kubernetes version whose schemas are used for validation, e.g. '1.27'").Default("master").String()
+	templateUnused     = template.Flag("report-unused", "Report variables that are not referenced by any template of a resource set").Bool()
+	templateDuplicates = template.Flag("check-duplicates", "Fail if a resource set renders the same object (kind, namespace and name) more than once").Bool()
+	templateAnnotate   = template.Flag("annotate", "Add the audit annotations of 'apply --annotate' to the printed resources").Bool()
+	templateArgoCD     = template.Flag("emit-argocd-app", "Write an ArgoCD Application for every resource set to the 'applications' directory of --output").Bool()
+	templateArgoRepo   = template.Flag("argocd-repo-url", "Git repository containing the output directory, used as the source of the ArgoCD Applications").String()
+	templateArgoPath   = template.Flag("argocd-path", "Path of the output directory within the git repository (defaults to --output)").String()
+	templateArgoRev    = template.Flag("argocd-revision", "Git revision tracked by the ArgoCD Applications").Default("HEAD").String()
+	templateArgoProj   = template.Flag("argocd-project", "ArgoCD project of the Applications").Default("default").String()
+	templateArgoNS     = template.Flag("argocd-namespace", "Namespace in which the ArgoCD Applications are created").Default("argocd").String()
+	templateDestServer = template.Flag("dest-server", "Kubernetes API server to which ArgoCD deploys the resource sets").Default("https://kubernetes.default.svc").String()
+	templateDestNS     = template.Flag("dest-namespace", "Namespace to which ArgoCD deploys resource sets that do not set a namespace").String()
 
-	apply       = app.Command("apply", "Template resources and pass to 'kubectl apply'")
-	applyFile   = apply.Arg("file", "Cluster configuration file to use").Required().String()
-	applyDryRun = apply.Flag("dry-run", "Print remote operations without executing them").Default("false").Bool()
+	apply                = app.Command("apply", "Template resources and pass to 'kubectl apply'")
+	applyFile            = apply.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
+	applyDryRun          = apply.Flag("dry-run", "Print remote operations without executing them: 'client' or 'server' (a bare --dry-run means 'client')").Default("none").Enum("none", "client", "server")
+	applyPrune           = apply.Flag("prune", "Delete resources managed by kontemplate that are no longer part of a resource set").Bool()
+	applyPruneDryRun     = apply.Flag("prune-dry-run", "Only list the objects that --prune would delete, using a server-side dry-run").Bool()
+	applyPruneWhitelist  = apply.Flag("prune-whitelist", "Only prune resources of this type, as 'group/version/kind' (e.g. 'core/v1/ConfigMap', can be repeated)").Strings()
+	applyConfirm         = apply.Flag("confirm", "Confirm destructive operations such as pruning").Bool()
+	applyEnsureNamespace = apply.Flag("ensure-namespace", "Create the namespaces declared by resource sets").Bool()
+	applyWait            = apply.Flag("wait", "Wait for the rollout of Deployments, StatefulSets and DaemonSets after applying each resource set").Bool()
+	applyWaitTimeout     = apply.Flag("wait-timeout", "Maximum time to wait for the rollout of a single resource").Default("5m").Duration()
+	applyServerSide      = apply.Flag("server-side", "Use server-side apply with the field manager 'kontemplate' (unless --field-manager is set)").Bool()
+	applyFieldManager    = apply.Flag("field-manager", "Name of the field manager that kubectl records for applied fields").String()
+	applyForceConflicts  = apply.Flag("force-conflicts", "Take ownership of fields managed by other field managers (requires --server-side)").Bool()
+	applyDuplicates      = apply.Flag("check-duplicates", "Fail before applying if a resource set renders the same object (kind, namespace and name) more than once").Bool()
+	applyAtomic          = apply.Flag("atomic", "Roll back all applied resource sets if applying one of them fails").Bool()
+	applyIncremental     = apply.Flag("incremental", "Skip resource sets that have not changed since they were last applied successfully").Bool()
+	applyStateFile       = apply.Flag("state-file", "File in which --incremental records applied resource sets (default 'kontemplate.lock' next to the cluster configuration)").String()
+	applyForce           = apply.Flag("force", "Apply all resource sets with --incremental, even if they have not changed").Bool()
+	applyAnnotate        = apply.Flag("annotate", "Annotate every object with the user, time and kontemplate commit of the apply").Bool()
 
-	replace     = app.Command("replace", "Template resources and pass to 'kubectl replace'")
-	replaceFile = replace.Arg("file", "Cluster configuration file to use").Required().String()
+	replace           = app.Command("replace", "Template resources and pass to 'kubectl replace'")
+	replaceFile       = replace.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
+	replaceYes        = replace.Flag("yes", "Do not ask for confirmation").Short('y').Bool()
+	replaceForce      = replace.Flag("force", "Delete and re-create resources, e.g. to change immutable fields").Bool()
+	replaceSaveConfig = replace.Flag("save-config", "Store the configuration in the last-applied annotation of each resource (disable with --no-save-config)").Default("true").Bool()
 
-	delete     = app.Command("delete", "Template resources and pass to 'kubectl delete'")
-	deleteFile = delete.Arg("file", "Cluster configuration file to use").Required().String()
+	delete           = app.Command("delete", "Template resources and pass to 'kubectl delete'")
+	deleteFile       = delete.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
+	deleteNamespaces = delete.Flag("delete-namespaces", "Also delete the namespaces declared by resource sets").Bool()
+	deleteYes        = delete.Flag("yes", "Do not ask for confirmation").Short('y').Bool()
+	deleteCascade    = delete.Flag("cascade", "How dependents are deleted: 'background', 'foreground' or 'orphan' (which keeps them)").HintOptions("background", "foreground", "orphan").String()
+	deleteGrace      = delete.Flag("grace-period", "Seconds given to objects to terminate gracefully (-1 uses the default of each object)").Default("-1").Int()
 
 	create     = app.Command("create", "Template resources and pass to 'kubectl create'")
-	createFile = create.Arg("file", "Cluster configuration file to use").Required().String()
+	createFile = create.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
+
+	diff        = app.Command("diff", "Template resources and pass to 'kubectl diff'")
+	diffFile    = diff.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
+	diffLocal   = diff.Flag("local", "Diff against the last applied configuration of each object instead of using 'kubectl diff'").Bool()
+	diffContext = diff.Flag("diff-context", "Number of context lines shown around changes with --local").Default("3").Int()
+
+	plan         = app.Command("plan", "Compare rendered resources with the cluster and summarise what 'apply' would change")
+	planFile     = plan.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
+	planExitCode = plan.Flag("detailed-exitcode", "Exit with status 5 if any object would be created or changed").Bool()
+
+	validate     = app.Command("validate", "Template resources and validate them using a 'kubectl apply' dry-run")
+	validateFile = validate.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
+	validateMode = validate.Flag("mode", "Dry-run mode to use for validation (server or client)").Default("server").Enum("server", "client")
+
+	lint     = app.Command("lint", "Template resources and check them for errors without contacting the cluster")
+	lintFile = lint.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
+
+	explain     = app.Command("explain", "Print the merged variables of each resource set without rendering templates")
+	explainFile = explain.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
+	explainPath = explain.Flag("set-path", "Show which source the value of a single (dotted) variable comes from").String()
+
+	list     = app.Command("list", "List the files each resource set will render, without templating them")
+	listFile = list.Arg("file", "Cluster configuration files to use, merged in order ('-' for stdin)").Required().Strings()
 
-	versionCmd = app.Command("version", "Show kontemplate version")
+	completions     = app.Command("completions", "Print a script that sets up shell completion for kontemplate")
+	completionShell = completions.Arg("shell", "Shell to print the completion script for (bash, zsh or fish)").Required().Enum("bash", "zsh", "fish")
+
+	versionCmd   = app.Command("version", "Show kontemplate version")
+	versionCheck = versionCmd.Flag("check", "Check whether a newer release of kontemplate is available").Bool()
 )
 
 func main() {
 	app.HelpFlag.Short('h')
+	app.ErrorWriter(util.StyledWriter(os.Stderr, util.Red))
+	templater.Version = version
+
+	command := kingpin.MustParse(app.Parse(expandShortFlags(normaliseDryRunFlag(os.Args[1:]))))
+	setLogLevel()
+	util.NoColor = *noColor
+	templater.Kubectl = *kubectlBin
+	templater.KubectlTimeout = *timeout
+	templater.FunctionTimeout = *funcTimeout
+
+	if err := loadSetLists(); err != nil {
+		fail(exitUsage, "%v\n", err)
+	}
 
-	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	// The summary is also written if kontemplate exits with an error.
+	app.Terminate(exit)
+	defer writeSummary(true)
+
+	switch command {
 	case template.FullCommand():
 		templateCommand()
 
@@ -80,44 +220,348 @@ func main() {
 	case create.FullCommand():
 		createCommand()
 
+	case diff.FullCommand():
+		diffCommand()
+
+	case plan.FullCommand():
+		planCommand()
+
+	case validate.FullCommand():
+		validateCommand()
+
+	case lint.FullCommand():
+		lintCommand()
+
+	case explain.FullCommand():
+		explainCommand()
+
+	case list.FullCommand():
+		listCommand()
+
+	case completions.FullCommand():
+		completionsCommand()
+
 	case versionCmd.FullCommand():
 		versionCommand()
 	}
 }
 
+func setLogLevel() {
+	switch {
+	case *quiet || *logLevel == "quiet":
+		util.Level = util.LogQuiet
+	case *verbose || *logLevel == "verbose":
+		util.Level = util.LogVerbose
+	}
+}
+
 func versionCommand() {
 	if gitHash == "" {
 		fmt.Printf("Kontemplate version %s (git commit unknown)\n", version)
 	} else {
 		fmt.Printf("Kontemplate version %s (git commit: %s)\n", version, gitHash)
 	}
+
+	if *versionCheck {
+		checkForUpdate(&http.Client{Timeout: 3 * time.Second})
+	}
+}
+
+// Compares the running version against the latest release. Failures
+// (e.g. when offline) are reported but never cause an error exit.
+func checkForUpdate(client util.HTTPClient) {
+	latest, err := util.LatestRelease(client, util.ReleaseRepository)
+	if err != nil {
+		util.Warnf("Could not check for updates: %v", err)
+		return
+	}
+
+	cmp, err := util.CompareVersions(version, latest)
+	if err != nil {
+		util.Warnf("Could not check for updates: %v", err)
+		return
+	}
+
+	if cmp < 0 {
+		fmt.Printf("A newer version of kontemplate is available: %s\n", latest)
+	} else {
+		fmt.Println("Kontemplate is up to date.")
+	}
 }
 
 func templateCommand() {
-	_, resourceSets := loadContextAndResources(templateFile)
+	ctx := loadContext(templateFile, true)
+
+	if len(clusterContexts(ctx)) > 1 && *templateOutputDir == "" && *templateFormat == "json" && !*templateJSONLines {
+		fail(exitUsage, "A single JSON array can not be printed for multiple contexts, use --json-lines or -o instead\n")
+	}
+
+	if *templateFilenames != "" {
+		if *templateOutputDir == "" || *templateOutputMode != "per-file" || *templateLayout != "flat" {
+			fail(exitUsage, "--filename-template can only be used with --output and the default output mode and layout\n")
+		}
+
+		var err error
+		if filenameTemplate, err = parseFilenameTemplate(*templateFilenames); err != nil {
+			fail(exitUsage, "%v\n", err)
+		}
+	}
+
+	if *templateArgoCD {
+		var err error
+		if argoApp, err = argoSettingsFromFlags(); err != nil {
+			fail(exitUsage, "%v\n", err)
+		}
+	}
+
+	// The output of multiple contexts is printed one after another,
+	// or written to one subdirectory per context.
+	forEachCluster(ctx, 1, false, func(c *context.Context) error {
+		resourceSets, err := renderResources(c)
+		if err != nil {
+			return err
+		}
+
+		if *templateDuplicates {
+			if err := checkDuplicates(resourceSets); err != nil {
+				return err
+			}
+		}
+
+		if *templateAnnotate {
+			if err := annotateResources(&resourceSets); err != nil {
+				return err
+			}
+		}
+
+		outputDir := *templateOutputDir
+		if multiCluster && outputDir != "" {
+			outputDir = path.Join(outputDir, kubectlContext(c))
+		} else if multiCluster && *templateFormat != "json" {
+			fmt.Printf("# Context: %s\n", kubectlContext(c))
+		}
+
+		return withExitCode(exitTemplate, templateResources(c, &resourceSets, outputDir))
+	})
+}
+
+// Prints the rendered resource sets of a context or writes them to the
+// output directory. Errors writing the output are returned.
+func templateResources(ctx *context.Context, resourceSets *[]templater.RenderedResourceSet, outputDir string) error {
+	if *templateValidate || *templateSchemaVer != "master" {
+		validateSchemas(resourceSets)
+	}
+
+	var documents []json.RawMessage
+	var stream strings.Builder
+	var named, argoSets []templater.RenderedResourceSet
 
 	for _, rs := range *resourceSets {
 		if len(rs.Resources) == 0 {
-			fmt.Fprintf(os.Stderr, "Warning: Resource set '%s' does not exist or contains no valid templates\n", rs.Name)
+			util.Warnf("Resource set '%s' contains no valid templates", rs.Name)
 			continue
 		}
 
-		if *templateOutputDir != "" {
-			templateIntoDirectory(templateOutputDir, rs)
+		if outputDir != "" && *templateOutputMode == "single" {
+			stream.WriteString(yamlStream(rs))
+		} else if outputDir != "" && filenameTemplate != nil {
+			named = append(named, rs)
+		} else if outputDir != "" && argoApp != nil {
+			argoSets = append(argoSets, rs)
+		} else if outputDir != "" {
+			if err := templateIntoDirectory(&outputDir, rs); err != nil {
+				return err
+			}
+		} else if *templateFormat == "yaml" {
+			printYAMLStream(rs)
+		} else if *templateFormat == "json" {
+			documents = append(documents, convertToJSON(rs)...)
 		} else {
-			for _, r := range rs.Resources {
-				fmt.Fprintf(os.Stderr, "Rendered file %s/%s:\n", rs.Name, r.Filename)
-				fmt.Println(r.Rendered)
+			printRenderedFiles(os.Stdout, rs)
+		}
+	}
+
+	if outputDir == "" && *templateFormat == "json" {
+		printJSONDocuments(documents)
+	}
+
+	if outputDir != "" && *templateOutputMode == "single" {
+		if err := writeOutputFile(path.Join(outputDir, "resources.yaml"), stream.String()); err != nil {
+			return err
+		}
+	}
+
+	if len(named) > 0 {
+		if err := writeTemplatedFiles(outputDir, named); err != nil {
+			return err
+		}
+	}
+
+	if len(argoSets) > 0 {
+		// Applications for multiple contexts are written to the
+		// subdirectory of each context.
+		subdir := ""
+		if multiCluster {
+			subdir = kubectlContext(ctx)
+		}
+
+		if err := writeArgoApplications(argoApp, outputDir, subdir, argoSets); err != nil {
+			return err
+		}
+	}
+
+	if *templateUnused {
+		reportUnusedVariables(ctx, resourceSets)
+	}
+
+	return nil
+}
+
+// Reports objects that are rendered more than once by the same resource
+// set, of which only one would end up in the cluster.
+func checkDuplicates(resourceSets []templater.RenderedResourceSet) error {
+	duplicates := 0
+
+	for i := range resourceSets {
+		for _, problem := range templater.DuplicateResources(&resourceSets[i]) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", problem)
+			duplicates++
+		}
+	}
+
+	if duplicates > 0 {
+		return withExitCode(exitValidation, fmt.Errorf("Found %d duplicate object(s)", duplicates))
+	}
+
+	return nil
+}
+
+// Warns about variables of the rendered resource sets that none of
+// their templates refer to.
+func reportUnusedVariables(ctx *context.Context, resourceSets *[]templater.RenderedResourceSet) {
+	rendered := make(map[string]bool, len(*resourceSets))
+	for _, rs := range *resourceSets {
+		rendered[rs.Name] = true
+	}
+
+	for _, rs := range ctx.ResourceSets {
+		if !rendered[rs.Name] {
+			continue
+		}
+
+		unused, err := templater.UnusedVariables(ctx, &rs)
+		if err != nil {
+			fail(exitTemplate, "Could not determine unused variables of %s: %v\n", rs.Name, err)
+		}
+
+		if len(unused) > 0 {
+			util.Warnf("Resource set '%s' does not use the variables: %s", rs.Name, strings.Join(unused, ", "))
+		}
+	}
+}
+
+// Validates every rendered document against the Kubernetes JSON
+// schemas and fails before printing anything if any of them are
+// invalid. Documents without a known schema (e.g. custom resources)
+// are skipped with a notice.
+func validateSchemas(resourceSets *[]templater.RenderedResourceSet) {
+	validator := schema.NewValidator(*templateSchemaVer, *cacheDir)
+	failures := 0
+
+	for _, rs := range *resourceSets {
+		for _, r := range rs.Resources {
+			for _, doc := range util.SplitDocuments(r.Rendered) {
+				result, err := validator.ValidateDocument(doc)
+				if err != nil {
+					fail(exitValidation, "Could not validate %s/%s: %v\n", rs.Name, r.Filename, err)
+				}
+
+				if result.Skipped {
+					util.Infof("Notice: No schema found for a document in %s/%s, skipping validation", rs.Name, r.Filename)
+					continue
+				}
+
+				for _, e := range result.Errors {
+					fmt.Fprintf(os.Stderr, "Invalid resource in %s/%s: %s\n", rs.Name, r.Filename, e)
+				}
+
+				if len(result.Errors) > 0 {
+					failures++
+				}
 			}
 		}
 	}
+
+	if failures > 0 {
+		fail(exitValidation, "%d document(s) failed schema validation\n", failures)
+	}
+}
+
+// Prints every document of a resource set on stdout, each prefixed
+// with a document separator, to form a single machine-readable YAML
+// stream.
+func printYAMLStream(rs templater.RenderedResourceSet) {
+	fmt.Print(yamlStream(rs))
+}
+
+// Concatenates all documents of a resource set into a single YAML
+// stream in which every document is preceded by a separator and ends
+// with a newline.
+func yamlStream(rs templater.RenderedResourceSet) string {
+	var b strings.Builder
+
+	for _, r := range rs.Resources {
+		for _, doc := range util.SplitDocuments(r.Rendered) {
+			fmt.Fprintf(&b, "---\n%s\n", doc)
+		}
+	}
+
+	return b.String()
+}
+
+// Converts every document of a resource set to JSON.
+func convertToJSON(rs templater.RenderedResourceSet) []json.RawMessage {
+	var documents []json.RawMessage
+
+	for _, r := range rs.Resources {
+		converted, err := util.DocumentsToJSON(r.Rendered)
+		if err != nil {
+			fail(exitTemplate, "Could not convert %s/%s to JSON: %v\n", rs.Name, r.Filename, err)
+		}
+
+		documents = append(documents, converted...)
+	}
+
+	return documents
 }
 
-func templateIntoDirectory(outputDir *string, rs templater.RenderedResourceSet) {
+// Prints documents either as a single JSON array or, with --json-lines,
+// as newline-delimited JSON.
+func printJSONDocuments(documents []json.RawMessage) {
+	if *templateJSONLines {
+		for _, doc := range documents {
+			fmt.Println(string(doc))
+		}
+		return
+	}
+
+	if documents == nil {
+		documents = []json.RawMessage{}
+	}
+
+	output, err := json.MarshalIndent(documents, "", "  ")
+	if err != nil {
+		fail(exitTemplate, "Could not print JSON output: %v\n", err)
+	}
+
+	fmt.Println(string(output))
+}
+
+func templateIntoDirectory(outputDir *string, rs templater.RenderedResourceSet) error {
 	// Attempt to create the output directory if it does not
 	// already exist:
-	if err := os.MkdirAll(*templateOutputDir, 0775); err != nil {
-		app.Fatalf("Could not create output directory: %v\n", err)
+	if err := os.MkdirAll(*outputDir, 0775); err != nil {
+		return fmt.Errorf("Could not create output directory: %v", err)
 	}
 
 	// Nested resource sets may contain slashes in their names.
@@ -125,50 +569,441 @@ func templateIntoDirectory(outputDir *string, rs templater.RenderedResourceSet)
 	// flat list of output files:
 	setName := strings.Replace(rs.Name, "/", "-", -1)
 
-	for _, r := range rs.Resources {
-		filename := fmt.Sprintf("%s/%s-%s", *templateOutputDir, setName, r.Filename)
-		fmt.Fprintf(os.Stderr, "Writing file %s\n", filename)
+	// In the tree layout the slashes instead become directories:
+	setDir := path.Join(*outputDir, rs.Name)
+
+	if *templateOutputMode == "per-set" {
+		filename := path.Join(*outputDir, setName+".yaml")
+		if *templateLayout == "tree" {
+			filename = setDir + ".yaml"
+		}
+
+		return writeOutputFile(filename, yamlStream(rs))
+	}
+
+	// Files from subdirectories of recursive resource sets are
+	// flattened in the same way, which can map two files to the same
+	// name (e.g. 'a/b.yaml' and 'a-b.yaml'). This is checked before
+	// any file is written.
+	filenames := make([]string, len(rs.Resources))
+	sources := make(map[string]string)
+	for i, r := range rs.Resources {
+		filenames[i] = fmt.Sprintf("%s/%s-%s", *outputDir, setName, strings.Replace(r.Filename, "/", "-", -1))
+		if *templateLayout == "tree" {
+			filenames[i] = path.Join(setDir, r.Filename)
+		}
+
+		if other, ok := sources[filenames[i]]; ok {
+			return fmt.Errorf("Files '%s' and '%s' of resource set '%s' would both be written to %s, use '--output-layout tree' instead", other, r.Filename, rs.Name, filenames[i])
+		}
+		sources[filenames[i]] = r.Filename
+	}
+
+	for i, r := range rs.Resources {
+		if err := writeOutputFile(filenames[i], r.Rendered); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes the resource sets that are about to be passed to kubectl to the
+// directory given with --dump-rendered, in the same layout as 'template
+// -o'. This happens before kubectl runs, so that the manifests are kept
+// for inspection even if kubectl fails.
+func dumpRenderedResources(ctx *context.Context, resources *[]templater.RenderedResourceSet) error {
+	if *dumpRendered == "" {
+		return nil
+	}
+
+	dir := *dumpRendered
+	if multiCluster {
+		dir = path.Join(dir, kubectlContext(ctx))
+	}
+
+	for _, rs := range *resources {
+		if err := templateIntoDirectory(&dir, rs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeOutputFile(filename string, content string) error {
+	if err := os.MkdirAll(path.Dir(filename), 0775); err != nil {
+		return fmt.Errorf("Could not create output directory: %v", err)
+	}
+
+	util.Infof("Writing file %s", filename)
+
+	if err := ioutil.WriteFile(filename, []byte(content), 0664); err != nil {
+		return fmt.Errorf("Error writing file %s: %v", filename, err)
+	}
+
+	return nil
+}
+
+func applyCommand() {
+	if *applyPruneDryRun && *applyDryRun == "client" {
+		fail(exitUsage, "--prune-dry-run uses a server-side dry-run and can not be combined with --dry-run=client\n")
+	}
+
+	if *applyPruneDryRun {
+		*applyDryRun = "server"
+	}
+
+	kubectlArgs, err := applyArgs(*applyDryRun, *applyServerSide, *applyForceConflicts, *applyFieldManager)
+	if err != nil {
+		fail(exitUsage, "%v\n", err)
+	}
+
+	pruneArgs, err := pruneWhitelistArgs(*applyPrune || *applyPruneDryRun, *applyPruneWhitelist)
+	if err != nil {
+		fail(exitUsage, "%v\n", err)
+	}
+
+	dryRun := *applyDryRun != "none"
+
+	if (*applyPrune || *applyPruneDryRun) && !*applyConfirm && !dryRun {
+		fail(exitUsage, "Pruning deletes resources from the cluster, please pass --confirm (or --dry-run)\n")
+	}
+
+	if *applyAtomic && *applyPrune && !dryRun {
+		fail(exitUsage, "Pruned resources can not be rolled back, --atomic can not be combined with --prune\n")
+	}
+
+	ctx := loadContext(applyFile, true)
+	if *summaryOutput != "" && len(clusterContexts(ctx)) > 1 {
+		fail(exitUsage, "--summary-output can not be used with multiple contexts\n")
+	}
 
-		file, err := os.Create(filename)
+	forEachCluster(ctx, *clusterJobs, *keepGoing, func(c *context.Context) error {
+		resources, err := renderResources(c)
 		if err != nil {
-			app.Fatalf("Could not create file %s: %v\n", filename, err)
+			return withExitCode(exitTemplate, err)
 		}
 
-		_, err = fmt.Fprintf(file, r.Rendered)
+		if *applyDuplicates {
+			if err := checkDuplicates(resources); err != nil {
+				return err
+			}
+		}
+
+		// Failures of kubectl, waiting and rollbacks all originate
+		// from the cluster.
+		return withExitCode(exitKubectl, applyResources(c, &resources, kubectlArgs, pruneArgs))
+	})
+}
+
+// Applies the rendered resource sets to the cluster of a context.
+func applyResources(ctx *context.Context, resources *[]templater.RenderedResourceSet, kubectlArgs []string, pruneArgs []string) error {
+	dryRun := *applyDryRun != "none"
+
+	if *applyEnsureNamespace {
+		addNamespaceResources(resources, false)
+	}
+
+	if *applyPrune || *applyPruneDryRun {
+		if err := prepareResourcesForPruning(resources, pruneArgs); err != nil {
+			return withExitCode(exitTemplate, err)
+		}
+	}
+
+	startSummary("apply", ctx, resources)
+
+	// Unchanged resource sets remain 'skipped' in the summary.
+	var hashes map[string]string
+	if *applyIncremental && !*applyPruneDryRun {
+		hashes = skipUnchangedResourceSets(ctx, resources, kubectlArgs)
+	}
+
+	// Annotations are added after hashing, as the time of the apply
+	// would otherwise change the hash of every resource set.
+	if *applyAnnotate {
+		if err := annotateResources(resources); err != nil {
+			return withExitCode(exitTemplate, err)
+		}
+	}
+
+	if err := dumpRenderedResources(ctx, resources); err != nil {
+		return withExitCode(exitTemplate, err)
+	}
+
+	if *applyPruneDryRun {
+		previews, err := previewPrune(ctx, &kubectlArgs, resources)
 		if err != nil {
-			app.Fatalf("Error writing file %s: %v\n", filename, err)
+			return kubectlError(err)
+		}
+
+		printPrunePreview(clusterWriter(ctx, os.Stdout), previews)
+		return nil
+	}
+
+	if dryRun {
+		if err := runKubectlWithResources(ctx, &kubectlArgs, resources); err != nil {
+			return kubectlError(err)
 		}
+		return nil
 	}
+
+	if err := applyToCluster(ctx, resources, kubectlArgs); err != nil {
+		return err
+	}
+
+	// Hashes are only recorded once all resource sets were applied,
+	// so that resource sets are never skipped after a failure.
+	return withExitCode(exitTemplate, recordAppliedResourceSets(ctx, hashes))
 }
 
-func applyCommand() {
-	ctx, resources := loadContextAndResources(applyFile)
+func applyToCluster(ctx *context.Context, resources *[]templater.RenderedResourceSet, kubectlArgs []string) error {
+	if *applyAtomic {
+		return atomicApply(ctx, &kubectlArgs, resources, *applyWait, *applyWaitTimeout)
+	}
+
+	if !*applyWait {
+		if err := runKubectlWithResources(ctx, &kubectlArgs, resources); err != nil {
+			return kubectlError(err)
+		}
+		return nil
+	}
+
+	for _, rs := range *resources {
+		start := time.Now()
+		if err := runKubectlWithResourceSet(ctx, &kubectlArgs, &rs); err != nil {
+			recordResourceSet(rs.Name, start, err)
+			return kubectlError(err)
+		}
 
-	var kubectlArgs []string
+		err := waitForWorkloads(ctx, &rs, *applyWaitTimeout)
+		recordResourceSet(rs.Name, start, err)
 
-	if *applyDryRun {
-		kubectlArgs = []string{"apply", "-f", "-", "--dry-run"}
-	} else {
-		kubectlArgs = []string{"apply", "-f", "-"}
+		if err != nil {
+			return err
+		}
 	}
 
-	if err := runKubectlWithResources(ctx, &kubectlArgs, resources); err != nil {
-		failWithKubectlError(err)
+	return nil
+}
+
+// Prints the rendered files of a resource set for inspection. The
+// content of sensitive resource sets is only written by the explicit
+// output formats and directories.
+func printRenderedFiles(w io.Writer, rs templater.RenderedResourceSet) {
+	for _, r := range rs.Resources {
+		if rs.Sensitive {
+			util.Infof("Rendered file %s: (hidden as resource set '%s' is sensitive, use --output-format yaml or -o to write it)", util.Highlight(rs.Name+"/"+r.Filename), rs.Name)
+			continue
+		}
+
+		util.Infof("Rendered file %s:", util.Highlight(rs.Name+"/"+r.Filename))
+		fmt.Fprintln(w, r.Rendered)
 	}
 }
 
+// Returns the kubectl arguments for applying resources in the given
+// dry-run mode, optionally using server-side apply. Without a field
+// manager, server-side apply uses 'kontemplate' while client-side apply
+// uses the default of kubectl.
+func applyArgs(dryRun string, serverSide bool, forceConflicts bool, fieldManager string) ([]string, error) {
+	args := []string{"apply", "-f", "-"}
+
+	if forceConflicts && !serverSide {
+		return nil, fmt.Errorf("--force-conflicts can only be used with --server-side")
+	}
+
+	if serverSide && dryRun == "client" {
+		return nil, fmt.Errorf("--server-side can not be combined with --dry-run=client, use --dry-run=server instead")
+	}
+
+	if dryRun != "none" {
+		args = append(args, fmt.Sprintf("--dry-run=%s", dryRun))
+	}
+
+	if serverSide && fieldManager == "" {
+		fieldManager = "kontemplate"
+	}
+
+	if serverSide {
+		args = append(args, "--server-side")
+	}
+
+	if fieldManager != "" {
+		args = append(args, fmt.Sprintf("--field-manager=%s", fieldManager))
+	}
+
+	if forceConflicts {
+		args = append(args, "--force-conflicts")
+	}
+
+	return args, nil
+}
+
+// Older versions of kontemplate accepted '--dry-run' as a boolean
+// flag. As kingpin does not support flags with optional values, a bare
+// '--dry-run' is rewritten to '--dry-run=client' before parsing.
+func normaliseDryRunFlag(args []string) []string {
+	normalised := make([]string, len(args))
+	copy(normalised, args)
+
+	for i, arg := range normalised {
+		if arg != "--dry-run" {
+			continue
+		}
+
+		if i+1 < len(normalised) {
+			switch normalised[i+1] {
+			case "none", "client", "server":
+				continue
+			}
+		}
+
+		util.Warnf("A bare --dry-run is deprecated, please use --dry-run=client")
+		normalised[i] = "--dry-run=client"
+	}
+
+	return normalised
+}
+
+// Returns the kubectl arguments that limit pruning to the given
+// 'group/version/kind' types, which are validated before running kubectl.
+func pruneWhitelistArgs(prune bool, whitelist []string) ([]string, error) {
+	if len(whitelist) > 0 && !prune {
+		return nil, fmt.Errorf("--prune-whitelist can only be used with --prune or --prune-dry-run")
+	}
+
+	var args []string
+	for _, entry := range whitelist {
+		parts := strings.Split(entry, "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid --prune-whitelist entry '%s', expected 'group/version/kind' (e.g. 'core/v1/ConfigMap')", entry)
+		}
+
+		args = append(args, fmt.Sprintf("--prune-whitelist=%s", entry))
+	}
+
+	return args, nil
+}
+
+// Pruning is scoped to each individual resource set by labelling all of
+// its resources, otherwise applying one resource set would prune the
+// resources of all others. Additional arguments, such as a whitelist of
+// pruned types, are passed along with '--prune'.
+func prepareResourcesForPruning(resources *[]templater.RenderedResourceSet, pruneArgs []string) error {
+	for i, rs := range *resources {
+		if rs.Prune != nil && !*rs.Prune {
+			util.Infof("Not pruning resource set '%s' as pruning is disabled for it", rs.Name)
+			continue
+		}
+
+		labels := map[string]string{
+			managedByLabel:   "kontemplate",
+			resourceSetLabel: strings.Replace(rs.Name, "/", ".", -1),
+		}
+
+		if err := templater.AddLabels(&rs, labels); err != nil {
+			return fmt.Errorf("Error labelling resources for pruning: %v", err)
+		}
+
+		selector := fmt.Sprintf("%s=%s,%s=%s", managedByLabel, labels[managedByLabel], resourceSetLabel, labels[resourceSetLabel])
+		util.Infof("Pruning resource set '%s' with selector %s", rs.Name, selector)
+
+		// The arguments of the resource set share their backing
+		// array with the cluster configuration, which is used by
+		// all contexts concurrently.
+		args := append([]string(nil), rs.Args...)
+		args = append(args, "--prune", fmt.Sprintf("--selector=%s", selector))
+		rs.Args = append(args, pruneArgs...)
+		(*resources)[i] = rs
+	}
+
+	return nil
+}
+
 func replaceCommand() {
 	ctx, resources := loadContextAndResources(replaceFile)
-	args := []string{"replace", "--save-config=true", "-f", "-"}
+	args := replaceArgs(*replaceForce, *replaceSaveConfig)
+
+	if *replaceForce {
+		util.Warnf("With --force, all resources are deleted and re-created")
+	}
+
+	confirmOperation("replace", ctx, resources, *replaceYes)
+	startSummary("replace", ctx, resources)
+	if err := dumpRenderedResources(ctx, resources); err != nil {
+		fail(exitTemplate, "%v\n", err)
+	}
 
 	if err := runKubectlWithResources(ctx, &args, resources); err != nil {
 		failWithKubectlError(err)
 	}
 }
 
+// Returns the kubectl arguments for replacing resources, optionally
+// deleting and re-creating them.
+func replaceArgs(force bool, saveConfig bool) []string {
+	args := []string{"replace", fmt.Sprintf("--save-config=%t", saveConfig), "-f", "-"}
+
+	if force {
+		args = append(args, "--force")
+	}
+
+	return args
+}
+
+// Returns the kubectl arguments for deleting resources with the given
+// cascading strategy and grace period, which are validated before
+// running kubectl. Empty and negative values use the kubectl defaults.
+func deleteArgs(cascade string, gracePeriod int) ([]string, error) {
+	args := []string{"delete", "-f", "-"}
+
+	switch cascade {
+	case "":
+	case "background", "foreground", "orphan":
+		args = append(args, fmt.Sprintf("--cascade=%s", cascade))
+	default:
+		return nil, fmt.Errorf("invalid --cascade value '%s', expected 'background', 'foreground' or 'orphan'", cascade)
+	}
+
+	// kubectl only accepts a grace period of 0 together with --force,
+	// which skips waiting for the confirmation of the deletion.
+	if gracePeriod == 0 {
+		return nil, fmt.Errorf("--grace-period=0 is not supported, use 1 for an immediate shutdown")
+	} else if gracePeriod > 0 {
+		args = append(args, fmt.Sprintf("--grace-period=%d", gracePeriod))
+	} else if gracePeriod < -1 {
+		return nil, fmt.Errorf("invalid --grace-period %d, expected a number of seconds or -1", gracePeriod)
+	}
+
+	return args, nil
+}
+
 func deleteCommand() {
+	args, err := deleteArgs(*deleteCascade, *deleteGrace)
+	if err != nil {
+		fail(exitUsage, "%v\n", err)
+	}
+
+	if *deleteCascade == "orphan" {
+		util.Warnf("With --cascade=orphan, dependents such as the pods of deleted workloads are kept running")
+	}
+
 	ctx, resources := loadContextAndResources(deleteFile)
-	args := []string{"delete", "-f", "-"}
+
+	// Resources are deleted in the reverse order of their
+	// creation, e.g. custom resources before their definitions.
+	reverseResourceSets(resources)
+
+	if *deleteNamespaces {
+		addNamespaceResources(resources, true)
+	}
+
+	confirmOperation("delete", ctx, resources, *deleteYes)
+	startSummary("delete", ctx, resources)
+	if err := dumpRenderedResources(ctx, resources); err != nil {
+		fail(exitTemplate, "%v\n", err)
+	}
 
 	if err := runKubectlWithResources(ctx, &args, resources); err != nil {
 		failWithKubectlError(err)
@@ -178,58 +1013,362 @@ func deleteCommand() {
 func createCommand() {
 	ctx, resources := loadContextAndResources(createFile)
 	args := []string{"create", "--save-config=true", "-f", "-"}
+	startSummary("create", ctx, resources)
+	if err := dumpRenderedResources(ctx, resources); err != nil {
+		fail(exitTemplate, "%v\n", err)
+	}
 
 	if err := runKubectlWithResources(ctx, &args, resources); err != nil {
 		failWithKubectlError(err)
 	}
 }
 
-func loadContextAndResources(file *string) (*context.Context, *[]templater.RenderedResourceSet) {
-	ctx, err := context.LoadContext(*file, variables)
-	if err != nil {
-		app.Fatalf("Error loading context: %v\n", err)
+// Diffing differs from the other kubectl-wrapping commands in that
+// 'kubectl diff' exits with status 1 if differences were found. All
+// resource sets are diffed before kontemplate exits with a dedicated
+// status, which makes this command usable as a CI gate.
+func diffCommand() {
+	if *diffContext < 0 {
+		fail(exitUsage, "invalid --diff-context %d, expected a number of lines >= 0\n", *diffContext)
 	}
 
-	resources, err := templater.LoadAndApplyTemplates(includes, excludes, ctx)
+	ctx, resources := loadContextAndResources(diffFile)
+	args := []string{"diff", "-f", "-"}
+	differences := false
+
+	for _, rs := range *resources {
+		if *diffLocal {
+			changed, err := localDiffResourceSet(ctx, &rs, *diffContext)
+			if err != nil {
+				fail(exitTemplate, "Error diffing resource set '%s': %v\n", rs.Name, err)
+			}
+
+			differences = differences || changed
+			continue
+		}
+
+		err := runKubectlWithResourceSet(ctx, &args, &rs)
+		if err == nil {
+			continue
+		}
+
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			differences = true
+			continue
+		}
+
+		failWithKubectlError(err)
+	}
+
+	if differences {
+		fmt.Fprintln(os.Stderr, "Differences found between rendered resources and cluster state")
+		exit(exitDifferences)
+	}
+}
+
+func planCommand() {
+	ctx, resources := loadContextAndResources(planFile)
+
+	plans, err := planResourceSets(ctx, *resources)
 	if err != nil {
-		app.Fatalf("Error templating resource sets: %v\n", err)
+		fail(exitKubectl, "Error planning changes: %v\n", err)
 	}
 
-	return ctx, &resources
+	if printPlan(os.Stdout, plans) && *planExitCode {
+		exit(exitDifferences)
+	}
 }
 
-func runKubectlWithResources(c *context.Context, kubectlArgs *[]string, resourceSets *[]templater.RenderedResourceSet) error {
-	argsWithContext := append(*kubectlArgs, fmt.Sprintf("--context=%s", c.Name))
+// Validation passes every file to kubectl individually so that errors
+// can be attributed to it. Unlike the other commands, validation
+// continues after errors and reports all failures at the end.
+func validateCommand() {
+	ctx, resources := loadContextAndResources(validateFile)
+	args := []string{"apply", fmt.Sprintf("--dry-run=%s", *validateMode), "-f", "-"}
+	var failures []string
+	total := 0
 
-	for _, rs := range *resourceSets {
-		if len(rs.Resources) == 0 {
-			fmt.Fprintf(os.Stderr, "Warning: Resource set '%s' contains no valid templates\n", rs.Name)
-			continue
+	for _, rs := range *resources {
+		for _, r := range rs.Resources {
+			total++
+			single := templater.RenderedResourceSet{
+				Name:      rs.Name,
+				Resources: []templater.RenderedResource{r},
+				Args:      rs.Args,
+			}
+
+			var stderr bytes.Buffer
+			if err := runKubectl(ctx, &args, &single, os.Stdout, &stderr); err != nil {
+				reason := strings.TrimSpace(stderr.String())
+				if reason == "" {
+					reason = err.Error()
+				}
+
+				if rs.Sensitive {
+					reason = "error details are hidden as the resource set is sensitive"
+				}
+
+				failures = append(failures, fmt.Sprintf("%s/%s: %s", rs.Name, r.Filename, reason))
+			}
 		}
+	}
+
+	for _, failure := range failures {
+		fmt.Fprintf(os.Stderr, "Validation failed for %s\n", failure)
+	}
+
+	if len(failures) > 0 {
+		fail(exitValidation, "%d of %d files failed validation\n", len(failures), total)
+	}
+
+	fmt.Fprintf(os.Stderr, "All %d files passed validation\n", total)
+}
+
+func lintCommand() {
+	ctx := loadContext(lintFile, false)
+	problems := templater.LintResourceSets(includes, excludes, ctx)
+
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", problem)
+	}
+
+	if len(problems) > 0 {
+		fail(exitValidation, "Found %d problems\n", len(problems))
+	}
 
-		argsWithResourceSetArgs := append(argsWithContext, rs.Args...)
+	fmt.Fprintln(os.Stderr, "No problems found")
+}
+
+func explainCommand() {
+	ctx := loadContext(explainFile, false)
+	sets := templater.SelectResourceSets(ctx, includes, excludes)
+
+	if len(sets) == 0 {
+		fail(exitTemplate, "No valid resource sets included!\n")
+	}
 
-		kubectl := exec.Command(*kubectlBin, argsWithResourceSetArgs...)
+	for _, rs := range sets {
+		if *explainPath != "" {
+			explainValue(ctx, &rs, *explainPath)
+			continue
+		}
 
-		stdin, err := kubectl.StdinPipe()
+		values, err := yaml.Marshal(rs.Values)
 		if err != nil {
-			return fmt.Errorf("kubectl error: %v", err)
+			fail(exitTemplate, "Could not serialise variables of %s: %v\n", rs.Name, err)
 		}
 
-		kubectl.Stdout = os.Stdout
-		kubectl.Stderr = os.Stderr
+		fmt.Printf("# Resource set: %s\n%s", rs.Name, values)
+	}
+}
+
+func listCommand() {
+	ctx := loadContext(listFile, false)
+
+	sets, err := templater.ListFiles(ctx, includes, excludes)
+	if err != nil {
+		fail(exitTemplate, "%v\n", err)
+	}
+
+	if len(sets) == 0 {
+		fail(exitTemplate, "No valid resource sets included!\n")
+	}
+
+	printFileList(os.Stdout, sets)
+}
 
-		if err = kubectl.Start(); err != nil {
-			return fmt.Errorf("kubectl error: %v", err)
+// Prints the files of each resource set, flagging resource sets that
+// would not render anything.
+func printFileList(w io.Writer, sets []templater.ResourceSetFiles) {
+	for _, rs := range sets {
+		switch {
+		case !rs.Enabled:
+			fmt.Fprintf(w, "%s (%s): disabled\n", rs.Name, rs.Path)
+		case len(rs.Files) == 0:
+			fmt.Fprintf(w, "%s (%s): no files\n", rs.Name, rs.Path)
+			util.Warnf("Resource set '%s' does not contain any files to template", rs.Name)
+		default:
+			fmt.Fprintf(w, "%s (%s): %d file(s)\n", rs.Name, rs.Path, len(rs.Files))
 		}
 
-		for _, r := range rs.Resources {
-			fmt.Printf("Passing file %s/%s to kubectl\n", rs.Name, r.Filename)
-			fmt.Fprintln(stdin, r.Rendered)
+		for _, file := range rs.Files {
+			if rs.Type == templater.KustomizeType {
+				file += " (built with kubectl kustomize)"
+			} else if rs.Type == templater.RawType {
+				file += " (not templated)"
+			}
+
+			fmt.Fprintf(w, "  %s\n", file)
+		}
+	}
+}
+
+func explainValue(ctx *context.Context, rs *context.ResourceSet, variable string) {
+	origin, err := ctx.ExplainValue(rs.Name, variable)
+	if err != nil {
+		fail(exitTemplate, "%v\n", err)
+	}
+
+	if origin == nil {
+		fmt.Printf("%s: %s is not set\n", rs.Name, variable)
+		return
+	}
+
+	value, err := json.Marshal(origin.Value)
+	if err != nil {
+		fail(exitTemplate, "Could not serialise %s of %s: %v\n", variable, rs.Name, err)
+	}
+
+	source := origin.Source
+	if source == "" {
+		source = "--namespace"
+	}
+
+	fmt.Printf("%s: %s = %s (from %s)\n", rs.Name, variable, value, source)
+	for _, overridden := range origin.Overridden {
+		fmt.Printf("  overrides %s\n", overridden)
+	}
+}
+
+func reverseResourceSets(rs *[]templater.RenderedResourceSet) {
+	sets := *rs
+	for i, j := 0, len(sets)-1; i < j; i, j = i+1, j-1 {
+		sets[i], sets[j] = sets[j], sets[i]
+	}
+}
+
+func loadContextAndResources(files *[]string) (*context.Context, *[]templater.RenderedResourceSet) {
+	ctx := loadContext(files, true)
+
+	resources, err := renderResources(ctx)
+	if err != nil {
+		fail(exitTemplate, "%v\n", err)
+	}
+
+	return ctx, &resources
+}
+
+// Renders the selected resource sets of a context and applies the
+// filters and post-rendering given on the command line.
+func renderResources(ctx *context.Context) ([]templater.RenderedResourceSet, error) {
+	resources, err := kontemplate.RenderWithOptions(ctx, *includes, *excludes, &kontemplate.Options{
+		Jobs:         *jobs,
+		Labels:       *labels,
+		Selector:     *selector,
+		IncludeKinds: splitList(*includeKinds),
+		ExcludeKinds: splitList(*excludeKinds),
+		SetFields:    *setFields,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if *postRenderCmd != "" {
+		for i := range resources {
+			if err := postRender(&resources[i], *postRenderCmd, *postRenderArg); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return resources, nil
+}
+
+// Splits comma-separated flag values into a single list.
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+
+	return list
+}
+
+// Loads the cluster configuration. Variables are only loaded from the
+// cluster (see 'fromCluster') if 'fromCluster' is set, which commands
+// that do not render resources leave unset.
+func loadContext(files *[]string, fromCluster bool) *context.Context {
+	ctx, err := context.LoadContexts(*files, &context.LoadOptions{
+		BaseDir:         *baseDir,
+		ExplicitVars:    *variables,
+		GlobalVarsFile:  *globalVars,
+		VarEnvPrefix:    *varEnvPrefix,
+		SetValues:       *setValues,
+		SetStringValues: *setStrings,
+		StrictEnv:       *strictEnv,
+		TemplateContext: *templateCtx,
+		CacheDir:        *cacheDir,
+		RefreshGit:      *refresh,
+		Decrypt:         *decrypt,
+		RecordSources:   *explainPath != "",
+		LoadFromCluster: fromCluster,
+		Kubectl:         *kubectlBin,
+		KubeContext:     *kubeContext,
+		KubeConfig:      *kubeconfig,
+		Timeout:         *timeout,
+	})
+	if err != nil {
+		fail(exitTemplate, "Error loading context: %v\n", err)
+	}
+
+	applyNamespaces(ctx, *namespace)
+
+	for _, rs := range ctx.ResourceSets {
+		if rs.DeprecatedArgs {
+			util.Warnf("Resource set '%s' uses the deprecated 'args' field, please rename it to 'kubectlArgs'", rs.Name)
+		}
+	}
+
+	if *kubeContext != "" && *kubeContext != ctx.KubectlContext() {
+		util.Warnf("Using kubectl context '%s' instead of '%s' from %s!", *kubeContext, ctx.KubectlContext(), strings.Join(*files, ", "))
+	}
+
+	warnUnmatchedSetNames(ctx, listedSets)
+
+	if *ignoreMissing {
+		removeMissingResourceSets(ctx)
+	}
+
+	return ctx
+}
+
+func removeMissingResourceSets(ctx *context.Context) {
+	existing := make([]context.ResourceSet, 0, len(ctx.ResourceSets))
+
+	for _, rs := range ctx.ResourceSets {
+		if _, err := os.Stat(rs.Path); os.IsNotExist(err) {
+			util.Warnf("Skipping resource set '%s' which does not exist at %s", rs.Name, rs.Path)
+			continue
 		}
-		stdin.Close()
 
-		if err = kubectl.Wait(); err != nil {
+		existing = append(existing, rs)
+	}
+
+	ctx.ResourceSets = existing
+}
+
+// Determines the kubectl context to use, which may be overridden on
+// the command line. Templates always see the context from the cluster
+// configuration.
+func kubectlContext(c *context.Context) string {
+	if *kubeContext != "" {
+		return *kubeContext
+	}
+
+	return c.KubectlContext()
+}
+
+func runKubectlWithResources(c *context.Context, kubectlArgs *[]string, resourceSets *[]templater.RenderedResourceSet) error {
+	for _, rs := range *resourceSets {
+		start := time.Now()
+		err := runKubectlWithResourceSet(c, kubectlArgs, &rs)
+		recordResourceSet(rs.Name, start, err)
+
+		if err != nil {
 			return err
 		}
 	}
@@ -237,6 +1376,90 @@ func runKubectlWithResources(c *context.Context, kubectlArgs *[]string, resource
 	return nil
 }
 
+func runKubectlWithResourceSet(c *context.Context, kubectlArgs *[]string, rs *templater.RenderedResourceSet) error {
+	return withRetries(*retries, *retryDelay, func() (string, error) {
+		var stderr bytes.Buffer
+		err := runKubectl(c, kubectlArgs, rs, clusterWriter(c, os.Stdout), io.MultiWriter(clusterWriter(c, os.Stderr), &stderr))
+		return stderr.String(), err
+	})
+}
+
+func runKubectl(c *context.Context, kubectlArgs *[]string, rs *templater.RenderedResourceSet, stdout io.Writer, stderr io.Writer) error {
+	if len(rs.Resources) == 0 {
+		util.Warnf("Resource set '%s' contains no valid templates", rs.Name)
+		return nil
+	}
+
+	// The arguments are copied, as they are shared by all contexts
+	// that run concurrently.
+	args := append(append([]string(nil), *kubectlArgs...), clusterArgs(c)...)
+	args = append(args, rs.Args...)
+
+	util.Debugf("Running %s %s", *kubectlBin, strings.Join(args, " "))
+	kubectl := exec.Command(*kubectlBin, args...)
+
+	stdin, err := kubectl.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("kubectl error: %v", err)
+	}
+
+	kubectl.Stdout = stdout
+	kubectl.Stderr = stderr
+
+	wait, err := util.StartCommand(kubectl, *timeout)
+	if err != nil {
+		return fmt.Errorf("kubectl error: %v", err)
+	}
+
+	for _, r := range rs.Resources {
+		util.Infof("Passing file %s to kubectl", util.Highlight(rs.Name+"/"+r.Filename))
+
+		// Writing fails if kubectl exited without reading all of
+		// its input, in which case the remaining files are not
+		// passed to it and its own error is reported as well.
+		if _, err := fmt.Fprintln(stdin, r.Rendered); err != nil {
+			stdin.Close()
+			return earlyExitError(rs, r.Filename, err, wait())
+		}
+	}
+	stdin.Close()
+
+	return wait()
+}
+
+// Describes a kubectl process that exited before all files of a
+// resource set were written to it.
+func earlyExitError(rs *templater.RenderedResourceSet, filename string, writeErr error, exitErr error) error {
+	if exitErr == nil {
+		exitErr = fmt.Errorf("exited successfully")
+	}
+
+	return fmt.Errorf("kubectl stopped reading before all files of resource set '%s' were passed to it (failed to write %s: %v): %v", rs.Name, filename, writeErr, exitErr)
+}
+
+// Returns the arguments that select the cluster kubectl talks to.
+func clusterArgs(c *context.Context) []string {
+	var args []string
+
+	// Without a context kubectl uses the current context of the
+	// kubeconfig.
+	if kubectlCtx := kubectlContext(c); kubectlCtx != "" {
+		args = append(args, fmt.Sprintf("--context=%s", kubectlCtx))
+	}
+
+	// The context is looked up in the specified kubeconfig file,
+	// or in the files from $KUBECONFIG if none is specified.
+	if *kubeconfig != "" {
+		args = append(args, fmt.Sprintf("--kubeconfig=%s", *kubeconfig))
+	}
+
+	return args
+}
+
 func failWithKubectlError(err error) {
-	app.Fatalf("Kubectl error: %v\n", err)
+	fail(exitKubectl, "%v\n", kubectlError(err))
+}
+
+func kubectlError(err error) error {
+	return withExitCode(exitKubectl, fmt.Errorf("Kubectl error: %v", err))
 }
@@ -0,0 +1,1235 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+func TestApplyArgs(t *testing.T) {
+	cases := map[string][]string{
+		"none":   {"apply", "-f", "-"},
+		"client": {"apply", "-f", "-", "--dry-run=client"},
+		"server": {"apply", "-f", "-", "--dry-run=server"},
+	}
+
+	for mode, expected := range cases {
+		if result, _ := applyArgs(mode, false, false, ""); !reflect.DeepEqual(expected, result) {
+			t.Errorf("Expected args %v for dry-run mode %s, but got %v\n", expected, mode, result)
+		}
+	}
+}
+
+func TestServerSideApplyArgs(t *testing.T) {
+	result, err := applyArgs("none", true, false, "")
+	expected := []string{"apply", "-f", "-", "--server-side", "--field-manager=kontemplate"}
+	if err != nil || !reflect.DeepEqual(expected, result) {
+		t.Errorf("Unexpected server-side apply args %v (%v)\n", result, err)
+	}
+
+	result, err = applyArgs("server", true, true, "")
+	expected = []string{"apply", "-f", "-", "--dry-run=server", "--server-side", "--field-manager=kontemplate", "--force-conflicts"}
+	if err != nil || !reflect.DeepEqual(expected, result) {
+		t.Errorf("Unexpected server-side dry-run args %v (%v)\n", result, err)
+	}
+
+	result, err = applyArgs("none", true, false, "deploy-bot")
+	expected = []string{"apply", "-f", "-", "--server-side", "--field-manager=deploy-bot"}
+	if err != nil || !reflect.DeepEqual(expected, result) {
+		t.Errorf("Unexpected args with a field manager %v (%v)\n", result, err)
+	}
+
+	result, err = applyArgs("none", false, false, "deploy-bot")
+	expected = []string{"apply", "-f", "-", "--field-manager=deploy-bot"}
+	if err != nil || !reflect.DeepEqual(expected, result) {
+		t.Errorf("Unexpected client-side args with a field manager %v (%v)\n", result, err)
+	}
+
+	if _, err = applyArgs("client", true, false, ""); err == nil {
+		t.Error("Expected server-side apply with client-side dry-run to fail")
+	}
+
+	if _, err = applyArgs("none", false, true, ""); err == nil {
+		t.Error("Expected --force-conflicts without --server-side to fail")
+	}
+}
+
+func TestReplaceArgs(t *testing.T) {
+	cases := []struct {
+		force      bool
+		saveConfig bool
+		expected   []string
+	}{
+		{false, true, []string{"replace", "--save-config=true", "-f", "-"}},
+		{true, true, []string{"replace", "--save-config=true", "-f", "-", "--force"}},
+		{false, false, []string{"replace", "--save-config=false", "-f", "-"}},
+		{true, false, []string{"replace", "--save-config=false", "-f", "-", "--force"}},
+	}
+
+	for _, c := range cases {
+		if result := replaceArgs(c.force, c.saveConfig); !reflect.DeepEqual(c.expected, result) {
+			t.Errorf("Expected args %v for force=%t, save-config=%t, but got %v\n", c.expected, c.force, c.saveConfig, result)
+		}
+	}
+}
+
+func TestDeleteArgs(t *testing.T) {
+	cases := []struct {
+		cascade     string
+		gracePeriod int
+		expected    []string
+	}{
+		{"", -1, []string{"delete", "-f", "-"}},
+		{"foreground", -1, []string{"delete", "-f", "-", "--cascade=foreground"}},
+		{"orphan", 30, []string{"delete", "-f", "-", "--cascade=orphan", "--grace-period=30"}},
+		{"", 1, []string{"delete", "-f", "-", "--grace-period=1"}},
+	}
+
+	for _, c := range cases {
+		if result, err := deleteArgs(c.cascade, c.gracePeriod); err != nil || !reflect.DeepEqual(c.expected, result) {
+			t.Errorf("Expected args %v for cascade=%s, grace-period=%d, but got %v (%v)\n", c.expected, c.cascade, c.gracePeriod, result, err)
+		}
+	}
+
+	if _, err := deleteArgs("true", -1); err == nil {
+		t.Errorf("Expected invalid cascade value to be rejected\n")
+	}
+
+	for _, invalid := range []int{0, -2} {
+		if _, err := deleteArgs("", invalid); err == nil {
+			t.Errorf("Expected grace period %d to be rejected\n", invalid)
+		}
+	}
+}
+
+func TestNormaliseDryRunFlag(t *testing.T) {
+	cases := []struct {
+		args     []string
+		expected []string
+	}{
+		{
+			args:     []string{"apply", "--dry-run", "cluster.yaml"},
+			expected: []string{"apply", "--dry-run=client", "cluster.yaml"},
+		},
+		{
+			args:     []string{"apply", "cluster.yaml", "--dry-run"},
+			expected: []string{"apply", "cluster.yaml", "--dry-run=client"},
+		},
+		{
+			args:     []string{"apply", "--dry-run", "server", "cluster.yaml"},
+			expected: []string{"apply", "--dry-run", "server", "cluster.yaml"},
+		},
+		{
+			args:     []string{"apply", "--dry-run=server", "cluster.yaml"},
+			expected: []string{"apply", "--dry-run=server", "cluster.yaml"},
+		},
+	}
+
+	for _, c := range cases {
+		if result := normaliseDryRunFlag(c.args); !reflect.DeepEqual(c.expected, result) {
+			t.Errorf("Expected args %v to be normalised to %v, but got %v\n", c.args, c.expected, result)
+		}
+	}
+}
+
+func TestRetriesOnTransientErrors(t *testing.T) {
+	attempts := 0
+	err := withRetries(3, time.Millisecond, func() (string, error) {
+		attempts++
+		if attempts < 3 {
+			return "Unable to connect to the server: dial tcp 10.0.0.1:443: i/o timeout", errors.New("exit status 1")
+		}
+		return "", nil
+	})
+
+	if err != nil || attempts != 3 {
+		t.Errorf("Expected success after 3 attempts, but got %v after %d\n", err, attempts)
+	}
+}
+
+func TestNoRetriesOnValidationErrors(t *testing.T) {
+	attempts := 0
+	err := withRetries(3, time.Millisecond, func() (string, error) {
+		attempts++
+		return `error validating data: unknown field "replica"`, errors.New("exit status 1")
+	})
+
+	if err == nil || attempts != 1 {
+		t.Errorf("Expected validation error not to be retried, but got %v after %d attempts\n", err, attempts)
+	}
+}
+
+func TestRetriesAreLimited(t *testing.T) {
+	attempts := 0
+	err := withRetries(2, time.Millisecond, func() (string, error) {
+		attempts++
+		return "connection refused", errors.New("exit status 1")
+	})
+
+	if err == nil || attempts != 3 {
+		t.Errorf("Expected 3 attempts in total, but got %d\n", attempts)
+	}
+}
+
+func TestResourceSetObjects(t *testing.T) {
+	rs := templater.RenderedResourceSet{
+		Name:      "some-api",
+		Namespace: "default-ns",
+		Resources: []templater.RenderedResource{
+			{
+				Filename: "deployment.yaml",
+				Rendered: "---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: api\n---\n# empty\n",
+			},
+			{
+				Filename: "service.yaml",
+				Rendered: "apiVersion: v1\nkind: Service\nmetadata:\n  name: api\n  namespace: other-ns\n",
+			},
+		},
+	}
+
+	objects, err := resourceSetObjects(&rs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if len(objects) != 2 {
+		t.Fatalf("Expected two objects, but got %v\n", objects)
+	}
+
+	if objects[0].resource() != "deployment.v1.apps/api" || objects[0].Namespace != "default-ns" {
+		t.Errorf("Unexpected first object: %v\n", objects[0])
+	}
+
+	if objects[1].resource() != "service/api" || objects[1].Namespace != "other-ns" {
+		t.Errorf("Unexpected second object: %v\n", objects[1])
+	}
+}
+
+func TestPriorState(t *testing.T) {
+	current := `{
+  "apiVersion": "v1",
+  "kind": "ConfigMap",
+  "metadata": {"name": "config", "uid": "1234", "resourceVersion": "42", "labels": {"app": "api"}},
+  "data": {"key": "value"},
+  "status": {}
+}`
+
+	prior, err := priorState([]byte(current))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := `{"apiVersion":"v1","data":{"key":"value"},"kind":"ConfigMap","metadata":{"labels":{"app":"api"},"name":"config"}}`
+	if prior != expected {
+		t.Errorf("Server fields were not removed from prior state: %s\n", prior)
+	}
+}
+
+func TestPostRender(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires sed")
+	}
+
+	rs := templater.RenderedResourceSet{
+		Name: "some-api",
+		Resources: []templater.RenderedResource{
+			{Filename: "a.yaml", Rendered: "kind: ConfigMap\n"},
+			{Filename: "b.yaml", Rendered: "---\nkind: Secret\n"},
+		},
+	}
+
+	if err := postRender(&rs, "sed", []string{"s/kind/type/"}); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []templater.RenderedResource{{
+		Filename: postRenderedFilename,
+		Rendered: "---\ntype: ConfigMap\n\n---\ntype: Secret\n\n",
+	}}
+
+	if !reflect.DeepEqual(expected, rs.Resources) {
+		t.Errorf("Unexpected post-rendered resources: %v\n", rs.Resources)
+	}
+
+	if err := postRender(&rs, "false", nil); err == nil {
+		t.Error("Expected failing post-render command to fail")
+	}
+
+	defer func(t time.Duration) { *timeout = t }(*timeout)
+	*timeout = 100 * time.Millisecond
+
+	if err := postRender(&rs, "sleep", []string{"5"}); err == nil || !strings.Contains(err.Error(), "did not finish within 100ms") {
+		t.Errorf("Expected slow post-render command to time out, but got %v\n", err)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	result := splitList([]string{"Deployment,Service", " ConfigMap ", ""})
+	expected := []string{"Deployment", "Service", "ConfigMap"}
+
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %v, but got %v\n", expected, result)
+	}
+}
+
+func TestPruneDisabledResourceSets(t *testing.T) {
+	disabled := false
+	resources := []templater.RenderedResourceSet{
+		{Name: "rbac", Args: []string{"--wait"}, Prune: &disabled},
+		{Name: "apps/api"},
+	}
+
+	if err := prepareResourcesForPruning(&resources, []string{"--prune-whitelist=core/v1/ConfigMap"}); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	for _, arg := range resources[0].Args {
+		if strings.HasPrefix(arg, "--prune") || strings.HasPrefix(arg, "--selector") {
+			t.Errorf("Expected resource set with pruning disabled not to be pruned, but got args %v\n", resources[0].Args)
+		}
+	}
+
+	expected := []string{
+		"--prune",
+		"--selector=app.kubernetes.io/managed-by=kontemplate,kontemplate.works/resource-set=apps.api",
+		"--prune-whitelist=core/v1/ConfigMap",
+	}
+	if !reflect.DeepEqual(expected, resources[1].Args) {
+		t.Errorf("Expected args %v, but got %v\n", expected, resources[1].Args)
+	}
+}
+
+func TestPruneArgsAreCopied(t *testing.T) {
+	// The arguments of resource sets of different contexts share
+	// their backing array with the cluster configuration.
+	shared := make([]string, 1, 4)
+	shared[0] = "--wait"
+	resources := []templater.RenderedResourceSet{{Name: "one", Args: shared}}
+
+	if err := prepareResourcesForPruning(&resources, nil); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if spare := shared[:cap(shared)]; spare[1] != "" {
+		t.Errorf("Expected shared arguments not to be modified, got %v\n", spare)
+	}
+}
+
+func TestConcurrentKubectlArgs(t *testing.T) {
+	defer func(kubectl string) { *kubectlBin = kubectl }(*kubectlBin)
+	*kubectlBin = "testdata/kubectl-echo-args.sh"
+
+	defer func(w io.Writer) { util.LogOutput = w }(util.LogOutput)
+	util.LogOutput = ioutil.Discard
+
+	// Spare capacity, as left by applyArgs, must not be shared by
+	// the contexts.
+	args := make([]string, 3, 8)
+	copy(args, []string{"apply", "-f", "-"})
+	rs := templater.RenderedResourceSet{
+		Name:      "some-set",
+		Resources: []templater.RenderedResource{{Filename: "a.yaml", Rendered: "kind: ConfigMap\n"}},
+	}
+
+	contexts := []string{"one", "two", "three", "four"}
+	outputs := make([]bytes.Buffer, len(contexts))
+	errs := make(chan error, len(contexts))
+
+	for i, name := range contexts {
+		go func(i int, name string) {
+			errs <- runKubectl(&context.Context{KubeContext: name}, &args, &rs, &outputs[i], ioutil.Discard)
+		}(i, name)
+	}
+
+	for range contexts {
+		if err := <-errs; err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+	}
+
+	for i, name := range contexts {
+		expected := fmt.Sprintf("apply -f - --context=%s\n", name)
+		if outputs[i].String() != expected {
+			t.Errorf("Expected kubectl to be called with %q, got %q\n", expected, outputs[i].String())
+		}
+	}
+}
+
+func TestNamespaceKubectlArgs(t *testing.T) {
+	kubectl, _ := filepath.Abs("testdata/kubectl-echo-args.sh")
+	cmd := kontemplateCommand("apply", "testdata/namespaces/cluster.yaml", "-n", "global-ns", "--kubectl", kubectl)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n%s", err, stderr.String())
+	}
+
+	expected := "apply -f - --context=k8s.test.mydomain.com --namespace=global-ns\n" +
+		"apply -f - --context=k8s.test.mydomain.com --namespace=per-set-ns\n" +
+		"apply -f - --context=k8s.test.mydomain.com --as=some-user --namespace=global-ns\n"
+	if string(output) != expected {
+		t.Errorf("Expected kubectl to be called with:\n%s\nbut got:\n%s", expected, output)
+	}
+
+	// Only the resource set that uses 'args' is warned about:
+	if strings.Count(stderr.String(), "deprecated 'args' field") != 1 || !strings.Contains(stderr.String(), "'aliased' uses the deprecated") {
+		t.Errorf("Expected a single deprecation warning for 'aliased', but got:\n%s", stderr.String())
+	}
+}
+
+func TestPruneWhitelistArgs(t *testing.T) {
+	args, err := pruneWhitelistArgs(true, []string{"core/v1/ConfigMap", "apps/v1/Deployment"})
+	if err != nil {
+		t.Fatalf("Expected valid whitelist, but got error: %v\n", err)
+	}
+
+	expected := []string{"--prune-whitelist=core/v1/ConfigMap", "--prune-whitelist=apps/v1/Deployment"}
+	if !reflect.DeepEqual(expected, args) {
+		t.Errorf("Expected args %v, but got %v\n", expected, args)
+	}
+
+	for _, invalid := range []string{"ConfigMap", "v1/ConfigMap", "core//ConfigMap", "a/b/c/d"} {
+		if _, err := pruneWhitelistArgs(true, []string{invalid}); err == nil {
+			t.Errorf("Expected whitelist entry '%s' to be rejected\n", invalid)
+		}
+	}
+
+	if _, err := pruneWhitelistArgs(false, []string{"core/v1/ConfigMap"}); err == nil {
+		t.Errorf("Expected --prune-whitelist without --prune to be rejected\n")
+	}
+}
+
+func TestSensitiveResourceSetsAreNotPrinted(t *testing.T) {
+	var diagnostics, output bytes.Buffer
+	defer func(w io.Writer) { util.LogOutput = w }(util.LogOutput)
+	util.LogOutput = &diagnostics
+
+	rs := templater.RenderedResourceSet{
+		Name:      "secrets",
+		Sensitive: true,
+		Resources: []templater.RenderedResource{
+			{Filename: "secret.yaml", Rendered: "kind: Secret\nstringData:\n  password: hunter2\n"},
+		},
+	}
+
+	printRenderedFiles(&output, rs)
+
+	if strings.Contains(diagnostics.String(), "hunter2") || strings.Contains(output.String(), "hunter2") {
+		t.Errorf("Expected sensitive content to be hidden, but got diagnostics %q and output %q\n", diagnostics.String(), output.String())
+	}
+
+	if !strings.Contains(diagnostics.String(), "secrets/secret.yaml") {
+		t.Errorf("Expected hidden file to be listed, but got %q\n", diagnostics.String())
+	}
+
+	rs.Sensitive = false
+	printRenderedFiles(&output, rs)
+
+	if !strings.Contains(output.String(), "hunter2") {
+		t.Errorf("Expected content of resource sets that are not sensitive to be printed\n")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	file, err := ioutil.TempFile("", "kontemplate-summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+
+	defer func(output string) { *summaryOutput = output }(*summaryOutput)
+	*summaryOutput = file.Name()
+
+	resources := []templater.RenderedResourceSet{
+		{Name: "one", Namespace: "ns", Resources: []templater.RenderedResource{{}, {}}},
+		{Name: "two"},
+		{Name: "three"},
+		{Name: "secrets", Sensitive: true},
+	}
+
+	startSummary("apply", &context.Context{Name: "k8s.test"}, &resources)
+	recordResourceSet("one", time.Now(), nil)
+	recordResourceSet("two", time.Now(), errors.New("kubectl failed"))
+	recordResourceSet("secrets", time.Now(), errors.New("invalid value: hunter2"))
+	writeSummary(false)
+
+	data, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var summary Summary
+	if err = json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("Could not parse summary: %v\n", err)
+	}
+
+	if summary.Version != summaryVersion || summary.Command != "apply" || summary.Context != "k8s.test" || summary.Success {
+		t.Errorf("Unexpected summary: %+v\n", summary)
+	}
+
+	expected := []ResourceSetSummary{
+		{Name: "one", Namespace: "ns", Files: 2, Tool: "kubectl", Status: statusSucceeded},
+		{Name: "two", Tool: "kubectl", Status: statusFailed, Error: "kubectl failed"},
+		{Name: "three", Tool: "kubectl", Status: statusSkipped},
+		{Name: "secrets", Tool: "kubectl", Status: statusFailed, Error: "error details are hidden as the resource set is sensitive"},
+	}
+
+	for i := range summary.ResourceSets {
+		summary.ResourceSets[i].DurationSeconds = 0
+	}
+
+	if !reflect.DeepEqual(expected, summary.ResourceSets) {
+		t.Errorf("Unexpected resource set summaries: %+v\n", summary.ResourceSets)
+	}
+}
+
+func TestPrunedObjects(t *testing.T) {
+	output := `configmap/settings configured (server dry run)
+deployment.apps/api unchanged (server dry run)
+configmap/old-settings pruned (server dry run)
+secret/legacy deleted (dry run)
+`
+
+	expected := []string{"configmap/old-settings", "secret/legacy"}
+	if result := prunedObjects(output); !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected pruned objects %v, but got %v\n", expected, result)
+	}
+}
+
+func TestPrintPrunePreview(t *testing.T) {
+	var output bytes.Buffer
+	printPrunePreview(&output, []prunePreview{
+		{"some-api", []string{"configmap/old-settings"}},
+		{"other-api", nil},
+	})
+
+	expected := "Pruning would delete 1 object(s):\n\nsome-api:\n  configmap/old-settings\n"
+	if output.String() != expected {
+		t.Errorf("Unexpected prune preview:\n%s\n", output.String())
+	}
+
+	output.Reset()
+	printPrunePreview(&output, []prunePreview{{"other-api", nil}})
+
+	if output.String() != "Pruning would not delete any objects.\n" {
+		t.Errorf("Unexpected empty prune preview:\n%s\n", output.String())
+	}
+}
+
+func TestPrintFileList(t *testing.T) {
+	var output bytes.Buffer
+	defer func(w io.Writer) { util.LogOutput = w }(util.LogOutput)
+	util.LogOutput = ioutil.Discard
+
+	printFileList(&output, []templater.ResourceSetFiles{
+		{Name: "some-api", Path: "some-api", Enabled: true, Files: []string{"deployment.yaml", "service.yaml"}},
+		{Name: "ingress", Path: "overlays/ingress", Type: "kustomize", Enabled: true, Files: []string{"kustomization.yaml"}},
+		{Name: "debug-tools", Path: "debug-tools"},
+		{Name: "empty", Path: "empty", Enabled: true},
+	})
+
+	expected := `some-api (some-api): 2 file(s)
+  deployment.yaml
+  service.yaml
+ingress (overlays/ingress): 1 file(s)
+  kustomization.yaml (built with kubectl kustomize)
+debug-tools (debug-tools): disabled
+empty (empty): no files
+`
+
+	if output.String() != expected {
+		t.Errorf("Unexpected file list:\n%s\n", output.String())
+	}
+}
+
+func TestClusterContexts(t *testing.T) {
+	ctx := context.Context{Name: "regional", Contexts: []string{"eu-west", "us-east"}}
+
+	clusters := clusterContexts(&ctx)
+	if len(clusters) != 2 || clusters[0].KubeContext != "eu-west" || clusters[1].KubeContext != "us-east" {
+		t.Fatalf("Unexpected contexts: %v\n", clusters)
+	}
+
+	if ctx.KubeContext != "" {
+		t.Errorf("Expected original context not to be modified\n")
+	}
+
+	single := context.Context{Name: "single"}
+	if clusters = clusterContexts(&single); len(clusters) != 1 || clusters[0] != &single {
+		t.Errorf("Expected context without 'contexts' to target a single context\n")
+	}
+}
+
+func TestRunClusters(t *testing.T) {
+	defer func(w io.Writer) { util.LogOutput = w }(util.LogOutput)
+	util.LogOutput = ioutil.Discard
+
+	var clusters []*context.Context
+	for _, name := range []string{"one", "two", "three"} {
+		clusters = append(clusters, &context.Context{KubeContext: name})
+	}
+
+	var ran []string
+	run := func(c *context.Context) error {
+		ran = append(ran, c.KubeContext)
+		if c.KubeContext == "two" {
+			return errors.New("kubectl failed")
+		}
+		return nil
+	}
+
+	failures, _ := runClusters(clusters, 1, false, run)
+	if !reflect.DeepEqual([]string{"two"}, failures) || !reflect.DeepEqual([]string{"one", "two"}, ran) {
+		t.Errorf("Expected remaining contexts to be skipped after a failure, but ran %v and got failures %v\n", ran, failures)
+	}
+
+	ran = nil
+	failures, code := runClusters(clusters, 1, true, run)
+	if code != exitTemplate {
+		t.Errorf("Expected failures without an exit code to exit with %d, but got %d\n", exitTemplate, code)
+	}
+
+	if !reflect.DeepEqual([]string{"two"}, failures) || !reflect.DeepEqual([]string{"one", "two", "three"}, ran) {
+		t.Errorf("Expected all contexts to run with keepGoing, but ran %v and got failures %v\n", ran, failures)
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var output bytes.Buffer
+	w := &prefixWriter{w: &output, prefix: "[eu-west] ", lineStart: true}
+
+	io.WriteString(w, "configmap/a configured\nconfigmap/")
+	io.WriteString(w, "b created\n")
+
+	expected := "[eu-west] configmap/a configured\n[eu-west] configmap/b created\n"
+	if output.String() != expected {
+		t.Errorf("Unexpected prefixed output:\n%s\n", output.String())
+	}
+}
+
+// Runs kontemplate itself if the test binary is invoked by
+// runKontemplate, so that exit codes can be tested end-to-end.
+func TestMain(m *testing.M) {
+	if os.Getenv("KONTEMPLATE_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func kontemplateCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "KONTEMPLATE_TEST_MAIN=1")
+	return cmd
+}
+
+func runKontemplate(t *testing.T, args ...string) int {
+	err := kontemplateCommand(args...).Run()
+	if err == nil {
+		return 0
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("Could not run kontemplate: %v\n", err)
+	}
+
+	return exitErr.ExitCode()
+}
+
+func TestExitCodes(t *testing.T) {
+	cluster := "testdata/exitcodes/cluster.yaml"
+	cases := []struct {
+		name     string
+		args     []string
+		expected int
+	}{
+		{"success", []string{"template", cluster, "-i", "valid"}, 0},
+		{"usage error", []string{"template", cluster, "--no-such-flag"}, exitUsage},
+		{"missing confirmation", []string{"apply", cluster, "--prune"}, exitUsage},
+		{"missing configuration", []string{"template", "testdata/exitcodes/missing.yaml"}, exitTemplate},
+		{"template error", []string{"template", cluster, "-i", "broken"}, exitTemplate},
+		{"kubectl error", []string{"apply", cluster, "-i", "valid", "--kubectl", "false"}, exitKubectl},
+		{"validation failure", []string{"validate", cluster, "-i", "valid", "--kubectl", "false"}, exitValidation},
+		{"lint failure", []string{"lint", cluster}, exitValidation},
+		{"differences", []string{"diff", cluster, "-i", "valid", "--kubectl", "testdata/exitcodes/kubectl-differences.sh"}, exitDifferences},
+	}
+
+	for _, c := range cases {
+		if code := runKontemplate(t, c.args...); code != c.expected {
+			t.Errorf("Expected %s to exit with %d, but got %d\n", c.name, c.expected, code)
+		}
+	}
+}
+
+func TestDumpRenderedWithFailingKubectl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontemplate-dump")
+	if err != nil {
+		t.Fatalf("Could not create dump directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	code := runKontemplate(t, "apply", "testdata/exitcodes/cluster.yaml", "-i", "valid", "--kubectl", "false", "--dump-rendered", dir)
+	if code != exitKubectl {
+		t.Errorf("Expected apply to fail with %d, but got %d\n", exitKubectl, code)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "valid-configmap.yaml")); err != nil {
+		t.Errorf("Expected rendered resources to be dumped before kubectl failed: %v\n", err)
+	}
+}
+
+func TestTemplateIntoDirectoryCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontemplate-output")
+	if err != nil {
+		t.Fatalf("Could not create output directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rs := templater.RenderedResourceSet{
+		Name: "api",
+		Resources: []templater.RenderedResource{
+			{Filename: "rbac/role.yaml", Rendered: "kind: Role\n"},
+			{Filename: "rbac-role.yaml", Rendered: "kind: ClusterRole\n"},
+		},
+	}
+
+	err = templateIntoDirectory(&dir, rs)
+	if err == nil || !strings.Contains(err.Error(), "'rbac/role.yaml' and 'rbac-role.yaml'") {
+		t.Errorf("Expected colliding file names to be rejected, but got %v\n", err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected no files to be written, but found %d\n", len(files))
+	}
+
+	defer func(layout string) { *templateLayout = layout }(*templateLayout)
+	*templateLayout = "tree"
+
+	if err := templateIntoDirectory(&dir, rs); err != nil {
+		t.Errorf("Unexpected error with the tree layout: %v\n", err)
+	}
+}
+
+func TestTemplatedOutputFiles(t *testing.T) {
+	resourceSets := []templater.RenderedResourceSet{{
+		Name: "monitoring/grafana",
+		Resources: []templater.RenderedResource{{
+			Filename: "grafana.yaml",
+			Rendered: "kind: Deployment\nmetadata:\n  name: grafana\n---\nkind: Service\nmetadata:\n  name: grafana\n",
+		}, {
+			Filename: "notes.yaml",
+			Rendered: "# no object\n",
+		}},
+	}}
+
+	tmpl, err := parseFilenameTemplate("{{ .SetName }}/{{ .Kind }}-{{ .Name }}.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	names, files, err := templatedOutputFiles(tmpl, resourceSets)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []string{"monitoring/grafana/Deployment-grafana.yaml", "monitoring/grafana/Service-grafana.yaml", "monitoring/grafana/-.yaml"}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf("Unexpected file names: %v\n", names)
+	}
+
+	if !reflect.DeepEqual([]string{"kind: Service\nmetadata:\n  name: grafana"}, files[names[1]]) {
+		t.Errorf("Expected documents to be split into separate files, got %v\n", files[names[1]])
+	}
+
+	// Templates that do not use the kind or name keep documents of
+	// the same file together.
+	tmpl, _ = parseFilenameTemplate("{{ .SetName }}/{{ .Filename }}")
+	names, files, _ = templatedOutputFiles(tmpl, resourceSets)
+	if len(names) != 2 || len(files["monitoring/grafana/grafana.yaml"]) != 2 {
+		t.Errorf("Expected documents of the same file to be grouped, got %v\n", files)
+	}
+}
+
+func TestTemplatedOutputFilesOutsideOutputDir(t *testing.T) {
+	resourceSets := []templater.RenderedResourceSet{{
+		Name:      "api",
+		Resources: []templater.RenderedResource{{Filename: "api.yaml", Rendered: "kind: Service\n"}},
+	}}
+
+	for _, text := range []string{"../{{ .Filename }}", "/tmp/{{ .Filename }}", "{{ .Name }}"} {
+		tmpl, _ := parseFilenameTemplate(text)
+		if _, _, err := templatedOutputFiles(tmpl, resourceSets); err == nil {
+			t.Errorf("Expected file name template '%s' to be rejected\n", text)
+		}
+	}
+
+	if _, err := parseFilenameTemplate("{{ .SetName"); err == nil {
+		t.Errorf("Expected invalid file name template to fail\n")
+	}
+}
+
+func TestBaseDirFromUnrelatedDirectory(t *testing.T) {
+	testdata, _ := filepath.Abs("testdata/exitcodes")
+	binary, _ := filepath.Abs(os.Args[0])
+
+	cwd, err := ioutil.TempDir("", "kontemplate-cwd")
+	if err != nil {
+		t.Fatalf("Could not create working directory: %v\n", err)
+	}
+	defer os.RemoveAll(cwd)
+
+	configDir, err := ioutil.TempDir("", "kontemplate-config")
+	if err != nil {
+		t.Fatalf("Could not create configuration directory: %v\n", err)
+	}
+	defer os.RemoveAll(configDir)
+
+	config := filepath.Join(configDir, "cluster.yaml")
+	ioutil.WriteFile(config, []byte("context: test\ninclude:\n  - name: valid\n"), 0644)
+
+	run := func(args ...string) (string, error) {
+		cmd := kontemplateCommand(args...)
+		cmd.Path = binary
+		cmd.Dir = cwd
+		output, err := cmd.Output()
+		return string(output), err
+	}
+
+	// Paths are resolved relative to the configuration file, not to
+	// the working directory.
+	if output, err := run("template", filepath.Join(testdata, "cluster.yaml"), "-i", "valid"); err != nil || !strings.Contains(output, "name: valid") {
+		t.Errorf("Expected resource sets to be resolved relative to the configuration, got %v: %s\n", err, output)
+	}
+
+	if _, err := run("template", config); err == nil {
+		t.Errorf("Expected resource set missing next to the configuration to fail\n")
+	}
+
+	// Relative base directories are resolved against the working
+	// directory, like other paths on the command line.
+	relative, _ := filepath.Rel(cwd, testdata)
+	for _, dir := range []string{testdata, relative} {
+		if output, err := run("-C", dir, "template", config); err != nil || !strings.Contains(output, "name: valid") {
+			t.Errorf("Expected resource sets to be resolved relative to -C %s, got %v: %s\n", dir, err, output)
+		}
+	}
+}
+
+func TestIncrementalApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontemplate-state")
+	if err != nil {
+		t.Fatalf("Could not create state directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(w io.Writer) { util.LogOutput = w }(util.LogOutput)
+	util.LogOutput = ioutil.Discard
+
+	ctx := context.Context{Name: "test", BaseDir: dir}
+	render := func(content string) *[]templater.RenderedResourceSet {
+		return &[]templater.RenderedResourceSet{
+			{Name: "one", Resources: []templater.RenderedResource{{Filename: "a.yaml", Rendered: "kind: ConfigMap\n"}}},
+			{Name: "two", Resources: []templater.RenderedResource{{Filename: "b.yaml", Rendered: content}}},
+		}
+	}
+	names := func(resources *[]templater.RenderedResourceSet) []string {
+		var names []string
+		for _, rs := range *resources {
+			names = append(names, rs.Name)
+		}
+		return names
+	}
+
+	// Without a state file, all resource sets are applied.
+	resources := render("kind: Secret\n")
+	hashes := skipUnchangedResourceSets(&ctx, resources, nil)
+	if len(*resources) != 2 {
+		t.Fatalf("Expected all resource sets to be applied on the first run, got %v\n", names(resources))
+	}
+
+	if err := recordAppliedResourceSets(&ctx, hashes); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	resources = render("kind: Secret\n")
+	skipUnchangedResourceSets(&ctx, resources, nil)
+	if len(*resources) != 0 {
+		t.Errorf("Expected unchanged resource sets to be skipped, got %v\n", names(resources))
+	}
+
+	resources = render("kind: Service\n")
+	skipUnchangedResourceSets(&ctx, resources, nil)
+	if !reflect.DeepEqual([]string{"two"}, names(resources)) {
+		t.Errorf("Expected only the changed resource set to be applied, got %v\n", names(resources))
+	}
+
+	resources = render("kind: Secret\n")
+	skipUnchangedResourceSets(&ctx, resources, []string{"--server-side"})
+	if len(*resources) != 2 {
+		t.Errorf("Expected resource sets to be applied with different kubectl arguments, got %v\n", names(resources))
+	}
+
+	// Hashes are recorded per kubectl context.
+	other := context.Context{Name: "other", BaseDir: dir}
+	resources = render("kind: Secret\n")
+	skipUnchangedResourceSets(&other, resources, nil)
+	if len(*resources) != 2 {
+		t.Errorf("Expected resource sets to be applied to another context, got %v\n", names(resources))
+	}
+
+	*applyForce = true
+	defer func() { *applyForce = false }()
+	resources = render("kind: Secret\n")
+	skipUnchangedResourceSets(&ctx, resources, nil)
+	if len(*resources) != 2 {
+		t.Errorf("Expected --force to apply unchanged resource sets, got %v\n", names(resources))
+	}
+}
+
+func TestIncrementalApplyWithInvalidState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontemplate-state")
+	if err != nil {
+		t.Fatalf("Could not create state directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(w io.Writer) { util.LogOutput = w }(util.LogOutput)
+	util.LogOutput = ioutil.Discard
+
+	ioutil.WriteFile(filepath.Join(dir, defaultStateFile), []byte("{not json"), 0644)
+
+	ctx := context.Context{Name: "test", BaseDir: dir}
+	resources := []templater.RenderedResourceSet{{Name: "one"}}
+	hashes := skipUnchangedResourceSets(&ctx, &resources, nil)
+	if len(resources) != 1 {
+		t.Fatalf("Expected resource sets to be applied with an invalid state file\n")
+	}
+
+	if err := recordAppliedResourceSets(&ctx, hashes); err != nil {
+		t.Fatalf("Expected invalid state file to be replaced, got %v\n", err)
+	}
+
+	if _, err := loadApplyState(filepath.Join(dir, defaultStateFile)); err != nil {
+		t.Errorf("Expected valid state file after recording, got %v\n", err)
+	}
+}
+
+func TestAuditAnnotations(t *testing.T) {
+	defer func(hash string) { gitHash = hash }(gitHash)
+	gitHash = "abc123"
+
+	annotations := auditAnnotations(time.Date(2019, 6, 1, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60)))
+
+	if annotations[appliedAtAnnotation] != "2019-06-01T12:00:00Z" {
+		t.Errorf("Unexpected time annotation: %v\n", annotations)
+	}
+
+	if annotations[gitCommitAnnotation] != "abc123" {
+		t.Errorf("Unexpected commit annotation: %v\n", annotations)
+	}
+
+	gitHash = ""
+	if _, ok := auditAnnotations(time.Now())[gitCommitAnnotation]; ok {
+		t.Error("Expected commit annotation to be omitted without a git hash")
+	}
+}
+
+func TestReadSetList(t *testing.T) {
+	names, err := readSetList("testdata/set-lists/changed.txt")
+	expected := []string{"some-api", "monitoring/*", "unknown-set"}
+	if err != nil || !reflect.DeepEqual(expected, names) {
+		t.Errorf("Unexpected resource set list %v (%v)\n", names, err)
+	}
+
+	if _, err := readSetList("testdata/set-lists/missing.txt"); err == nil {
+		t.Error("Expected reading a missing list to fail")
+	}
+}
+
+func TestLoadSetLists(t *testing.T) {
+	defer func(i, e, fi, fe []string) {
+		*includes, *excludes, *includeFrom, *excludeFrom = i, e, fi, fe
+		listedSets = nil
+	}(*includes, *excludes, *includeFrom, *excludeFrom)
+
+	*includes = []string{"other-api"}
+	*excludes = nil
+	*includeFrom = []string{"testdata/set-lists/changed.txt"}
+	*excludeFrom = nil
+
+	if err := loadSetLists(); err != nil {
+		t.Fatalf("Could not load resource set lists: %v\n", err)
+	}
+
+	expected := []string{"other-api", "some-api", "monitoring/*", "unknown-set"}
+	if !reflect.DeepEqual(expected, *includes) {
+		t.Errorf("Unexpected includes %v\n", *includes)
+	}
+
+	*includes = nil
+	*includeFrom = []string{"testdata/set-lists/empty.txt"}
+	if err := loadSetLists(); err == nil {
+		t.Error("Expected an empty include list to fail instead of including everything")
+	}
+}
+
+func TestPlanAction(t *testing.T) {
+	document := "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: api\n  creationTimestamp: null\nspec:\n  replicas: 2\n  template:\n    spec:\n      containers:\n      - name: api\n        image: api:v1\n        resources:\n          limits:\n            cpu: 1\n        args: []\n"
+	applied := `{\"apiVersion\":\"apps/v1\",\"kind\":\"Deployment\",\"metadata\":{\"name\":\"api\",\"namespace\":\"prod\",\"labels\":{\"app.kubernetes.io/managed-by\":\"kontemplate\",\"kontemplate.works/resource-set\":\"api\"},\"creationTimestamp\":null},\"spec\":{\"replicas\":2,\"template\":{\"spec\":{\"containers\":[{\"name\":\"api\",\"image\":\"api:v1\",\"resources\":{\"limits\":{\"cpu\":1}},\"args\":[]}]}}}}`
+	live := func(replicas int, lastApplied string) []byte {
+		return []byte(fmt.Sprintf(`{"apiVersion": "apps/v1", "kind": "Deployment",
+  "metadata": {"name": "api", "namespace": "prod", "uid": "1234", "creationTimestamp": "2019-06-01T12:00:00Z",
+    "labels": {"app.kubernetes.io/managed-by": "kontemplate", "kontemplate.works/resource-set": "api"},
+    "annotations": {"kubectl.kubernetes.io/last-applied-configuration": "%s"}},
+  "spec": {"replicas": %d, "progressDeadlineSeconds": 600, "template": {"spec": {"containers": [
+    {"name": "api", "image": "api:v1", "imagePullPolicy": "IfNotPresent", "resources": {"limits": {"cpu": "1"}}}]}}},
+  "status": {"readyReplicas": 2}}`, lastApplied, replicas))
+	}
+
+	cases := []struct {
+		name     string
+		document string
+		live     []byte
+		found    bool
+		expected string
+	}{
+		{"missing object", document, nil, false, planCreate},
+		{"unchanged object with server defaults", document, live(2, applied), true, planUnchanged},
+		{"changed field", document, live(3, applied), true, planUpdate},
+		{"added field", strings.Replace(document, "  replicas: 2\n", "  replicas: 2\n  paused: true\n", 1), live(2, applied), true, planUpdate},
+		{"removed field", strings.Replace(document, "        args: []\n", "", 1), live(2, strings.Replace(applied, `,\"args\":[]`, `,\"args\":[\"--debug\"]`, 1)), true, planUpdate},
+	}
+
+	for _, c := range cases {
+		action, err := planAction(c.document, c.live, c.found)
+		if err != nil || action != c.expected {
+			t.Errorf("Expected %s for %s, got %s (%v)\n", c.expected, c.name, action, err)
+		}
+	}
+}
+
+func TestPlanSecretWithStringData(t *testing.T) {
+	document := "apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\ndata:\n  user: YWRtaW4=\nstringData:\n  password: hunter2\n"
+	live := func(password string) []byte {
+		return []byte(fmt.Sprintf(`{"apiVersion": "v1", "kind": "Secret", "type": "Opaque",
+  "metadata": {"name": "db", "namespace": "prod", "uid": "1234"},
+  "data": {"user": "YWRtaW4=", "password": "%s"}}`, password))
+	}
+
+	// "hunter2" and "hunter3"
+	if action, err := planAction(document, live("aHVudGVyMg=="), true); err != nil || action != planUnchanged {
+		t.Errorf("Expected Secret with unchanged stringData to be unchanged, got %s (%v)\n", action, err)
+	}
+
+	if action, err := planAction(document, live("aHVudGVyMw=="), true); err != nil || action != planUpdate {
+		t.Errorf("Expected Secret with changed stringData to be updated, got %s (%v)\n", action, err)
+	}
+}
+
+func TestPrintPlan(t *testing.T) {
+	plans := []resourceSetPlan{
+		{"some-api", []plannedObject{
+			{"deployment.v1.apps/api", "prod", planUpdate},
+			{"service/api", "prod", planUnchanged},
+			{"configmap/api", "prod", planCreate},
+		}},
+		{"rbac", []plannedObject{{"clusterrole.v1.rbac.authorization.k8s.io/reader", "", planUnchanged}}},
+	}
+
+	var b strings.Builder
+	if !printPlan(&b, plans) {
+		t.Error("Expected plan to report changes")
+	}
+
+	expected := "some-api:\n  ~ deployment.v1.apps/api (namespace prod)\n  + configmap/api (namespace prod)\n\nPlan: + 1 to create, ~ 1 to change, 2 unchanged\n"
+	if b.String() != expected {
+		t.Errorf("Unexpected plan output:\n%s", b.String())
+	}
+
+	b.Reset()
+	if printPlan(&b, plans[1:]) || b.String() != "Plan: + 0 to create, ~ 0 to change, 1 unchanged\n" {
+		t.Errorf("Unexpected plan output without changes:\n%s", b.String())
+	}
+}
+
+func TestKubectlExitingEarly(t *testing.T) {
+	defer func(kubectl string) { *kubectlBin = kubectl }(*kubectlBin)
+	*kubectlBin = "testdata/kubectl-early-exit.sh"
+
+	// The files are larger than the pipe buffer, so that writing
+	// blocks until kubectl has exited.
+	large := strings.Repeat("# padding\n", 100000)
+	rs := templater.RenderedResourceSet{
+		Name: "large-set",
+		Resources: []templater.RenderedResource{
+			{Filename: "first.yaml", Rendered: large},
+			{Filename: "second.yaml", Rendered: large},
+		},
+	}
+
+	var stderr bytes.Buffer
+	args := []string{"apply", "-f", "-"}
+	err := runKubectl(&context.Context{}, &args, &rs, ioutil.Discard, &stderr)
+
+	if err == nil || !strings.Contains(err.Error(), "kubectl stopped reading before all files of resource set 'large-set' were passed to it") {
+		t.Fatalf("Expected early exit of kubectl to be reported, got %v\n", err)
+	}
+
+	if !strings.Contains(err.Error(), "exit status 1") {
+		t.Errorf("Expected exit status of kubectl to be included, got %v\n", err)
+	}
+
+	if !strings.Contains(stderr.String(), "the server is unavailable") {
+		t.Errorf("Expected kubectl error output to be passed on, got %q\n", stderr.String())
+	}
+}
+
+func TestCompletionScripts(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		var b strings.Builder
+		printCompletionScript(&b, shell)
+
+		if !strings.Contains(b.String(), "kontemplate --completion-bash") && !strings.Contains(b.String(), `"${COMP_WORDS[0]}" --completion-bash`) {
+			t.Errorf("Completion script for %s does not call kontemplate:\n%s", shell, b.String())
+		}
+	}
+}
+
+func TestExpandShortFlags(t *testing.T) {
+	args := []string{"--completion-bash", "apply", "cluster.yaml", "-i", "some-api", "-e"}
+	expected := []string{"--completion-bash", "apply", "cluster.yaml", "--include", "some-api", "--exclude"}
+
+	if result := expandShortFlags(args); !reflect.DeepEqual(expected, result) {
+		t.Errorf("Unexpected expanded flags %v\n", result)
+	}
+
+	args = []string{"apply", "cluster.yaml", "-i", "some-api"}
+	if result := expandShortFlags(args); !reflect.DeepEqual(args, result) {
+		t.Errorf("Expected flags not to be expanded outside of completion, got %v\n", result)
+	}
+}
+
+func TestResourceSetCompletion(t *testing.T) {
+	cmd := kontemplateCommand("--completion-bash", "apply", "testdata/exitcodes/cluster.yaml", "-i")
+
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Completion failed: %v\n", err)
+	}
+
+	if string(output) != "broken\nvalid" {
+		t.Errorf("Unexpected resource set completions %q\n", output)
+	}
+}
+
+func TestArgoApplication(t *testing.T) {
+	settings := argoSettings{
+		repoURL:       "https://git.example.com/deploy.git",
+		repoPath:      "rendered",
+		revision:      "main",
+		project:       "default",
+		namespace:     "argocd",
+		destServer:    "https://kubernetes.default.svc",
+		destNamespace: "apps",
+	}
+	rs := templater.RenderedResourceSet{Name: "Backend/API"}
+
+	name, app, err := argoApplicationFor(&settings, &rs, "prod", "rendered/prod/Backend/API")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if name != "prod-backend-api" {
+		t.Errorf("Expected Application name 'prod-backend-api', got '%s'\n", name)
+	}
+
+	expected := `---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: prod-backend-api
+  namespace: argocd
+spec:
+  destination:
+    namespace: apps
+    server: https://kubernetes.default.svc
+  project: default
+  source:
+    path: rendered/prod/Backend/API
+    repoURL: https://git.example.com/deploy.git
+    targetRevision: main
+`
+	if app != expected {
+		t.Errorf("Unexpected Application:\n%s\n", app)
+	}
+
+	// The namespace of the resource set takes precedence.
+	rs.Namespace = "backend"
+	if _, app, _ = argoApplicationFor(&settings, &rs, "", "rendered/Backend/API"); !strings.Contains(app, "namespace: backend\n") {
+		t.Errorf("Expected the namespace of the resource set as destination, got:\n%s\n", app)
+	}
+}
+
+func TestWriteArgoApplications(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontemplate-argocd")
+	if err != nil {
+		t.Fatalf("Could not create output directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(w io.Writer) { util.LogOutput = w }(util.LogOutput)
+	util.LogOutput = ioutil.Discard
+
+	settings := argoSettings{repoURL: "https://git.example.com/deploy.git", repoPath: "rendered"}
+	sets := []templater.RenderedResourceSet{
+		{Name: "some-api", Resources: []templater.RenderedResource{{Filename: "deployment.yaml", Rendered: "kind: Deployment\n"}}},
+	}
+
+	if err := writeArgoApplications(&settings, dir, "", sets); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "some-api", "deployment.yaml")); err != nil {
+		t.Errorf("Expected rendered file to be written: %v\n", err)
+	}
+
+	app, err := ioutil.ReadFile(filepath.Join(dir, argoApplicationsDir, "some-api.yaml"))
+	if err != nil || !strings.Contains(string(app), "path: rendered/some-api\n") {
+		t.Errorf("Expected Application pointing at the resource set, got %v: %s\n", err, app)
+	}
+
+	sets[0].Name = argoApplicationsDir
+	if err := writeArgoApplications(&settings, dir, "", sets); err == nil {
+		t.Errorf("Expected resource set named '%s' to be rejected\n", argoApplicationsDir)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of running commands against
+// all kubectl contexts listed in the 'contexts' field of a cluster
+// configuration. Resources are rendered separately for every context,
+// and the output of kubectl is prefixed with the name of the context.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Set when a command runs against multiple contexts, in which case the
+// output of kubectl is attributed to the context it came from.
+var multiCluster = false
+
+// Returns a copy of the cluster configuration for every context it
+// targets. Configurations without 'contexts', or runs with an explicit
+// --kube-context, target a single context.
+func clusterContexts(c *context.Context) []*context.Context {
+	if len(c.Contexts) == 0 || *kubeContext != "" {
+		return []*context.Context{c}
+	}
+
+	clusters := make([]*context.Context, 0, len(c.Contexts))
+	for _, name := range c.Contexts {
+		cluster := *c
+		cluster.KubeContext = name
+		clusters = append(clusters, &cluster)
+	}
+
+	return clusters
+}
+
+// Runs a function for every context targeted by a cluster configuration.
+// Failures are reported once all started contexts have finished.
+func forEachCluster(c *context.Context, parallel int, keepGoing bool, run func(*context.Context) error) {
+	clusters := clusterContexts(c)
+
+	if len(clusters) == 1 {
+		if err := run(clusters[0]); err != nil {
+			fail(exitCode(err), "%v\n", err)
+		}
+		return
+	}
+
+	multiCluster = true
+	failures, code := runClusters(clusters, parallel, keepGoing, run)
+
+	if len(failures) > 0 {
+		fail(code, "%d of %d contexts failed: %s\n", len(failures), len(clusters), strings.Join(failures, ", "))
+	}
+}
+
+// Runs a function for multiple contexts with at most 'parallel' of them
+// running concurrently, and returns the names of the contexts for which
+// it failed along with the highest exit code of the failures. Unless
+// 'keepGoing' is set, no further contexts are started after a failure.
+func runClusters(clusters []*context.Context, parallel int, keepGoing bool, run func(*context.Context) error) ([]string, int) {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures []string
+		code     int
+		slots    = make(chan struct{}, parallel)
+	)
+
+	for _, cluster := range clusters {
+		slots <- struct{}{}
+
+		mu.Lock()
+		stop := len(failures) > 0 && !keepGoing
+		mu.Unlock()
+
+		if stop {
+			util.Warnf("Skipping context '%s' after an earlier failure (pass --keep-going to continue)", cluster.KubeContext)
+			<-slots
+			continue
+		}
+
+		wg.Add(1)
+		go func(cluster *context.Context) {
+			defer func() { <-slots; wg.Done() }()
+
+			util.Infof("Running against context '%s'", cluster.KubeContext)
+			if err := run(cluster); err != nil {
+				util.Warnf("Context '%s' failed: %v", cluster.KubeContext, err)
+
+				mu.Lock()
+				failures = append(failures, cluster.KubeContext)
+				if c := exitCode(err); c > code {
+					code = c
+				}
+				mu.Unlock()
+			}
+		}(cluster)
+	}
+
+	wg.Wait()
+	return failures, code
+}
+
+// Returns a writer for the output of commands run against a context,
+// which prefixes every line with the name of the context when running
+// against multiple contexts.
+func clusterWriter(c *context.Context, w io.Writer) io.Writer {
+	if !multiCluster {
+		return w
+	}
+
+	return &prefixWriter{w: w, prefix: fmt.Sprintf("[%s] ", kubectlContext(c)), lineStart: true}
+}
+
+// Serialises writes of all prefix writers, so that lines of different
+// contexts are not mixed up.
+var prefixWriterLock sync.Mutex
+
+type prefixWriter struct {
+	w         io.Writer
+	prefix    string
+	lineStart bool
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	prefixWriterLock.Lock()
+	defer prefixWriterLock.Unlock()
+
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+
+		if p.lineStart {
+			b.WriteString(p.prefix)
+		}
+
+		b.WriteString(line)
+		p.lineStart = strings.HasSuffix(line, "\n")
+	}
+
+	if _, err := io.WriteString(p.w, b.String()); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
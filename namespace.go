@@ -0,0 +1,129 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the handling of namespaces declared for resource
+// sets or specified on the command line.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Namespaces that are managed by Kubernetes itself and must never be
+// created or deleted by kontemplate.
+var reservedNamespaces = []string{"default", "kube-system", "kube-public", "kube-node-lease"}
+
+const namespaceTemplate string = `---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: %s
+`
+
+// Determines the namespace of every resource set and makes it
+// available both as the '.namespace' template variable and as the
+// namespace passed to kubectl.
+//
+// The precedence is (in descending order):
+//
+// 1. The `namespace` field of the resource set
+// 2. A `namespace` variable of the resource set, if `--namespace` is set
+// 3. The namespace specified via `--namespace`
+func applyNamespaces(ctx *context.Context, global string) {
+	for i, rs := range ctx.ResourceSets {
+		effective := rs.Namespace
+
+		if effective != "" && global != "" && effective != global {
+			util.Warnf("Resource set '%s' declares namespace '%s', which takes precedence over --namespace '%s'", rs.Name, effective, global)
+		}
+
+		if effective == "" && global != "" {
+			effective = global
+
+			if v, ok := rs.Values["namespace"]; ok {
+				declared, ok := v.(string)
+				if !ok {
+					fail(exitTemplate, "Resource set '%s' declares a non-string 'namespace' variable\n", rs.Name)
+				}
+
+				if declared != global {
+					util.Warnf("Resource set '%s' declares namespace variable '%s', which takes precedence over --namespace '%s'", rs.Name, declared, global)
+				}
+
+				effective = declared
+			}
+		}
+
+		if effective == "" {
+			continue
+		}
+
+		nsValues := map[string]interface{}{"namespace": effective}
+		rs.Values = *util.Merge(&rs.Values, &nsValues)
+		rs.Namespace = effective
+		// The arguments are copied, as they may be shared with the
+		// deprecated 'args' field.
+		rs.KubectlArgs = append(append([]string(nil), rs.KubectlArgs...), fmt.Sprintf("--namespace=%s", effective))
+		ctx.ResourceSets[i] = rs
+	}
+}
+
+// Adds a Namespace resource to resource sets that declare a namespace,
+// so that it is created (or deleted) together with the resource set.
+//
+// Each namespace is only added once. When creating it is added to the
+// first resource set using it, when deleting to the last one.
+func addNamespaceResources(resourceSets *[]templater.RenderedResourceSet, deleting bool) {
+	sets := *resourceSets
+	seen := make(map[string]bool)
+
+	for n := range sets {
+		i := n
+		if deleting {
+			i = len(sets) - 1 - n
+		}
+
+		ns := sets[i].Namespace
+		if ns == "" || seen[ns] {
+			continue
+		}
+		seen[ns] = true
+
+		if isReservedNamespace(ns) {
+			util.Warnf("Not managing reserved namespace '%s' of resource set '%s'", ns, sets[i].Name)
+			continue
+		}
+
+		namespace := templater.RenderedResource{
+			Filename: fmt.Sprintf("namespace-%s.yaml", ns),
+			Rendered: fmt.Sprintf(namespaceTemplate, ns),
+		}
+
+		if deleting {
+			sets[i].Resources = append(sets[i].Resources, namespace)
+		} else {
+			sets[i].Resources = append([]templater.RenderedResource{namespace}, sets[i].Resources...)
+		}
+	}
+}
+
+func isReservedNamespace(ns string) bool {
+	for _, reserved := range reservedNamespaces {
+		if ns == reserved {
+			return true
+		}
+	}
+
+	return false
+}
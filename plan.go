@@ -0,0 +1,293 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of 'kontemplate plan', which
+// compares every rendered object with the live object in the cluster and
+// reports whether applying would create, change or leave it unchanged.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Actions that applying would take for an object.
+const (
+	planCreate    = "create"
+	planUpdate    = "update"
+	planUnchanged = "no-op"
+)
+
+type plannedObject struct {
+	resource  string
+	namespace string
+	action    string
+}
+
+type resourceSetPlan struct {
+	resourceSet string
+	objects     []plannedObject
+}
+
+// Fetches the live state of every object of the resource sets and
+// decides what applying them would do.
+func planResourceSets(c *context.Context, resourceSets []templater.RenderedResourceSet) ([]resourceSetPlan, error) {
+	var plans []resourceSetPlan
+
+	for _, rs := range resourceSets {
+		objects, err := resourceSetObjects(&rs)
+		if err != nil {
+			return nil, err
+		}
+
+		result := resourceSetPlan{resourceSet: rs.Name}
+		for _, o := range objects {
+			live, found, err := getObject(c, o.resource(), o.Namespace)
+			if err != nil {
+				return nil, err
+			}
+
+			action, err := planAction(o.Document, live, found)
+			if err != nil {
+				return nil, fmt.Errorf("could not compare %s in %s: %v", o.resource(), rs.Name, err)
+			}
+
+			result.objects = append(result.objects, plannedObject{o.resource(), o.Namespace, action})
+		}
+
+		plans = append(plans, result)
+	}
+
+	return plans, nil
+}
+
+// Decides what applying a rendered document would do to the live object.
+//
+// The live object contains many fields that are defaulted or set by the
+// API server, so it is only compared with the fields the document sets.
+// Fields that were removed from the document are detected by comparing
+// it with the last applied configuration, if the object has one.
+func planAction(document string, live []byte, found bool) (string, error) {
+	if !found {
+		return planCreate, nil
+	}
+
+	var desired, current map[string]interface{}
+	if err := yaml.Unmarshal([]byte(document), &desired); err != nil {
+		return "", err
+	}
+
+	if err := json.Unmarshal(live, &current); err != nil {
+		return "", err
+	}
+
+	if !containsFields(current, encodeStringData(desired)) {
+		return planUpdate, nil
+	}
+
+	applied, err := lastAppliedObject(current)
+	if err != nil {
+		return "", err
+	}
+
+	if applied != nil && !reflect.DeepEqual(comparableObject(applied), comparableObject(desired)) {
+		return planUpdate, nil
+	}
+
+	return planUnchanged, nil
+}
+
+// Secrets may set values in 'stringData', which the server encodes into
+// 'data' (taking precedence over it) and never returns. A copy of such
+// Secrets is returned in the form that the server stores.
+func encodeStringData(object map[string]interface{}) map[string]interface{} {
+	stringData, ok := object["stringData"].(map[string]interface{})
+	if !ok || object["kind"] != "Secret" {
+		return object
+	}
+
+	data := make(map[string]interface{})
+	if existing, ok := object["data"].(map[string]interface{}); ok {
+		for k, v := range existing {
+			data[k] = v
+		}
+	}
+
+	for k, v := range stringData {
+		value := ""
+		if v != nil {
+			value = fmt.Sprint(v)
+		}
+		data[k] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	encoded := make(map[string]interface{}, len(object))
+	for k, v := range object {
+		if k != "stringData" {
+			encoded[k] = v
+		}
+	}
+	encoded["data"] = data
+
+	return encoded
+}
+
+// Checks whether every field set in 'desired' has the same value in
+// 'live'. Lists must have the same length, and their elements are
+// compared in the same way. Empty maps and lists match missing fields,
+// as the server omits them.
+func containsFields(live interface{}, desired interface{}) bool {
+	// Fields that are explicitly null in the document, such as
+	// 'creationTimestamp: null', are set by the server.
+	if desired == nil {
+		return true
+	}
+
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return live == nil && len(d) == 0
+		}
+
+		for k, v := range d {
+			if !containsFields(l[k], v) {
+				return false
+			}
+		}
+
+		return true
+
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok {
+			return live == nil && len(d) == 0
+		}
+
+		if len(l) != len(d) {
+			return false
+		}
+
+		for i := range d {
+			if !containsFields(l[i], d[i]) {
+				return false
+			}
+		}
+
+		return true
+
+	default:
+		// Scalars are compared as strings, as the server returns
+		// e.g. resource quantities written as numbers as strings.
+		return live != nil && fmt.Sprint(live) == fmt.Sprint(desired)
+	}
+}
+
+// Returns the last applied configuration of a live object, or nil if it
+// has none.
+func lastAppliedObject(live map[string]interface{}) (map[string]interface{}, error) {
+	metadata, _ := live["metadata"].(map[string]interface{})
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	annotation, ok := annotations[lastAppliedAnnotation].(string)
+	if !ok {
+		return nil, nil
+	}
+
+	var applied map[string]interface{}
+	if err := json.Unmarshal([]byte(annotation), &applied); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", lastAppliedAnnotation, err)
+	}
+
+	return applied, nil
+}
+
+// Metadata that kontemplate adds to objects when applying them with
+// --prune or --annotate.
+var addedLabels = []string{managedByLabel, resourceSetLabel}
+var addedAnnotations = []string{appliedByAnnotation, appliedAtAnnotation, gitCommitAnnotation}
+
+// Removes the metadata from an object that differs between the last
+// applied configuration and the rendered document without a change to
+// the document: the namespace, which kubectl may add, and the labels
+// and annotations added by kontemplate itself.
+func comparableObject(o map[string]interface{}) map[string]interface{} {
+	original, ok := o["metadata"].(map[string]interface{})
+	if !ok {
+		return o
+	}
+
+	// Empty labels and annotations are removed, as they are equal to
+	// none at all.
+	metadata := withoutFields(original, "namespace", "labels", "annotations")
+	if labels, ok := original["labels"].(map[string]interface{}); ok {
+		if labels = withoutFields(labels, addedLabels...); len(labels) > 0 {
+			metadata["labels"] = labels
+		}
+	}
+
+	if annotations, ok := original["annotations"].(map[string]interface{}); ok {
+		if annotations = withoutFields(annotations, addedAnnotations...); len(annotations) > 0 {
+			metadata["annotations"] = annotations
+		}
+	}
+
+	filtered := withoutFields(o, "metadata")
+	filtered["metadata"] = metadata
+	return filtered
+}
+
+// Prints the objects that would be created or changed, grouped by
+// resource set, followed by a summary of all planned actions.
+// Returns whether any object would be created or changed.
+func printPlan(w io.Writer, plans []resourceSetPlan) bool {
+	counts := make(map[string]int)
+
+	for _, p := range plans {
+		printed := false
+
+		for _, o := range p.objects {
+			counts[o.action]++
+
+			symbol, style := "+", util.Green
+			if o.action == planUnchanged {
+				continue
+			} else if o.action == planUpdate {
+				symbol, style = "~", util.Yellow
+			}
+
+			if !printed {
+				fmt.Fprintf(w, "%s:\n", p.resourceSet)
+				printed = true
+			}
+
+			name := o.resource
+			if o.namespace != "" {
+				name = fmt.Sprintf("%s (namespace %s)", o.resource, o.namespace)
+			}
+
+			fmt.Fprintf(w, "  %s %s\n", util.Colorize(w, style, symbol), name)
+		}
+
+		if printed {
+			fmt.Fprintln(w)
+		}
+	}
+
+	fmt.Fprintf(w, "Plan: + %d to create, ~ %d to change, %d unchanged\n", counts[planCreate], counts[planUpdate], counts[planUnchanged])
+	return counts[planCreate]+counts[planUpdate] > 0
+}
@@ -0,0 +1,71 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of post-rendering, which pipes
+// the rendered resources through an external command.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Name of the file that holds the output of the post-render command.
+const postRenderedFilename = "post-rendered.yaml"
+
+// Runs the post-render command once per resource set. The command
+// receives all rendered files of the set on stdin, separated by '---',
+// and its output replaces them.
+//
+// The name and namespace of the resource set are passed to the command
+// in the KONTEMPLATE_RESOURCE_SET and KONTEMPLATE_NAMESPACE
+// environment variables.
+func postRender(rs *templater.RenderedResourceSet, command string, args []string) error {
+	if len(rs.Resources) == 0 {
+		return nil
+	}
+
+	var stdin, stdout bytes.Buffer
+	for _, r := range rs.Resources {
+		fmt.Fprintf(&stdin, "---\n%s\n", strings.TrimPrefix(r.Rendered, "---\n"))
+	}
+
+	util.Debugf("Running post-render command %s %s for %s", command, strings.Join(args, " "), rs.Name)
+	cmd := exec.Command(command, args...)
+	cmd.Env = append(os.Environ(),
+		"KONTEMPLATE_RESOURCE_SET="+rs.Name,
+		"KONTEMPLATE_NAMESPACE="+rs.Namespace,
+	)
+	cmd.Stdin = &stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	if err := util.RunCommand(cmd, *timeout); err != nil {
+		return fmt.Errorf("post-render command failed for resource set '%s': %v", rs.Name, err)
+	}
+
+	if strings.TrimSpace(stdout.String()) == "" {
+		rs.Resources = nil
+		return nil
+	}
+
+	rs.Resources = []templater.RenderedResource{{
+		Filename: postRenderedFilename,
+		Rendered: stdout.String(),
+	}}
+
+	return nil
+}
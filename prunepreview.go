@@ -0,0 +1,108 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of 'apply --prune-dry-run',
+// which runs a pruning server-side dry-run and lists the objects that
+// pruning would delete, grouped by resource set.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Objects that pruning would delete from a resource set.
+type prunePreview struct {
+	resourceSet string
+	objects     []string
+}
+
+// Runs kubectl with the given (dry-run) arguments for all resource sets
+// that are pruned and collects the objects kubectl reports as pruned.
+func previewPrune(c *context.Context, kubectlArgs *[]string, resourceSets *[]templater.RenderedResourceSet) ([]prunePreview, error) {
+	var previews []prunePreview
+
+	for _, rs := range *resourceSets {
+		if rs.Prune != nil && !*rs.Prune {
+			continue
+		}
+
+		var stdout bytes.Buffer
+		start := time.Now()
+		err := withRetries(*retries, *retryDelay, func() (string, error) {
+			var stderr bytes.Buffer
+			stdout.Reset()
+			err := runKubectl(c, kubectlArgs, &rs, &stdout, io.MultiWriter(os.Stderr, &stderr))
+			return stderr.String(), err
+		})
+		recordResourceSet(rs.Name, start, err)
+
+		if err != nil {
+			return nil, err
+		}
+
+		util.Debugf("Output of kubectl for resource set '%s':\n%s", rs.Name, stdout.String())
+		previews = append(previews, prunePreview{rs.Name, prunedObjects(stdout.String())})
+	}
+
+	return previews, nil
+}
+
+// Extracts the objects reported as pruned from the output of 'kubectl
+// apply --prune', whose lines look like 'configmap/foo pruned (server
+// dry run)'. Older kubectl versions report them as 'deleted'.
+func prunedObjects(output string) []string {
+	var objects []string
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		if fields[1] == "pruned" || fields[1] == "deleted" {
+			objects = append(objects, fields[0])
+		}
+	}
+
+	return objects
+}
+
+func printPrunePreview(w io.Writer, previews []prunePreview) {
+	total := 0
+	for _, p := range previews {
+		total += len(p.objects)
+	}
+
+	if total == 0 {
+		fmt.Fprintln(w, "Pruning would not delete any objects.")
+		return
+	}
+
+	fmt.Fprintf(w, "Pruning would delete %d object(s):\n", total)
+	for _, p := range previews {
+		if len(p.objects) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%s:\n", p.resourceSet)
+		for _, o := range p.objects {
+			fmt.Fprintf(w, "  %s\n", o)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of retrying kubectl invocations
+// that failed due to transient errors.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Messages in the output of kubectl that indicate a transient problem
+// communicating with the cluster, as opposed to invalid resources.
+var transientErrors = []string{
+	"connection refused",
+	"connection reset by peer",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"no route to host",
+	"unexpected EOF",
+	"http2: client connection lost",
+	"Client.Timeout exceeded",
+	"context deadline exceeded",
+	"etcdserver: request timed out",
+	"the server is currently unable to handle the request",
+	"the server was unable to return a response in the time allotted",
+}
+
+func isTransientError(output string) bool {
+	for _, msg := range transientErrors {
+		if strings.Contains(output, msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Runs a function up to 'retries' additional times for as long as it
+// fails with a transient error, doubling the delay between attempts.
+// The function returns the output in which transient errors are
+// detected together with its error.
+func withRetries(retries int, delay time.Duration, f func() (string, error)) error {
+	for attempt := 0; ; attempt++ {
+		output, err := f()
+		if err == nil || attempt >= retries || !isTransientError(output) {
+			return err
+		}
+
+		util.Warnf("Transient kubectl error, retrying in %s (attempt %d of %d)", delay, attempt+1, retries)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
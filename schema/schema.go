@@ -0,0 +1,331 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of validating rendered
+// resources against the JSON schemas of the Kubernetes API.
+
+// Package schema implements offline validation of rendered resources
+// against the JSON schemas of the Kubernetes API.
+//
+// The schemas are downloaded from the kubernetes-json-schema project
+// and cached locally. Only the subset of JSON schema used by these
+// schemas is supported.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// Location from which schemas are downloaded by default.
+const DefaultBaseURL string = "https://raw.githubusercontent.com/yannh/kubernetes-json-schema/master"
+
+type Validator struct {
+	// Kubernetes version to validate against, e.g. "1.27" or "master".
+	Version string
+
+	// Directory in which downloaded schemas are cached.
+	CacheDir string
+
+	// Location from which schemas are downloaded.
+	BaseURL string
+
+	client  *http.Client
+	schemas map[string]map[string]interface{}
+}
+
+// Result of validating a single document.
+type Result struct {
+	// Field-level validation errors.
+	Errors []string
+
+	// Set if no schema exists for the document, e.g. for custom resources.
+	Skipped bool
+}
+
+func NewValidator(version string, cacheDir string) *Validator {
+	return &Validator{
+		Version:  version,
+		CacheDir: cacheDir,
+		BaseURL:  DefaultBaseURL,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		schemas:  make(map[string]map[string]interface{}),
+	}
+}
+
+// Validates a single YAML document against the schema for its
+// apiVersion and kind.
+func (v *Validator) ValidateDocument(doc string) (*Result, error) {
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(doc), &parsed); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %v", err)
+	}
+
+	// Documents consisting only of comments are ignored by kubectl.
+	if parsed == nil {
+		return &Result{Skipped: true}, nil
+	}
+
+	object, ok := parsed.(map[string]interface{})
+	if !ok {
+		return &Result{Errors: []string{"document is not an object"}}, nil
+	}
+
+	apiVersion, _ := object["apiVersion"].(string)
+	kind, _ := object["kind"].(string)
+	if apiVersion == "" || kind == "" {
+		return &Result{Errors: []string{"missing required field 'apiVersion' or 'kind'"}}, nil
+	}
+
+	schema, err := v.loadSchema(schemaFilename(apiVersion, kind))
+	if err != nil {
+		return nil, err
+	}
+
+	if schema == nil {
+		return &Result{Skipped: true}, nil
+	}
+
+	var errs []string
+	validate(schema, object, kind, &errs)
+
+	return &Result{Errors: errs}, nil
+}
+
+// Determines the file name of a schema in the kubernetes-json-schema
+// project, e.g. 'deployment-apps-v1.json'.
+func schemaFilename(apiVersion string, kind string) string {
+	parts := strings.Split(apiVersion, "/")
+	if len(parts) == 1 {
+		return fmt.Sprintf("%s-%s.json", strings.ToLower(kind), parts[0])
+	}
+
+	group := strings.Split(parts[0], ".")[0]
+	return fmt.Sprintf("%s-%s-%s.json", strings.ToLower(kind), group, parts[1])
+}
+
+// Determines the folder containing the schemas for a Kubernetes
+// version, e.g. 'v1.27.0-standalone-strict'.
+func (v *Validator) versionDir() string {
+	version := strings.TrimPrefix(v.Version, "v")
+
+	if version != "master" && strings.Count(version, ".") == 1 {
+		version = version + ".0"
+	}
+
+	if version != "master" {
+		version = "v" + version
+	}
+
+	return version + "-standalone-strict"
+}
+
+// Loads a schema from the cache or downloads it. Returns nil if no
+// such schema exists.
+func (v *Validator) loadSchema(filename string) (map[string]interface{}, error) {
+	if schema, ok := v.schemas[filename]; ok {
+		return schema, nil
+	}
+
+	cached := path.Join(v.CacheDir, "schemas", v.versionDir(), filename)
+	data, err := ioutil.ReadFile(cached)
+
+	if os.IsNotExist(err) {
+		data, err = v.downloadSchema(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		// Missing schemas (e.g. of custom resources) are remembered
+		// for this run, so that they are not requested once per
+		// document.
+		if data == nil {
+			v.schemas[filename] = nil
+			return nil, nil
+		}
+
+		if err = os.MkdirAll(path.Dir(cached), 0775); err != nil {
+			return nil, err
+		}
+
+		if err = ioutil.WriteFile(cached, data, 0664); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var schema map[string]interface{}
+	if err = json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", filename, err)
+	}
+
+	v.schemas[filename] = schema
+	return schema, nil
+}
+
+func (v *Validator) downloadSchema(filename string) ([]byte, error) {
+	url := fmt.Sprintf("%s/%s/%s", v.BaseURL, v.versionDir(), filename)
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("could not download schema: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not download schema from %s: %s", url, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Validates a value against a schema, appending errors for all fields
+// that do not match.
+func validate(schema map[string]interface{}, value interface{}, field string, errs *[]string) {
+	for _, key := range []string{"oneOf", "anyOf"} {
+		if alternatives, ok := schema[key].([]interface{}); ok && !matchesAny(alternatives, value, field) {
+			*errs = append(*errs, fmt.Sprintf("%s: does not match any of the allowed types", field))
+			return
+		}
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		*errs = append(*errs, fmt.Sprintf("%s: expected %v, but got %s", field, t, typeName(value)))
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok && !contains(enum, value) {
+		*errs = append(*errs, fmt.Sprintf("%s: must be one of %v", field, enum))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		validateObject(schema, v, field, errs)
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				validate(items, item, fmt.Sprintf("%s[%d]", field, i), errs)
+			}
+		}
+	}
+}
+
+func validateObject(schema map[string]interface{}, object map[string]interface{}, field string, errs *[]string) {
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	for key, value := range object {
+		child := field + "." + key
+
+		if property, ok := properties[key].(map[string]interface{}); ok {
+			validate(property, value, child, errs)
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				*errs = append(*errs, fmt.Sprintf("%s: unknown field", child))
+			}
+		case map[string]interface{}:
+			validate(additional, value, child, errs)
+		}
+	}
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, key := range required {
+			if _, ok := object[key.(string)]; !ok {
+				*errs = append(*errs, fmt.Sprintf("%s.%s: missing required field", field, key))
+			}
+		}
+	}
+}
+
+func matchesAny(alternatives []interface{}, value interface{}, field string) bool {
+	for _, alternative := range alternatives {
+		if schema, ok := alternative.(map[string]interface{}); ok {
+			var errs []string
+			validate(schema, value, field, &errs)
+			if len(errs) == 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func matchesType(t interface{}, value interface{}) bool {
+	switch types := t.(type) {
+	case string:
+		return isType(types, value)
+	case []interface{}:
+		for _, alternative := range types {
+			if name, ok := alternative.(string); ok && isType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func isType(name string, value interface{}) bool {
+	switch name {
+	case "null":
+		return value == nil
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == float64(int64(n))
+	default:
+		return typeName(value) == name
+	}
+}
+
+// Returns the JSON schema type name of a deserialised value.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+
+	return fmt.Sprintf("%T", value)
+}
+
+func contains(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
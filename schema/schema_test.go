@@ -0,0 +1,188 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package schema
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Serves the schemas in testdata for the 'v1.27.0-standalone-strict'
+// version and counts the number of requests made.
+func testServer(requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		filename := strings.TrimPrefix(r.URL.Path, "/v1.27.0-standalone-strict/")
+		data, err := ioutil.ReadFile(path.Join("testdata", filename))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+}
+
+func testValidator(t *testing.T, requests *int) (*Validator, func()) {
+	server := testServer(requests)
+	cacheDir, err := ioutil.TempDir("", "kontemplate-schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewValidator("1.27", cacheDir)
+	v.BaseURL = server.URL
+
+	return v, func() {
+		server.Close()
+		os.RemoveAll(cacheDir)
+	}
+}
+
+func TestSchemaFilename(t *testing.T) {
+	cases := map[string][2]string{
+		"service-v1.json":            {"v1", "Service"},
+		"deployment-apps-v1.json":    {"apps/v1", "Deployment"},
+		"ingress-networking-v1.json": {"networking.k8s.io/v1", "Ingress"},
+		"cronjob-batch-v1beta1.json": {"batch/v1beta1", "CronJob"},
+	}
+
+	for expected, input := range cases {
+		if result := schemaFilename(input[0], input[1]); result != expected {
+			t.Errorf("Expected schema filename %s for %v, but got %s\n", expected, input, result)
+		}
+	}
+}
+
+func TestValidDocument(t *testing.T) {
+	requests := 0
+	v, cleanup := testValidator(t, &requests)
+	defer cleanup()
+
+	doc := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+  labels:
+    app: foo
+spec:
+  replicas: 3
+  strategy:
+    rollingUpdate:
+      maxSurge: 25%
+  containers:
+  - name: foo
+`
+
+	result, err := v.ValidateDocument(doc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if result.Skipped || len(result.Errors) != 0 {
+		t.Errorf("Expected document to be valid, but got %+v\n", result)
+	}
+}
+
+func TestInvalidDocument(t *testing.T) {
+	requests := 0
+	v, cleanup := testValidator(t, &requests)
+	defer cleanup()
+
+	doc := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: 42
+spec:
+  replicas: "3"
+  replica: 3
+  strategy:
+    rollingUpdate:
+      maxSurge: true
+  containers:
+  - image: foo
+`
+
+	result, err := v.ValidateDocument(doc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []string{
+		"Deployment.metadata.labels.app: expected string, but got number",
+		"Deployment.spec.containers[0].name: missing required field",
+		"Deployment.spec.replica: unknown field",
+		"Deployment.spec.replicas: expected integer, but got string",
+		"Deployment.spec.strategy.rollingUpdate.maxSurge: does not match any of the allowed types",
+	}
+
+	errors := result.Errors
+	sort.Strings(errors)
+
+	if !reflect.DeepEqual(expected, errors) {
+		t.Errorf("Unexpected validation errors:\n%s\n", strings.Join(errors, "\n"))
+	}
+}
+
+func TestUnknownKindIsSkipped(t *testing.T) {
+	requests := 0
+	v, cleanup := testValidator(t, &requests)
+	defer cleanup()
+
+	result, err := v.ValidateDocument("apiVersion: example.com/v1\nkind: Widget\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if !result.Skipped {
+		t.Error("Expected document without schema to be skipped")
+	}
+
+	// The missing schema must only be requested once:
+	if _, err := v.ValidateDocument("apiVersion: example.com/v1\nkind: Widget\n"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if requests != 1 {
+		t.Errorf("Expected missing schema to be requested once, but got %d requests\n", requests)
+	}
+}
+
+func TestSchemasAreCached(t *testing.T) {
+	requests := 0
+	v, cleanup := testValidator(t, &requests)
+	defer cleanup()
+
+	doc := "apiVersion: apps/v1\nkind: Deployment\nspec: {}\n"
+	if _, err := v.ValidateDocument(doc); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	// A fresh validator with the same cache directory must not
+	// download the schema again.
+	cached := NewValidator("1.27", v.CacheDir)
+	cached.BaseURL = v.BaseURL
+
+	result, err := cached.ValidateDocument(doc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if requests != 1 || result.Skipped {
+		t.Errorf("Expected schema to be downloaded once, but got %d requests\n", requests)
+	}
+}
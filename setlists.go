@@ -0,0 +1,92 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of '--include-from' and
+// '--exclude-from', which read the names of resource sets to include or
+// exclude from files, e.g. a list of changed resource sets written by CI.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Names read from --include-from and --exclude-from, which are checked
+// against the resource sets of the cluster configuration.
+var listedSets []string
+
+// Reads a list of resource set names, one per line. Everything after a
+// '#' is a comment, and blank lines are ignored.
+func readSetList(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read resource set list: %v", err)
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+
+	return names, nil
+}
+
+// Adds the names listed in --include-from and --exclude-from to the
+// inline includes and excludes.
+func loadSetLists() error {
+	for _, file := range *includeFrom {
+		names, err := readSetList(file)
+		if err != nil {
+			return err
+		}
+
+		*includes = append(*includes, names...)
+		listedSets = append(listedSets, names...)
+	}
+
+	// An empty list would otherwise include every resource set, which
+	// is the opposite of what a list of (changed) resource sets means.
+	if len(*includeFrom) > 0 && len(*includes) == 0 {
+		return fmt.Errorf("--include-from does not list any resource sets (%s)", strings.Join(*includeFrom, ", "))
+	}
+
+	for _, file := range *excludeFrom {
+		names, err := readSetList(file)
+		if err != nil {
+			return err
+		}
+
+		*excludes = append(*excludes, names...)
+		listedSets = append(listedSets, names...)
+	}
+
+	return nil
+}
+
+// Warns about listed names that match none of the resource sets of a
+// context, e.g. because a resource set was renamed.
+func warnUnmatchedSetNames(ctx *context.Context, names []string) {
+	for _, name := range names {
+		if len(templater.SelectResourceSets(ctx, &[]string{name}, &[]string{})) == 0 {
+			util.Warnf("Listed resource set '%s' does not match any resource set", name)
+		}
+	}
+}
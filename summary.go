@@ -0,0 +1,164 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of machine-readable summaries
+// of kubectl-wrapping commands (see --summary-output).
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+)
+
+// Version of the summary format. It is incremented whenever fields
+// are removed or change their meaning, but not when fields are added.
+const summaryVersion = 1
+
+// Status of a resource set in a summary.
+const (
+	statusSucceeded  = "succeeded"
+	statusFailed     = "failed"
+	statusSkipped    = "skipped"
+	statusRolledBack = "rolled-back"
+)
+
+// Summary of a kubectl-wrapping command, written as JSON.
+type Summary struct {
+	Version         int                  `json:"version"`
+	Command         string               `json:"command"`
+	Context         string               `json:"context"`
+	Success         bool                 `json:"success"`
+	StartedAt       time.Time            `json:"startedAt"`
+	DurationSeconds float64              `json:"durationSeconds"`
+	ResourceSets    []ResourceSetSummary `json:"resourceSets"`
+}
+
+// Summary of a single resource set. Resource sets that were not
+// processed because an earlier one failed have the status 'skipped'.
+type ResourceSetSummary struct {
+	Name            string  `json:"name"`
+	Namespace       string  `json:"namespace,omitempty"`
+	Files           int     `json:"files"`
+	Tool            string  `json:"tool"`
+	Status          string  `json:"status"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+
+	// Errors of sensitive resource sets are redacted, as they may
+	// contain parts of the rendered resources.
+	sensitive bool
+}
+
+var runSummary struct {
+	sync.Mutex
+	summary *Summary
+}
+
+// Starts recording a summary for the resource sets that are about to
+// be passed to kubectl, if --summary-output is set.
+func startSummary(command string, c *context.Context, resourceSets *[]templater.RenderedResourceSet) {
+	if *summaryOutput == "" {
+		return
+	}
+
+	s := Summary{
+		Version:   summaryVersion,
+		Command:   command,
+		Context:   kubectlContext(c),
+		StartedAt: time.Now(),
+	}
+
+	for _, rs := range *resourceSets {
+		s.ResourceSets = append(s.ResourceSets, ResourceSetSummary{
+			Name:      rs.Name,
+			Namespace: rs.Namespace,
+			Files:     len(rs.Resources),
+			Tool:      "kubectl",
+			Status:    statusSkipped,
+			sensitive: rs.Sensitive,
+		})
+	}
+
+	runSummary.Lock()
+	runSummary.summary = &s
+	runSummary.Unlock()
+}
+
+// Records the result of processing a resource set that was started at
+// the given time.
+func recordResourceSet(name string, start time.Time, err error) {
+	status := statusSucceeded
+	if err != nil {
+		status = statusFailed
+	}
+
+	updateResourceSetSummary(name, func(rs *ResourceSetSummary) {
+		rs.Status = status
+		rs.DurationSeconds = time.Since(start).Seconds()
+		if err != nil && rs.sensitive {
+			rs.Error = "error details are hidden as the resource set is sensitive"
+		} else if err != nil {
+			rs.Error = err.Error()
+		}
+	})
+}
+
+func recordRollback(name string) {
+	updateResourceSetSummary(name, func(rs *ResourceSetSummary) {
+		if rs.Status == statusSucceeded {
+			rs.Status = statusRolledBack
+		}
+	})
+}
+
+func updateResourceSetSummary(name string, update func(*ResourceSetSummary)) {
+	runSummary.Lock()
+	defer runSummary.Unlock()
+
+	if runSummary.summary == nil {
+		return
+	}
+
+	for i := range runSummary.summary.ResourceSets {
+		if runSummary.summary.ResourceSets[i].Name == name {
+			update(&runSummary.summary.ResourceSets[i])
+		}
+	}
+}
+
+// Writes the summary, if one was started, to the --summary-output
+// file. This is called when kontemplate exits, including on failures.
+func writeSummary(success bool) {
+	runSummary.Lock()
+	defer runSummary.Unlock()
+
+	s := runSummary.summary
+	if s == nil {
+		return
+	}
+	runSummary.summary = nil
+
+	s.Success = success
+	s.DurationSeconds = time.Since(s.StartedAt).Seconds()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(*summaryOutput, append(data, '\n'), 0664)
+	}
+
+	if err != nil {
+		fail(exitTemplate, "Could not write summary to %s: %v\n", *summaryOutput, err)
+	}
+}
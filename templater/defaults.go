@@ -0,0 +1,189 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of default values in templates.
+// The 'default' function of sprig replaces nil, empty and zero values,
+// but templates are executed with 'missingkey=error', so fields passed
+// to it are rewritten after parsing to look them up without failing if
+// they are not set.
+
+package templater
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"text/template"
+	"text/template/parse"
+)
+
+// Name of the function that fields passed to 'default' are rewritten
+// to. It is not meant to be called by templates directly.
+const optionalFieldFunc = "_optionalField"
+
+// Looks up a (nested) field of a map, returning nil instead of failing if
+// it or any of its parents is not set.
+func optionalField(value interface{}, fields ...string) interface{} {
+	for _, field := range fields {
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+
+		entry := v.MapIndex(reflect.ValueOf(field).Convert(v.Type().Key()))
+		if !entry.IsValid() {
+			return nil
+		}
+
+		value = entry.Interface()
+	}
+
+	return value
+}
+
+// Returns the parsed trees of a template and its associated templates.
+func parsedTrees(tpl *template.Template) map[*parse.Tree]bool {
+	trees := make(map[*parse.Tree]bool)
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil {
+			trees[t.Tree] = true
+		}
+	}
+
+	return trees
+}
+
+// Rewrites the fields passed to 'default' in the templates associated
+// with 'tpl', except for the trees in 'skip' (e.g. partials that were
+// already rewritten and are shared with other templates).
+func rewriteDefaults(tpl *template.Template, skip map[*parse.Tree]bool) error {
+	for _, t := range tpl.Templates() {
+		if t.Tree == nil || skip[t.Tree] {
+			continue
+		}
+
+		if err := rewriteDefaultsIn(t.Tree, t.Tree.Root); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func rewriteDefaultsIn(tree *parse.Tree, node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := rewriteDefaultsIn(tree, child); err != nil {
+				return err
+			}
+		}
+
+	case *parse.ActionNode:
+		return rewriteDefaultsIn(tree, n.Pipe)
+
+	case *parse.IfNode:
+		return rewriteBranchDefaults(tree, &n.BranchNode)
+
+	case *parse.RangeNode:
+		return rewriteBranchDefaults(tree, &n.BranchNode)
+
+	case *parse.WithNode:
+		return rewriteBranchDefaults(tree, &n.BranchNode)
+
+	case *parse.TemplateNode:
+		return rewriteDefaultsIn(tree, n.Pipe)
+
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+
+		for i, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				if err := rewriteDefaultsIn(tree, arg); err != nil {
+					return err
+				}
+			}
+
+			if function, ok := cmd.Args[0].(*parse.IdentifierNode); !ok || function.Ident != "default" {
+				continue
+			}
+
+			// Before 'default' treated the value as the name of a
+			// variable, '{{ default 3 "replicas" }}' looked up the
+			// variable 'replicas'. This now renders "replicas".
+			if i == 0 && len(cmd.Args) == 3 {
+				if name, ok := cmd.Args[2].(*parse.StringNode); ok {
+					location, _ := tree.ErrorContext(name)
+					return fmt.Errorf("template: %s: 'default' does not look up variables by name, use '{{ defaultVar ... %s }}' or '{{ .%s | default ... }}' instead", location, name.Quoted, name.Text)
+				}
+			}
+
+			for j := 2; j < len(cmd.Args); j++ {
+				cmd.Args[j] = optionalArg(cmd.Args[j])
+			}
+
+			if i > 0 && len(n.Cmds[i-1].Args) == 1 {
+				n.Cmds[i-1].Args[0] = optionalArg(n.Cmds[i-1].Args[0])
+			}
+		}
+	}
+
+	return nil
+}
+
+func rewriteBranchDefaults(tree *parse.Tree, n *parse.BranchNode) error {
+	for _, node := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+		if err := rewriteDefaultsIn(tree, node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replaces a field access such as '.a.b' or '$x.a' with a call to the
+// optional field function, e.g. '(_optionalField . "a" "b")'. Other
+// nodes are returned unchanged.
+func optionalArg(node parse.Node) parse.Node {
+	var root parse.Node
+	var fields []string
+
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		root = &parse.DotNode{NodeType: parse.NodeDot, Pos: n.Pos}
+		fields = n.Ident
+
+	case *parse.VariableNode:
+		if len(n.Ident) < 2 {
+			return node
+		}
+		root = &parse.VariableNode{NodeType: parse.NodeVariable, Pos: n.Pos, Ident: n.Ident[:1]}
+		fields = n.Ident[1:]
+
+	default:
+		return node
+	}
+
+	pos := node.Position()
+	args := []parse.Node{parse.NewIdentifier(optionalFieldFunc).SetPos(pos), root}
+	for _, field := range fields {
+		args = append(args, &parse.StringNode{NodeType: parse.NodeString, Pos: pos, Quoted: strconv.Quote(field), Text: field})
+	}
+
+	return &parse.PipeNode{
+		NodeType: parse.NodePipe,
+		Pos:      pos,
+		Cmds:     []*parse.CommandNode{{NodeType: parse.NodeCommand, Pos: pos, Args: args}},
+	}
+}
@@ -15,11 +15,12 @@ package templater
 import (
 	"fmt"
 	"net"
-	"os"
+
+	"github.com/tazjin/kontemplate/util"
 )
 
 func GetIPsFromDNS(host string) ([]interface{}, error) {
-	fmt.Fprintf(os.Stderr, "Attempting to look up IP for %s in DNS\n", host)
+	util.Infof("Attempting to look up IP for %s in DNS", host)
 	ips, err := net.LookupIP(host)
 
 	if err != nil {
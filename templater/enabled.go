@@ -0,0 +1,89 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of conditionally enabling
+// resource sets via their 'enabled' field.
+
+package templater
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Removes resource sets whose 'enabled' condition evaluates to false.
+func enabledResourceSets(c *context.Context, sets []context.ResourceSet) ([]context.ResourceSet, error) {
+	enabled := make([]context.ResourceSet, 0, len(sets))
+
+	for _, rs := range sets {
+		ok, err := isEnabled(c, &rs)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			util.Infof("Skipping disabled resource set %s", rs.Name)
+			continue
+		}
+
+		enabled = append(enabled, rs)
+	}
+
+	return enabled, nil
+}
+
+// Evaluates the 'enabled' condition of a resource set. The condition
+// may be a boolean, a template such as '{{ eq .env "dev" }}' or the
+// name of a variable, which is treated like '{{ .name }}'. Conditions
+// that do not result in "true" or "false" are an error instead of
+// silently disabling the resource set.
+func isEnabled(c *context.Context, rs *context.ResourceSet) (bool, error) {
+	switch condition := rs.Enabled.(type) {
+	case nil:
+		return true, nil
+
+	case bool:
+		return condition, nil
+
+	case string:
+		if !strings.Contains(condition, "{{") {
+			condition = fmt.Sprintf("{{ .%s }}", strings.TrimPrefix(condition, "."))
+		}
+
+		tpl, err := template.New("enabled").Funcs(templateFuncs(c, rs)).Option(failOnMissingKeys).Parse(condition)
+		if err == nil {
+			err = rewriteDefaults(tpl, nil)
+		}
+
+		if err != nil {
+			return false, fmt.Errorf("Invalid 'enabled' condition of resource set %s: %v", rs.Name, err)
+		}
+
+		var b bytes.Buffer
+		if err = tpl.Execute(&b, templateValues(c, rs)); err != nil {
+			return false, fmt.Errorf("Invalid 'enabled' condition of resource set %s: %v", rs.Name, err)
+		}
+
+		result, err := strconv.ParseBool(strings.TrimSpace(b.String()))
+		if err != nil {
+			return false, fmt.Errorf("'enabled' condition of resource set %s must evaluate to true or false, but got '%s'", rs.Name, b.String())
+		}
+
+		return result, nil
+
+	default:
+		return false, fmt.Errorf("'enabled' condition of resource set %s must be a boolean or a string, but got %v", rs.Name, condition)
+	}
+}
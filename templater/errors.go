@@ -0,0 +1,127 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of the errors returned for
+// templates that fail to parse or execute, which name the resource set,
+// file and line of the problem.
+
+package templater
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+)
+
+// Kinds of template errors.
+const (
+	// The template could not be parsed, e.g. because of invalid syntax
+	// or an unknown function.
+	ParseError = "parse"
+
+	// The template could not be executed with the values of the
+	// resource set, e.g. because a variable is not set.
+	ExecutionError = "execution"
+)
+
+// An error in a template of a resource set. Callers that need more than
+// the message can inspect its fields.
+type TemplateError struct {
+	// Name of the resource set containing the template.
+	ResourceSet string
+
+	// Path of the file containing the error. This is a partial if the
+	// error is in a template defined by one.
+	File string
+
+	// Line of the error in the file, or 0 if it is not known.
+	Line int
+
+	// Either ParseError or ExecutionError.
+	Kind string
+
+	// Short description of the problem, e.g. 'unknown function "tolower"'.
+	Summary string
+
+	// The error returned by text/template.
+	Err error
+}
+
+func (e *TemplateError) Error() string {
+	location := fmt.Sprintf("resource set '%s', file %s", e.ResourceSet, e.File)
+	if e.Line > 0 {
+		location = fmt.Sprintf("%s, line %d", location, e.Line)
+	}
+
+	return fmt.Sprintf("%s: %s (%s error: %v)", location, e.Summary, e.Kind, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// Errors of text/template start with the template name and line,
+	// followed by a column for execution errors.
+	templateErrorPattern = regexp.MustCompile(`^template: ([^:]+):(\d+)(?::\d+)?: (.*)$`)
+
+	unknownFunctionPattern = regexp.MustCompile(`function "([^"]+)" not defined`)
+	missingKeyPattern      = regexp.MustCompile(`at <([^>]+)>: map has no entry for key "([^"]+)"`)
+	callErrorPattern       = regexp.MustCompile(`at <[^>]+>: error calling ([^:]+): (.*)$`)
+	executingPattern       = regexp.MustCompile(`^executing "[^"]*" at (<[^>]+>: .*)$`)
+)
+
+// Wraps an error of text/template in a TemplateError for the given
+// template file.
+func newTemplateError(rs string, filepath string, kind string, err error) error {
+	e := &TemplateError{
+		ResourceSet: rs,
+		File:        filepath,
+		Kind:        kind,
+		Summary:     err.Error(),
+		Err:         err,
+	}
+
+	m := templateErrorPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return e
+	}
+
+	// Partials are located next to the template that uses them.
+	if m[1] != path.Base(filepath) {
+		e.File = path.Join(path.Dir(filepath), m[1])
+	}
+
+	e.Line, _ = strconv.Atoi(m[2])
+	e.Summary = templateErrorSummary(m[3])
+
+	return e
+}
+
+// Shortens the most common errors of text/template to a summary.
+func templateErrorSummary(msg string) string {
+	if m := unknownFunctionPattern.FindStringSubmatch(msg); m != nil {
+		return fmt.Sprintf("unknown function %q", m[1])
+	}
+
+	if m := missingKeyPattern.FindStringSubmatch(msg); m != nil {
+		return fmt.Sprintf("variable %q is not set (in %s)", m[2], m[1])
+	}
+
+	if m := callErrorPattern.FindStringSubmatch(msg); m != nil {
+		return fmt.Sprintf("function %s failed: %s", m[1], m[2])
+	}
+
+	if m := executingPattern.FindStringSubmatch(msg); m != nil {
+		return m[1]
+	}
+
+	return msg
+}
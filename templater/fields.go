@@ -0,0 +1,179 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of setting fields of already
+// rendered resources (`--set-field Deployment:spec.replicas=3`).
+
+package templater
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// A field to set in rendered resources. Resources of other kinds are
+// left untouched, unless Kind is empty.
+type FieldTransform struct {
+	Kind  string
+	Path  []string
+	Value interface{}
+}
+
+// Parses field transforms in the form `[Kind:]path.to.field=value`. The
+// value is parsed as YAML, so that numbers, booleans, lists and maps can
+// be set as well. A '*' in the path selects every element of a list.
+func ParseFieldTransforms(transforms []string) ([]FieldTransform, error) {
+	var parsed []FieldTransform
+
+	for _, t := range transforms {
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf(`invalid field transform provided (%s), path and value should be separated with "="`, t)
+		}
+
+		var transform FieldTransform
+		field := parts[0]
+		if i := strings.Index(field, ":"); i >= 0 {
+			transform.Kind, field = field[:i], field[i+1:]
+		}
+
+		transform.Path = strings.Split(field, ".")
+		for _, key := range transform.Path {
+			if key == "" {
+				return nil, fmt.Errorf("invalid field path provided (%s)", field)
+			}
+		}
+
+		if err := yaml.Unmarshal([]byte(parts[1]), &transform.Value); err != nil {
+			return nil, fmt.Errorf("invalid value provided for field %s: %v", field, err)
+		}
+
+		parsed = append(parsed, transform)
+	}
+
+	return parsed, nil
+}
+
+// Sets fields of the rendered resources of a resource set, applying the
+// transforms in order to every document of a matching kind.
+//
+// Like AddLabels, documents that are changed are re-serialised, which
+// strips comments and formatting. Files without matching documents are
+// passed through as-is.
+func SetFields(rs *RenderedResourceSet, transforms []FieldTransform) error {
+	for i, r := range rs.Resources {
+		var docs []string
+		changed := false
+
+		for _, doc := range util.SplitDocuments(r.Rendered) {
+			updated, ok, err := setFieldsInDocument(doc, transforms)
+			if err != nil {
+				return fmt.Errorf("Could not set fields in %s/%s: %v", rs.Name, r.Filename, err)
+			}
+
+			docs = append(docs, updated)
+			changed = changed || ok
+		}
+
+		if changed {
+			rs.Resources[i].Rendered = joinDocuments(docs)
+		}
+	}
+
+	return nil
+}
+
+// Applies field transforms to a single document and reports whether any
+// of them matched its kind.
+func setFieldsInDocument(doc string, transforms []FieldTransform) (string, bool, error) {
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(doc), &parsed); err != nil {
+		return "", false, err
+	}
+
+	object, ok := parsed.(map[string]interface{})
+	if !ok {
+		return doc, false, nil
+	}
+
+	kind, _ := object["kind"].(string)
+	matched := false
+
+	for _, t := range transforms {
+		if t.Kind != "" && !strings.EqualFold(t.Kind, kind) {
+			continue
+		}
+
+		if err := setField(object, t.Path, t.Value); err != nil {
+			return "", false, fmt.Errorf("%s: %v", strings.Join(t.Path, "."), err)
+		}
+
+		matched = true
+	}
+
+	if !matched {
+		return doc, false, nil
+	}
+
+	out, err := yaml.Marshal(object)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(out), true, nil
+}
+
+// Sets a (possibly nested) field, creating missing maps along the path.
+// Existing values along the path that are not maps (or lists, for '*')
+// are an error, as replacing them would change the structure of the
+// resource.
+func setField(value interface{}, path []string, field interface{}) error {
+	if path[0] == "*" {
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("'*' can only be used for lists")
+		}
+
+		for i := range list {
+			if len(path) == 1 {
+				list[i] = field
+			} else if err := setField(list[i], path[1:], field); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("can not set key '%s' of a value that is not a map", path[0])
+	}
+
+	if len(path) == 1 {
+		object[path[0]] = field
+		return nil
+	}
+
+	nested := object[path[0]]
+	if nested == nil {
+		// Lists that do not exist have no elements to set fields of.
+		if path[1] == "*" {
+			return nil
+		}
+
+		nested = make(map[string]interface{})
+		object[path[0]] = nested
+	}
+
+	return setField(nested, path[1:], field)
+}
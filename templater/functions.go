@@ -0,0 +1,108 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of template functions that are
+// defined as commands in the cluster configuration. Calling such a
+// function runs its command with the arguments of the call and returns
+// the output.
+
+package templater
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Maximum time a single call of a template function may take before its
+// command is killed. This is set by the kontemplate binary.
+var FunctionTimeout = 10 * time.Second
+
+// Checks that template functions from the cluster configuration do not
+// replace any of the built-in functions.
+func validateTemplateFunctions(c *context.Context) error {
+	builtins := templateFuncs(&context.Context{}, &context.ResourceSet{})
+
+	for name := range c.TemplateFunctions {
+		if _, ok := builtins[name]; ok {
+			return fmt.Errorf("Template function '%s' can not be defined, as it is a built-in function", name)
+		}
+	}
+
+	return nil
+}
+
+// Adds the template functions of the cluster configuration to the
+// functions available to templates of a resource set.
+func addCommandFunctions(m template.FuncMap, c *context.Context, rs *context.ResourceSet) {
+	for name, command := range c.TemplateFunctions {
+		if _, ok := m[name]; ok {
+			continue
+		}
+
+		name, command := name, command
+		m[name] = func(args ...interface{}) (string, error) {
+			return runFunctionCommand(c, rs, name, command, args)
+		}
+	}
+}
+
+// Runs the command of a template function in the folder of the resource
+// set. The command is split on whitespace and receives the arguments of
+// the call, formatted as strings. Its output is returned without the
+// trailing newline.
+func runFunctionCommand(c *context.Context, rs *context.ResourceSet, name string, command string, args []interface{}) (string, error) {
+	fields := strings.Fields(command)
+	program := fields[0]
+
+	// Commands are looked up in $PATH unless they contain a slash,
+	// in which case they are relative to the cluster configuration.
+	// They are made absolute as they run in the resource set folder.
+	if strings.Contains(program, "/") && !path.IsAbs(program) {
+		program = absolutePath(path.Join(c.BaseDir, program))
+	}
+
+	cmdArgs := fields[1:]
+	for _, arg := range args {
+		cmdArgs = append(cmdArgs, fmt.Sprint(arg))
+	}
+
+	util.Debugf("Running template function %s: %s %s", name, program, strings.Join(cmdArgs, " "))
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(program, cmdArgs...)
+	cmd.Dir = rs.Path
+	cmd.Env = append(os.Environ(),
+		"KONTEMPLATE_RESOURCE_SET="+rs.Name,
+		"KONTEMPLATE_NAMESPACE="+rs.Namespace,
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// Commands that start other processes (e.g. a script running
+	// 'sleep') are killed together with them, as waiting would
+	// otherwise block until the children have closed their output.
+	if err := util.RunCommand(cmd, FunctionTimeout); err != nil {
+		if _, ok := err.(*util.TimeoutError); ok {
+			return "", fmt.Errorf("template function '%s' did not finish within %s and was killed", name, FunctionTimeout)
+		}
+
+		return "", fmt.Errorf("template function '%s' failed: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of '.kontemplateignore' files,
+// which exclude files in a resource set folder from templating using
+// gitignore-style patterns.
+
+package templater
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Name of the ignore file in the root of a resource set folder.
+const ignoreFilename = ".kontemplateignore"
+
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Ordered list of ignore rules. Later rules take precedence over
+// earlier ones, as in gitignore.
+type ignoreRules []ignoreRule
+
+// Loads the ignore file of a resource set folder. A missing file is not
+// an error and results in no rules.
+func loadIgnoreFile(dir string) (ignoreRules, error) {
+	file, err := os.Open(path.Join(dir, ignoreFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules ignoreRules
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		rule, ok, err := parseIgnoreRule(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern in %s on line %d: %v", path.Join(dir, ignoreFilename), line, err)
+		}
+
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, scanner.Err()
+}
+
+// Parses a single line of an ignore file. Blank lines and comments are
+// skipped.
+func parseIgnoreRule(line string) (ignoreRule, bool, error) {
+	var rule ignoreRule
+
+	line = strings.TrimRight(line, " \t")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+
+	// Patterns containing a slash are relative to the resource set
+	// folder, all others match at any depth.
+	if strings.HasPrefix(line, "/") {
+		line = line[1:]
+	} else if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+
+	pattern, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return rule, false, err
+	}
+
+	rule.pattern = pattern
+	return rule, true, nil
+}
+
+// Translates a glob pattern in which '**' matches any number of
+// directories into a regular expression.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta(glob[i:]))
+				return b.String()
+			}
+
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			b.WriteString("[" + class + "]")
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
+
+// Checks whether a path relative to the resource set folder is ignored.
+// As in gitignore, files in an ignored directory can not be included
+// again by a negated pattern.
+func (rules ignoreRules) ignored(relPath string, isDir bool) bool {
+	parts := strings.Split(relPath, "/")
+
+	for i := 1; i < len(parts); i++ {
+		if rules.matches(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return rules.matches(relPath, isDir)
+}
+
+func (rules ignoreRules) matches(relPath string, isDir bool) bool {
+	ignored := false
+
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if rule.pattern.MatchString(relPath) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of filtering rendered resources
+// by their kind.
+
+package templater
+
+import (
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Removes documents from a rendered resource set whose kind is not in
+// 'include' (if it is not empty) or is in 'exclude'. Kinds are
+// compared case-insensitively.
+//
+// Documents whose kind can not be determined are kept when only
+// including kinds, so that kubectl reports the problem, and dropped
+// when excluding kinds, as they might be of an excluded kind. A
+// warning is printed in both cases.
+func FilterKinds(rs *RenderedResourceSet, include []string, exclude []string) {
+	var resources []RenderedResource
+
+	for _, r := range rs.Resources {
+		var docs []string
+
+		for i, doc := range util.SplitDocuments(r.Rendered) {
+			var object struct {
+				Kind string `json:"kind"`
+			}
+
+			if err := yaml.Unmarshal([]byte(doc), &object); err != nil || object.Kind == "" {
+				if len(exclude) > 0 {
+					util.Warnf("Dropping document %d of %s/%s, as its kind can not be determined", i+1, rs.Name, r.Filename)
+					continue
+				}
+
+				util.Warnf("Keeping document %d of %s/%s, as its kind can not be determined", i+1, rs.Name, r.Filename)
+				docs = append(docs, doc)
+				continue
+			}
+
+			if (len(include) == 0 || containsKind(include, object.Kind)) && !containsKind(exclude, object.Kind) {
+				docs = append(docs, doc)
+			}
+		}
+
+		if len(docs) > 0 {
+			r.Rendered = joinDocuments(docs)
+			resources = append(resources, r)
+		}
+	}
+
+	rs.Resources = resources
+}
+
+func containsKind(kinds []string, kind string) bool {
+	for _, k := range kinds {
+		if strings.EqualFold(k, kind) {
+			return true
+		}
+	}
+
+	return false
+}
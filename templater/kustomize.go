@@ -0,0 +1,67 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of kustomize resource sets,
+// which are built with 'kubectl kustomize' instead of being templated.
+
+package templater
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Type of resource sets whose path is a kustomize directory.
+const KustomizeType string = "kustomize"
+
+// Name of the resource containing the output of a kustomize build.
+const kustomizeOutput string = "kustomization.yaml"
+
+// Path to the kubectl binary used to build kustomize resource sets. This
+// is set by the kontemplate binary.
+var Kubectl = "kubectl"
+
+// Time after which building a kustomize resource set is aborted. Zero
+// means no timeout. This is set by the kontemplate binary.
+var KubectlTimeout time.Duration
+
+func validateType(rs *context.ResourceSet) error {
+	if rs.Type != "" && rs.Type != KustomizeType && rs.Type != RawType {
+		return fmt.Errorf("Resource set '%s' has unknown type '%s', supported types are '%s' and '%s'", rs.Name, rs.Type, KustomizeType, RawType)
+	}
+
+	return nil
+}
+
+// Builds a kustomize resource set, whose output is treated like a single
+// rendered file. The result is passed to kubectl like any other resource
+// set, which is equivalent to 'kubectl apply -k'.
+func buildKustomization(rs *context.ResourceSet) (RenderedResource, error) {
+	util.Debugf("Running %s kustomize %s", Kubectl, rs.Path)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(Kubectl, "kustomize", rs.Path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := util.RunCommand(cmd, KubectlTimeout); err != nil {
+		return RenderedResource{}, fmt.Errorf("Could not build kustomization of resource set '%s': %v: %s", rs.Name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return RenderedResource{
+		Filename: kustomizeOutput,
+		Rendered: stdout.String(),
+	}, nil
+}
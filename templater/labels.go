@@ -0,0 +1,123 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of adding labels and annotations
+// to already rendered resources.
+
+package templater
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Adds labels to the metadata of every document in a rendered resource
+// set. Labels that are already set on a resource are not overwritten.
+//
+// Documents that are empty or are not objects are left untouched, but
+// note that all other documents are re-serialised, which strips
+// comments and formatting.
+func AddLabels(rs *RenderedResourceSet, labels map[string]string) error {
+	return addMetadata(rs, "labels", labels)
+}
+
+// Adds annotations to the metadata of every document in a rendered
+// resource set. Like AddLabels, annotations that are already set on a
+// resource are not overwritten.
+func AddAnnotations(rs *RenderedResourceSet, annotations map[string]string) error {
+	return addMetadata(rs, "annotations", annotations)
+}
+
+// Adds values to a map in the metadata of every document, e.g. to
+// 'metadata.labels'.
+func addMetadata(rs *RenderedResourceSet, field string, values map[string]string) error {
+	for i, r := range rs.Resources {
+		var docs []string
+		changed := false
+
+		for _, doc := range util.SplitDocuments(r.Rendered) {
+			updated, ok, err := addMetadataToDocument(doc, field, values)
+			if err != nil {
+				return fmt.Errorf("Could not add %s to %s/%s: %v", field, rs.Name, r.Filename, err)
+			}
+
+			docs = append(docs, updated)
+			changed = changed || ok
+		}
+
+		// Files without any objects are passed through as-is.
+		if changed {
+			rs.Resources[i].Rendered = joinDocuments(docs)
+		}
+	}
+
+	return nil
+}
+
+// Adds values to a metadata field of a single document and reports
+// whether it is an object that could be changed.
+func addMetadataToDocument(doc string, field string, values map[string]string) (string, bool, error) {
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(doc), &parsed); err != nil {
+		return "", false, err
+	}
+
+	object, ok := parsed.(map[string]interface{})
+	if !ok {
+		return doc, false, nil
+	}
+
+	if _, ok := object["metadata"]; !ok {
+		object["metadata"] = make(map[string]interface{})
+	}
+
+	metadata, ok := object["metadata"].(map[string]interface{})
+	if !ok {
+		return doc, false, nil
+	}
+
+	if _, ok := metadata[field]; !ok {
+		metadata[field] = make(map[string]interface{})
+	}
+
+	existing, ok := metadata[field].(map[string]interface{})
+	if !ok {
+		return "", false, fmt.Errorf("metadata.%s is not a map", field)
+	}
+
+	for k, v := range values {
+		if _, ok := existing[k]; !ok {
+			existing[k] = v
+		}
+	}
+
+	out, err := yaml.Marshal(object)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(out), true, nil
+}
+
+// Joins documents into a YAML stream, prefixing each one with a
+// document separator.
+func joinDocuments(docs []string) string {
+	var b strings.Builder
+
+	for _, doc := range docs {
+		b.WriteString("---\n")
+		b.WriteString(strings.TrimRight(doc, "\n"))
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of static checks for rendered
+// resources that do not require access to a cluster.
+
+package templater
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Renders all included resource sets and checks that every rendered
+// document is valid YAML and contains the fields required by
+// Kubernetes.
+//
+// Unlike LoadAndApplyTemplates this does not stop at the first error,
+// but returns all problems that were found.
+func LintResourceSets(include *[]string, exclude *[]string, c *context.Context) []error {
+	var problems []error
+
+	if err := validateTemplateFunctions(c); err != nil {
+		return []error{err}
+	}
+
+	sets, err := enabledResourceSets(c, *applyLimits(&c.ResourceSets, include, exclude))
+	if err != nil {
+		return []error{err}
+	}
+
+	for _, rs := range sets {
+		set, err := processResourceSet(c, &rs)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v", rs.Name, err))
+			continue
+		}
+
+		problems = append(problems, LintResourceSet(set)...)
+	}
+
+	return problems
+}
+
+// Checks the documents of a single rendered resource set.
+func LintResourceSet(rs *RenderedResourceSet) []error {
+	var problems []error
+
+	for _, r := range rs.Resources {
+		for i, doc := range util.SplitDocuments(r.Rendered) {
+			if err := lintDocument(doc); err != nil {
+				problems = append(problems, fmt.Errorf("%s/%s (document %d): %v", rs.Name, r.Filename, i+1, err))
+			}
+		}
+	}
+
+	return append(problems, DuplicateResources(rs)...)
+}
+
+// Identity of a Kubernetes object. Versions of the same API group refer
+// to the same object, so only the group is compared.
+type objectKey struct {
+	group     string
+	kind      string
+	namespace string
+	name      string
+}
+
+func (k objectKey) String() string {
+	kind := k.kind
+	if k.group != "" {
+		kind += "." + k.group
+	}
+
+	if k.namespace == "" {
+		return fmt.Sprintf("%s %s", kind, k.name)
+	}
+
+	return fmt.Sprintf("%s %s/%s", kind, k.namespace, k.name)
+}
+
+// Checks that no two documents of a rendered resource set describe the
+// same object, for example because a loop rendered the same name twice.
+// Documents without a namespace are in the namespace of the resource
+// set, and cluster-scoped objects are compared by kind and name only. Documents
+// without a name (e.g. with 'generateName') are ignored.
+func DuplicateResources(rs *RenderedResourceSet) []error {
+	var problems []error
+	var keys []objectKey
+	locations := make(map[objectKey][]string)
+
+	for _, r := range rs.Resources {
+		for i, doc := range util.SplitDocuments(r.Rendered) {
+			var object struct {
+				APIVersion string `json:"apiVersion"`
+				Kind       string `json:"kind"`
+				Metadata   struct {
+					Name      string `json:"name"`
+					Namespace string `json:"namespace"`
+				} `json:"metadata"`
+			}
+
+			if err := yaml.Unmarshal([]byte(doc), &object); err != nil || object.Kind == "" || object.Metadata.Name == "" {
+				continue
+			}
+
+			key := objectKey{
+				kind:      object.Kind,
+				namespace: object.Metadata.Namespace,
+				name:      object.Metadata.Name,
+			}
+
+			if slash := strings.Index(object.APIVersion, "/"); slash >= 0 {
+				key.group = object.APIVersion[:slash]
+			}
+
+			// Objects in the namespace of the resource set may
+			// leave out the namespace, which is also how
+			// cluster-scoped objects are identified.
+			if key.namespace == rs.Namespace {
+				key.namespace = ""
+			}
+
+			if _, ok := locations[key]; !ok {
+				keys = append(keys, key)
+			}
+
+			locations[key] = append(locations[key], fmt.Sprintf("%s (document %d)", r.Filename, i+1))
+		}
+	}
+
+	for _, key := range keys {
+		if len(locations[key]) > 1 {
+			problems = append(problems, fmt.Errorf("%s: %s is defined more than once, in %s", rs.Name, key, strings.Join(locations[key], ", ")))
+		}
+	}
+
+	return problems
+}
+
+func lintDocument(doc string) error {
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(doc), &parsed); err != nil {
+		return fmt.Errorf("invalid YAML: %v", err)
+	}
+
+	// Documents consisting only of comments are ignored by kubectl.
+	if parsed == nil {
+		return nil
+	}
+
+	object, ok := parsed.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("document is not an object")
+	}
+
+	for _, field := range []string{"apiVersion", "kind"} {
+		if value, ok := object[field].(string); !ok || value == "" {
+			return fmt.Errorf("missing required field '%s'", field)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of listing the files that each
+// resource set will render, without templating them.
+
+package templater
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tazjin/kontemplate/context"
+)
+
+// Files of a selected resource set. Disabled resource sets have no
+// files.
+type ResourceSetFiles struct {
+	Name    string
+	Path    string
+	Type    string
+	Enabled bool
+	Files   []string
+}
+
+// Lists the files of the included resource sets that would be
+// templated, in the order in which they would be rendered.
+func ListFiles(c *context.Context, include *[]string, exclude *[]string) ([]ResourceSetFiles, error) {
+	var result []ResourceSetFiles
+
+	for _, rs := range SelectResourceSets(c, include, exclude) {
+		files := ResourceSetFiles{
+			Name: rs.Name,
+			Path: rs.Path,
+			Type: rs.Type,
+		}
+
+		enabled, err := isEnabled(c, &rs)
+		if err != nil {
+			return nil, err
+		}
+
+		if enabled {
+			files.Enabled = true
+			if files.Files, err = selectedFiles(&rs); err != nil {
+				return nil, err
+			}
+		}
+
+		result = append(result, files)
+	}
+
+	return result, nil
+}
+
+func selectedFiles(rs *context.ResourceSet) ([]string, error) {
+	if err := validateType(rs); err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(rs.Path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Resource set '%s' does not exist at %s", rs.Name, absolutePath(rs.Path))
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case rs.Type == KustomizeType:
+		return []string{kustomizeOutput}, nil
+	case fileInfo.IsDir():
+		return resourceFiles(rs)
+	default:
+		return []string{filepath.Base(rs.Path)}, nil
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of partials, which are template
+// files that define named templates for use in other templates of the
+// same resource set.
+
+package templater
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sync"
+	"text/template"
+
+	"github.com/tazjin/kontemplate/context"
+)
+
+// Pattern of file names that are loaded as partials.
+const partialPattern = "_*.tpl"
+
+// Partials are parsed only once per folder and set of delimiters into a
+// base template, which is cloned for every template file. The clones
+// share the parsed partials, but each has its own template functions
+// bound to the variables of its resource set.
+var partialCache = struct {
+	sync.Mutex
+	entries map[string]*cachedPartials
+}{entries: make(map[string]*cachedPartials)}
+
+type cachedPartials struct {
+	once sync.Once
+	base *template.Template
+	err  error
+}
+
+// Returns a template containing the partials of a folder, which can be
+// used to parse a template file after setting its template functions.
+// The template functions of the cluster configuration are passed so
+// that partials can call them.
+func partialsTemplate(dir string, left string, right string, functions map[string]string) (*template.Template, error) {
+	key := dir + "\x00" + left + "\x00" + right
+
+	partialCache.Lock()
+	entry, ok := partialCache.entries[key]
+	if !ok {
+		entry = &cachedPartials{}
+		partialCache.entries[key] = entry
+	}
+	partialCache.Unlock()
+
+	entry.once.Do(func() {
+		// The functions are only needed to parse the partials and are
+		// replaced before the template is executed.
+		c := context.Context{TemplateFunctions: functions}
+		base := template.New(dir).Delims(left, right).Funcs(templateFuncs(&c, &context.ResourceSet{}))
+		base.Funcs(template.FuncMap{"include": includeFunc(base)})
+
+		if err := loadPartials(base, dir); err != nil {
+			entry.err = err
+			return
+		}
+
+		if err := rewriteDefaults(base, nil); err != nil {
+			entry.err = err
+			return
+		}
+
+		entry.base = base
+	})
+
+	if entry.err != nil {
+		return nil, entry.err
+	}
+
+	return entry.base.Clone()
+}
+
+// Discards all cached partials.
+func resetPartialCache() {
+	partialCache.Lock()
+	partialCache.entries = make(map[string]*cachedPartials)
+	partialCache.Unlock()
+}
+
+// Parses all partials in a folder into the namespace of a template, so
+// that the templates they define can be used with 'template' and
+// 'include'.
+func loadPartials(tpl *template.Template, dir string) error {
+	partials, err := globRelative(dir, partialPattern)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range partials {
+		partial := path.Join(dir, name)
+		data, err := ioutil.ReadFile(partial)
+		if err != nil {
+			return fmt.Errorf("Could not read partial %s: %v", partial, err)
+		}
+
+		if _, err = tpl.New(path.Base(partial)).Parse(string(data)); err != nil {
+			return fmt.Errorf("Could not load partial %s: %v", partial, err)
+		}
+	}
+
+	return nil
+}
+
+// Returns a function that renders a named template into a string, which
+// unlike the built-in 'template' action can be piped into other
+// functions, e.g. '{{ include "labels" . | indent 4 }}'.
+func includeFunc(tpl *template.Template) func(string, interface{}) (string, error) {
+	return func(name string, data interface{}) (string, error) {
+		var b bytes.Buffer
+		if err := tpl.ExecuteTemplate(&b, name, data); err != nil {
+			return "", err
+		}
+
+		return b.String(), nil
+	}
+}
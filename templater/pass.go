@@ -14,13 +14,14 @@ package templater
 
 import (
 	"fmt"
-	"os"
 	"os/exec"
 	"strings"
+
+	"github.com/tazjin/kontemplate/util"
 )
 
 func GetFromPass(key string) (string, error) {
-	fmt.Fprintf(os.Stderr, "Attempting to look up %s in pass\n", key)
+	util.Infof("Attempting to look up %s in pass", key)
 	pass := exec.Command("pass", "show", key)
 
 	output, err := pass.CombinedOutput()
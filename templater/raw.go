@@ -0,0 +1,38 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of raw resource sets, whose
+// files are used verbatim instead of being templated.
+
+package templater
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/tazjin/kontemplate/context"
+)
+
+// Type of resource sets whose files are not templated, e.g. vendored
+// manifests that contain '{{' themselves.
+const RawType string = "raw"
+
+// Reads a file of a raw resource set as-is.
+func readRawFile(rs *context.ResourceSet, filepath string) (RenderedResource, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return RenderedResource{}, fmt.Errorf("Could not read file %s in resource set %s: %v", filepath, rs.Name, err)
+	}
+
+	return RenderedResource{
+		Filename: path.Base(filepath),
+		Rendered: string(data),
+	}, nil
+}
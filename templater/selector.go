@@ -0,0 +1,210 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of filtering rendered resources
+// by Kubernetes label selectors.
+
+package templater
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// A single requirement of a label selector, e.g. 'app=foo' or
+// 'tier in (frontend, backend)'.
+type requirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+// Selector is a parsed label selector in the syntax used by kubectl.
+type Selector []requirement
+
+// Parses a label selector. Equality-based ('a=b', 'a==b', 'a!=b'),
+// set-based ('a in (b, c)', 'a notin (b, c)') and existence ('a', '!a')
+// requirements are supported and may be combined with commas.
+func ParseSelector(selector string) (Selector, error) {
+	var parsed Selector
+
+	for _, term := range splitSelector(selector) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		r, err := parseRequirement(term)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label selector '%s': %v", selector, err)
+		}
+
+		parsed = append(parsed, r)
+	}
+
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("Invalid label selector '%s': no requirements", selector)
+	}
+
+	return parsed, nil
+}
+
+// Splits a selector on commas that are not enclosed in parentheses.
+func splitSelector(selector string) []string {
+	var terms []string
+	depth, start := 0, 0
+
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(terms, selector[start:])
+}
+
+func parseRequirement(term string) (requirement, error) {
+	for _, op := range []string{" notin ", " in "} {
+		if idx := strings.Index(term, op); idx > 0 {
+			set := strings.TrimSpace(term[idx+len(op):])
+			if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+				return requirement{}, fmt.Errorf("values of '%s' must be enclosed in parentheses", term)
+			}
+
+			var values []string
+			for _, v := range strings.Split(set[1:len(set)-1], ",") {
+				values = append(values, strings.TrimSpace(v))
+			}
+
+			return requirement{strings.TrimSpace(term[:idx]), strings.TrimSpace(op), values}, nil
+		}
+	}
+
+	for _, op := range []string{"!=", "==", "="} {
+		if idx := strings.Index(term, op); idx > 0 {
+			operator := op
+			if op == "==" {
+				operator = "="
+			}
+
+			value := strings.TrimSpace(term[idx+len(op):])
+			return requirement{strings.TrimSpace(term[:idx]), operator, []string{value}}, nil
+		}
+	}
+
+	if strings.ContainsAny(term, "=() ") {
+		return requirement{}, fmt.Errorf("could not parse '%s'", term)
+	}
+
+	if strings.HasPrefix(term, "!") {
+		return requirement{strings.TrimPrefix(term, "!"), "!", nil}, nil
+	}
+
+	return requirement{term, "exists", nil}, nil
+}
+
+// Checks whether a set of labels fulfills all requirements of the
+// selector.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, ok := labels[r.key]
+
+		switch r.operator {
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!":
+			if ok {
+				return false
+			}
+		case "=", "in":
+			if !ok || !containsString(r.values, value) {
+				return false
+			}
+		case "!=", "notin":
+			if ok && containsString(r.values, value) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Removes all documents from a rendered resource set whose labels do
+// not match the selector. Documents that are not objects are removed
+// with a warning, and files without any remaining documents are
+// dropped entirely.
+func FilterResources(rs *RenderedResourceSet, selector Selector) error {
+	var resources []RenderedResource
+
+	for _, r := range rs.Resources {
+		var docs []string
+
+		for i, doc := range util.SplitDocuments(r.Rendered) {
+			var parsed interface{}
+			if err := yaml.Unmarshal([]byte(doc), &parsed); err != nil {
+				return fmt.Errorf("Could not parse %s/%s: %v", rs.Name, r.Filename, err)
+			}
+
+			object, ok := parsed.(map[string]interface{})
+			if !ok {
+				util.Warnf("Excluding document %d of %s/%s from selector, as it is not an object", i+1, rs.Name, r.Filename)
+				continue
+			}
+
+			if selector.Matches(documentLabels(object)) {
+				docs = append(docs, doc)
+			}
+		}
+
+		if len(docs) > 0 {
+			r.Rendered = joinDocuments(docs)
+			resources = append(resources, r)
+		}
+	}
+
+	rs.Resources = resources
+	return nil
+}
+
+func documentLabels(object map[string]interface{}) map[string]string {
+	labels := make(map[string]string)
+
+	metadata, _ := object["metadata"].(map[string]interface{})
+	existing, _ := metadata["labels"].(map[string]interface{})
+
+	for k, v := range existing {
+		labels[k] = fmt.Sprint(v)
+	}
+
+	return labels
+}
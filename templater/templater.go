@@ -11,22 +11,39 @@ package templater
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/Masterminds/sprig"
+	"github.com/ghodss/yaml"
 	"github.com/tazjin/kontemplate/context"
 	"github.com/tazjin/kontemplate/util"
 )
 
 const failOnMissingKeys string = "missingkey=error"
 
+// Version of kontemplate made available to templates. This is set by
+// the kontemplate binary.
+var Version string
+
+// Name of the variable under which built-in variables are made
+// available to templates. User variables with this name are replaced.
+const builtinVariables string = "kontemplate"
+
 type RenderedResource struct {
 	Filename string
 	Rendered string
@@ -34,56 +51,132 @@ type RenderedResource struct {
 
 type RenderedResourceSet struct {
 	Name      string
+	Namespace string
 	Resources []RenderedResource
 	Args      []string
+	Prune     *bool
+	Sensitive bool
 }
 
-func LoadAndApplyTemplates(include *[]string, exclude *[]string, c *context.Context) ([]RenderedResourceSet, error) {
+// Templates all included resource sets using a pool of at most 'jobs'
+// concurrent workers. The rendered resource sets are returned in the
+// same order as they appear in the context, regardless of the order
+// in which rendering finishes.
+func LoadAndApplyTemplates(include *[]string, exclude *[]string, c *context.Context, jobs int) ([]RenderedResourceSet, error) {
+	// Partials are cached for the duration of a single run, so that
+	// changes are picked up when embedding kontemplate as a library.
+	resetPartialCache()
+
+	if err := validateTemplateFunctions(c); err != nil {
+		return nil, err
+	}
+
 	limitedResourceSets := applyLimits(&c.ResourceSets, include, exclude)
-	renderedResourceSets := make([]RenderedResourceSet, 0)
+	sets := *limitedResourceSets
 
-	if len(*limitedResourceSets) == 0 {
-		return renderedResourceSets, fmt.Errorf("No valid resource sets included!")
+	if len(sets) == 0 {
+		return make([]RenderedResourceSet, 0), fmt.Errorf("No valid resource sets included!")
 	}
 
-	for _, rs := range *limitedResourceSets {
-		set, err := processResourceSet(c, &rs)
+	sets, err := enabledResourceSets(c, sets)
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			return nil, err
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	renderedResourceSets := make([]RenderedResourceSet, len(sets))
+	indices := make(chan int)
+	failed := make(chan struct{})
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				set, err := processResourceSet(c, &sets[i])
+				if err != nil {
+					// Template errors already name the resource set.
+					if _, ok := err.(*TemplateError); !ok {
+						err = fmt.Errorf("Error in resource set %s: %v", sets[i].Name, err)
+					}
+
+					once.Do(func() {
+						firstErr = err
+						close(failed)
+					})
+					continue
+				}
+
+				renderedResourceSets[i] = *set
+			}
+		}()
+	}
+
+	// Stop handing out work as soon as any resource set has failed
+	// to render.
+feed:
+	for i := range sets {
+		select {
+		case indices <- i:
+		case <-failed:
+			break feed
 		}
+	}
+	close(indices)
+	wg.Wait()
 
-		renderedResourceSets = append(renderedResourceSets, *set)
+	if firstErr != nil {
+		return nil, firstErr
 	}
 
 	return renderedResourceSets, nil
 }
 
 func processResourceSet(ctx *context.Context, rs *context.ResourceSet) (*RenderedResourceSet, error) {
-	fmt.Fprintf(os.Stderr, "Loading resources for %s\n", rs.Name)
+	util.Infof("Loading resources for %s", rs.Name)
+	util.Debugf("Resource set '%s' is located at %s", rs.Name, absolutePath(rs.Path))
+
+	if err := validateType(rs); err != nil {
+		return nil, err
+	}
 
 	fileInfo, err := os.Stat(rs.Path)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Resource set '%s' does not exist at %s", rs.Name, absolutePath(rs.Path))
+	} else if err != nil {
 		return nil, err
 	}
 
-	var files []os.FileInfo
 	var resources []RenderedResource
 
 	// Treat single-file resource paths separately from resource
 	// sets containing multiple templates
-	if fileInfo.IsDir() {
-		// Explicitly discard this error, which will give us an empty
-		// list of files instead.
-		// This will end up printing a warning to the user, but it
-		// won't stop the rest of the process.
-		files, _ = ioutil.ReadDir(rs.Path)
+	if rs.Type == KustomizeType {
+		resource, err := buildKustomization(rs)
+		if err != nil {
+			return nil, err
+		}
+
+		resources = []RenderedResource{resource}
+	} else if fileInfo.IsDir() {
+		files, err := resourceFiles(rs)
+		if err != nil {
+			return nil, err
+		}
+
 		resources, err = processFiles(ctx, rs, files)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		resource, err := templateFile(ctx, rs, rs.Path)
+		resource, err := renderFile(ctx, rs, rs.Path)
 		if err != nil {
 			return nil, err
 		}
@@ -93,42 +186,135 @@ func processResourceSet(ctx *context.Context, rs *context.ResourceSet) (*Rendere
 
 	return &RenderedResourceSet{
 		Name:      rs.Name,
+		Namespace: rs.Namespace,
 		Resources: resources,
-		Args:      rs.Args,
+		Args:      rs.KubectlArgs,
+		Prune:     rs.Prune,
+		Sensitive: rs.Sensitive,
 	}, nil
 }
 
-func processFiles(ctx *context.Context, rs *context.ResourceSet, files []os.FileInfo) ([]RenderedResource, error) {
+// Templates the given files of a resource set, which are relative to
+// the resource set folder.
+func processFiles(ctx *context.Context, rs *context.ResourceSet, files []string) ([]RenderedResource, error) {
 	resources := make([]RenderedResource, 0)
 
 	for _, file := range files {
-		if !file.IsDir() && isResourceFile(file) {
-			path := path.Join(rs.Path, file.Name())
-			res, err := templateFile(ctx, rs, path)
+		res, err := renderFile(ctx, rs, path.Join(rs.Path, file))
 
-			if err != nil {
-				return resources, err
+		if err != nil {
+			return resources, err
+		}
+
+		// Files in subdirectories of recursive resource sets keep
+		// their relative path.
+		res.Filename = file
+		resources = append(resources, res)
+	}
+
+	// Resources are ordered by file name so that output and the
+	// order of application do not depend on the file system.
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Filename < resources[j].Filename
+	})
+
+	return resources, nil
+}
+
+// Returns the paths of the files in a resource set folder that should
+// be templated, relative to the folder. Subdirectories are only
+// searched if the resource set is recursive.
+func resourceFiles(rs *context.ResourceSet) ([]string, error) {
+	var paths []string
+
+	ignore, err := loadIgnoreFile(rs.Path)
+	if err != nil {
+		return paths, err
+	}
+
+	addFile := func(relPath string, file os.FileInfo) error {
+		if !isResourceFile(file) || ignore.ignored(relPath, false) {
+			return nil
+		}
+
+		selected, err := isSelectedFile(rs, relPath)
+		if selected {
+			paths = append(paths, relPath)
+		}
+
+		return err
+	}
+
+	if !rs.Recursive {
+		// Explicitly discard this error, which will give us an empty
+		// list of files instead.
+		// This will end up printing a warning to the user, but it
+		// won't stop the rest of the process.
+		files, _ := ioutil.ReadDir(rs.Path)
+
+		for _, file := range files {
+			if file.IsDir() {
+				continue
 			}
 
-			resources = append(resources, res)
+			if err = addFile(file.Name(), file); err != nil {
+				return paths, err
+			}
 		}
+
+		return paths, nil
 	}
 
-	return resources, nil
+	err = filepath.Walk(rs.Path, func(p string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(rs.Path, p)
+		if err != nil || relPath == "." {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if file.IsDir() {
+			if ignore.ignored(relPath, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return addFile(relPath, file)
+	})
+
+	return paths, err
+}
+
+// Templates a file of a resource set, unless the resource set is raw.
+func renderFile(ctx *context.Context, rs *context.ResourceSet, filepath string) (RenderedResource, error) {
+	if rs.Type == RawType {
+		return readRawFile(rs, filepath)
+	}
+
+	return templateFile(ctx, rs, filepath)
 }
 
 func templateFile(ctx *context.Context, rs *context.ResourceSet, filepath string) (RenderedResource, error) {
 	var resource RenderedResource
 
-	tpl, err := template.New(path.Base(filepath)).Funcs(templateFuncs(ctx, rs)).Option(failOnMissingKeys).ParseFiles(filepath)
+	start := time.Now()
+	defer func() {
+		util.Debugf("Templated %s in %s", absolutePath(filepath), time.Since(start))
+	}()
+
+	tpl, err := parseTemplate(ctx, rs, filepath)
 	if err != nil {
-		return resource, fmt.Errorf("Could not load template %s: %v", filepath, err)
+		return resource, err
 	}
 
 	var b bytes.Buffer
-	err = tpl.Execute(&b, rs.Values)
+	err = tpl.Execute(&b, templateValues(ctx, rs))
 	if err != nil {
-		return resource, fmt.Errorf("Error while templating %s: %v", filepath, err)
+		return resource, newTemplateError(rs.Name, filepath, ExecutionError, err)
 	}
 
 	resource = RenderedResource{
@@ -139,6 +325,96 @@ func templateFile(ctx *context.Context, rs *context.ResourceSet, filepath string
 	return resource, nil
 }
 
+// Parses a template file together with the partials next to it.
+func parseTemplate(ctx *context.Context, rs *context.ResourceSet, filepath string) (*template.Template, error) {
+	left, right, err := templateDelimiters(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	partials, err := partialsTemplate(path.Dir(filepath), left, right, ctx.TemplateFunctions)
+	if err != nil {
+		return nil, err
+	}
+
+	tpl := partials.New(path.Base(filepath)).Funcs(templateFuncs(ctx, rs)).Option(failOnMissingKeys)
+	tpl.Funcs(template.FuncMap{"include": includeFunc(tpl)})
+
+	// The partials are shared with other templates and have already
+	// been rewritten.
+	shared := parsedTrees(tpl)
+
+	tpl, err = tpl.ParseFiles(filepath)
+	if err == nil {
+		err = rewriteDefaults(tpl, shared)
+	}
+
+	if err != nil {
+		return nil, newTemplateError(rs.Name, filepath, ParseError, err)
+	}
+
+	return tpl, nil
+}
+
+// Returns the template delimiters configured for a resource set. Empty
+// delimiters are replaced with the defaults by text/template.
+func templateDelimiters(rs *context.ResourceSet) (string, string, error) {
+	if rs.Delimiters == nil {
+		return "", "", nil
+	}
+
+	if len(rs.Delimiters) != 2 || rs.Delimiters[0] == "" || rs.Delimiters[1] == "" {
+		return "", "", fmt.Errorf("'delimiters' of resource set %s must be a list of a left and a right delimiter, but was %v", rs.Name, rs.Delimiters)
+	}
+
+	return rs.Delimiters[0], rs.Delimiters[1], nil
+}
+
+func absolutePath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+
+	return p
+}
+
+// Prepares the variables of a resource set for templating by adding
+// the built-in variables.
+func templateValues(ctx *context.Context, rs *context.ResourceSet) map[string]interface{} {
+	values := make(map[string]interface{}, len(rs.Values)+1)
+	for k, v := range rs.Values {
+		values[k] = v
+	}
+
+	values[builtinVariables] = map[string]interface{}{
+		"clusterName":     ctx.Name,
+		"kubeContext":     ctx.KubectlContext(),
+		"resourceSetName": rs.Name,
+		"resourceSets":    resourceSetNames(ctx),
+		"version":         Version,
+	}
+
+	return values
+}
+
+// Returns the sorted names of all resource sets in the cluster
+// configuration, regardless of which are included in a run.
+func resourceSetNames(ctx *context.Context) []string {
+	names := make([]string, 0, len(ctx.ResourceSets))
+	for _, rs := range ctx.ResourceSets {
+		names = append(names, rs.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Returns the resource sets of a context that are selected by the
+// include and exclude limits, without rendering them.
+func SelectResourceSets(c *context.Context, include *[]string, exclude *[]string) []context.ResourceSet {
+	return *applyLimits(&c.ResourceSets, include, exclude)
+}
+
 // Applies the limits of explicitly included or excluded resources and returns the updated resource set.
 // Exclude takes priority over include
 func applyLimits(rs *[]context.ResourceSet, include *[]string, exclude *[]string) *[]context.ResourceSet {
@@ -168,24 +444,66 @@ func applyLimits(rs *[]context.ResourceSet, include *[]string, exclude *[]string
 	return &included
 }
 
-// Check whether an include/exclude string slice matches a resource set
+// Check whether an include/exclude string slice matches a resource set.
+// Entries may be shell-style glob patterns (see path.Match), which are
+// matched against both the name of the resource set and its parents.
 func matchesResourceSet(s *[]string, rs *context.ResourceSet) bool {
 	for _, r := range *s {
 		r = strings.TrimSuffix(r, "/")
-		if r == rs.Name || r == rs.Parent {
+		if matchesName(r, rs.Name) || matchesName(r, rs.Parent) {
 			return true
 		}
+
+		// Resource sets nested more than one level deep are also
+		// matched by the names of all of their ancestors.
+		for ancestor := path.Dir(rs.Parent); ancestor != "." && ancestor != "/"; ancestor = path.Dir(ancestor) {
+			if matchesName(r, ancestor) {
+				return true
+			}
+		}
 	}
 
 	return false
 }
 
+func matchesName(pattern string, name string) bool {
+	if pattern == name {
+		return true
+	}
+
+	// Malformed patterns are treated as not matching, which
+	// leaves only the exact comparison above.
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
 func templateFuncs(c *context.Context, rs *context.ResourceSet) template.FuncMap {
 	m := sprig.TxtFuncMap()
 	m["json"] = func(data interface{}) string {
 		b, _ := json.Marshal(data)
 		return string(b)
 	}
+	m["toYaml"] = func(data interface{}) (string, error) {
+		b, err := yaml.Marshal(data)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSuffix(string(b), "\n"), nil
+	}
+	m["toJson"] = func(data interface{}) (string, error) {
+		b, err := json.Marshal(data)
+		return string(b), err
+	}
+	m["toToml"] = toToml
+	m["sha256sum"] = func(input string) string {
+		hash := sha256.Sum256([]byte(input))
+		return hex.EncodeToString(hash[:])
+	}
+	m["sha1sum"] = func(input string) string {
+		hash := sha1.Sum([]byte(input))
+		return hex.EncodeToString(hash[:])
+	}
 	m["passLookup"] = GetFromPass
 	m["gitHEAD"] = func() (string, error) {
 		out, err := exec.Command("git", "-C", c.BaseDir, "rev-parse", "HEAD").Output()
@@ -204,6 +522,25 @@ func templateFuncs(c *context.Context, rs *context.ResourceSet) template.FuncMap
 
 		return string(data), nil
 	}
+	m["readFile"] = func(file string) (string, error) {
+		data, err := readResourceSetFile(rs, file)
+		if err != nil {
+			return "", err
+		}
+
+		return string(data), nil
+	}
+	m["fileToBase64"] = func(file string) (string, error) {
+		data, err := readResourceSetFile(rs, file)
+		if err != nil {
+			return "", err
+		}
+
+		return base64.StdEncoding.EncodeToString(data), nil
+	}
+	m["listFiles"] = func(pattern string) ([]string, error) {
+		return listResourceSetFiles(rs, pattern)
+	}
 	m["insertTemplate"] = func(file string) (string, error) {
 		data, err := templateFile(c, rs, path.Join(rs.Path, file))
 		if err != nil {
@@ -212,16 +549,90 @@ func templateFuncs(c *context.Context, rs *context.ResourceSet) template.FuncMap
 
 		return data.Rendered, nil
 	}
-	m["default"] = func(defaultVal interface{}, varName string) interface{} {
+	// 'default' is the function of sprig, which replaces empty values.
+	// Variables can also be referred to by name, which replaces only
+	// variables that are not set at all.
+	m["defaultVar"] = func(defaultVal interface{}, varName string) interface{} {
 		if val, ok := rs.Values[varName]; ok {
 			return val
 		}
 
 		return defaultVal
 	}
+	m[optionalFieldFunc] = optionalField
+
+	addCommandFunctions(m, c, rs)
 	return m
 }
 
+// Reads a file relative to the resource set's folder for use in
+// template functions.
+func readResourceSetFile(rs *context.ResourceSet, file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path.Join(rs.Path, file))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read file %s in resource set %s: %v", file, rs.Name, err)
+	}
+
+	return data, nil
+}
+
+// Lists the files in the resource set's folder that match the given
+// glob pattern. Paths are returned relative to the resource set in
+// sorted order.
+func listResourceSetFiles(rs *context.ResourceSet, pattern string) ([]string, error) {
+	files, err := globRelative(rs.Path, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid file pattern %q in resource set %s: %v", pattern, rs.Name, err)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// Lists the files in a folder that match a glob pattern, like
+// filepath.Glob, and returns them relative to the folder. Unlike
+// joining the folder and the pattern, characters such as '[' in the
+// name of the folder itself are not treated as part of the pattern.
+func globRelative(dir string, pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	matches := []string{""}
+	for _, segment := range strings.Split(path.Clean(pattern), "/") {
+		var next []string
+		for _, match := range matches {
+			if !strings.ContainsAny(segment, `*?[\`) {
+				next = append(next, path.Join(match, segment))
+				continue
+			}
+
+			// As with filepath.Glob, folders that can not be read
+			// have no matches.
+			entries, err := ioutil.ReadDir(path.Join(dir, match))
+			if err != nil {
+				continue
+			}
+
+			for _, entry := range entries {
+				if ok, _ := filepath.Match(segment, entry.Name()); ok {
+					next = append(next, path.Join(match, entry.Name()))
+				}
+			}
+		}
+		matches = next
+	}
+
+	var files []string
+	for _, match := range matches {
+		if _, err := os.Lstat(path.Join(dir, match)); err == nil {
+			files = append(files, match)
+		}
+	}
+
+	return files, nil
+}
+
 // Checks whether a file is a resource file (i.e. is YAML or JSON) and not a default values file.
 func isResourceFile(f os.FileInfo) bool {
 	for _, defaultFile := range util.DefaultFilenames {
@@ -234,3 +645,47 @@ func isResourceFile(f os.FileInfo) bool {
 		strings.HasSuffix(f.Name(), "yml") ||
 		strings.HasSuffix(f.Name(), "json")
 }
+
+// Checks whether a file in a resource set folder is selected for
+// templating by the file include and exclude patterns of the resource
+// set. The name is relative to the resource set folder.
+func isSelectedFile(rs *context.ResourceSet, name string) (bool, error) {
+	base := path.Base(name)
+	if rs.SkipPrefixedFiles && (strings.HasPrefix(base, "_") || strings.HasPrefix(base, ".")) {
+		return false, nil
+	}
+
+	excluded, err := matchesAnyFile(rs.ExcludeFiles, name)
+	if err != nil || excluded {
+		return false, err
+	}
+
+	if len(rs.IncludeFiles) == 0 {
+		return true, nil
+	}
+
+	return matchesAnyFile(rs.IncludeFiles, name)
+}
+
+// Patterns without a slash match files in any directory by their base
+// name, patterns with a slash match the path relative to the resource
+// set folder.
+func matchesAnyFile(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+
+		matched, err := path.Match(pattern, target)
+		if err != nil {
+			return false, fmt.Errorf("Invalid file pattern '%s': %v", pattern, err)
+		}
+
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -10,10 +10,17 @@
 package templater
 
 import (
+	"fmt"
 	"github.com/tazjin/kontemplate/context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"text/template"
+	"time"
 )
 
 func TestApplyNoLimits(t *testing.T) {
@@ -203,3 +210,1700 @@ func TestInsertTemplateFunction(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestReadFileFunctions(t *testing.T) {
+	ctx := context.Context{}
+	resourceSet := context.ResourceSet{
+		Path: "testdata",
+	}
+
+	res, err := templateFile(&ctx, &resourceSet, "testdata/test-readFile.txt")
+
+	if err != nil {
+		t.Error(err)
+		t.Errorf("Templating with readFile calls should have succeeded.\n")
+		t.Fail()
+	}
+
+	expected := "cert: LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCg==\nraw: -----BEGIN CERTIFICATE-----\n"
+	if res.Rendered != expected {
+		t.Error("Result does not contain expected file contents.")
+		t.Error(res.Rendered)
+		t.Fail()
+	}
+}
+
+func TestReadFileMissing(t *testing.T) {
+	ctx := context.Context{}
+	resourceSet := context.ResourceSet{
+		Name: "test-set",
+		Path: "testdata",
+	}
+
+	_, err := templateFile(&ctx, &resourceSet, "testdata/test-readFile-missing.txt")
+
+	if err == nil {
+		t.Errorf("Template reading a missing file should have failed.\n")
+		t.FailNow()
+	}
+
+	if !strings.Contains(err.Error(), "Could not read file does-not-exist.pem in resource set test-set") {
+		t.Errorf("Templating failed with unexpected error: %v\n", err)
+	}
+}
+
+func TestParallelTemplatingOrder(t *testing.T) {
+	ctx := context.Context{}
+	for i := 0; i < 20; i++ {
+		ctx.ResourceSets = append(ctx.ResourceSets, context.ResourceSet{
+			Name: fmt.Sprintf("set-%d", i),
+			Path: "testdata/test-default.txt",
+		})
+	}
+
+	result, err := LoadAndApplyTemplates(&[]string{}, &[]string{}, &ctx, 4)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	for i, rs := range result {
+		if rs.Name != ctx.ResourceSets[i].Name {
+			t.Errorf("Resource set at position %d has unexpected name %s", i, rs.Name)
+		}
+	}
+}
+
+func TestParallelTemplatingError(t *testing.T) {
+	ctx := context.Context{
+		ResourceSets: []context.ResourceSet{
+			{
+				Name: "working-set",
+				Path: "testdata/test-default.txt",
+			},
+			{
+				Name: "broken-set",
+				Path: "testdata/test-template.txt",
+			},
+		},
+	}
+
+	_, err := LoadAndApplyTemplates(&[]string{}, &[]string{}, &ctx, 2)
+	if err == nil {
+		t.Errorf("Templating a broken resource set should have failed.\n")
+		t.FailNow()
+	}
+
+	if !strings.Contains(err.Error(), "broken-set") || !strings.Contains(err.Error(), "test-template.txt") {
+		t.Errorf("Templating failed with unexpected error: %v\n", err)
+	}
+}
+
+func TestApplyGlobLimits(t *testing.T) {
+	resources := []context.ResourceSet{
+		{
+			Name: "frontend-web",
+		},
+		{
+			Name: "frontend-api",
+		},
+		{
+			Name: "backend-worker",
+		},
+		{
+			Name:   "monitoring/grafana",
+			Parent: "monitoring",
+		},
+		{
+			Name:   "monitoring/prometheus",
+			Parent: "monitoring",
+		},
+	}
+
+	include := []string{"frontend-*", "monitoring/*"}
+	exclude := []string{"*/prometheus"}
+
+	result := applyLimits(&resources, &include, &exclude)
+
+	expected := []context.ResourceSet{
+		{
+			Name: "frontend-web",
+		},
+		{
+			Name: "frontend-api",
+		},
+		{
+			Name:   "monitoring/grafana",
+			Parent: "monitoring",
+		},
+	}
+
+	if !reflect.DeepEqual(expected, *result) {
+		t.Error("Result does not contain expected resource sets.")
+		t.Errorf("Expected: %v\nResult: %v\n", expected, *result)
+		t.Fail()
+	}
+}
+
+func TestListFilesFunction(t *testing.T) {
+	ctx := context.Context{}
+	resourceSet := context.ResourceSet{
+		Path: "testdata",
+	}
+
+	res, err := templateFile(&ctx, &resourceSet, "testdata/test-listFiles.txt")
+
+	if err != nil {
+		t.Error(err)
+		t.Errorf("Templating with a listFiles call should have succeeded.\n")
+		t.Fail()
+	}
+
+	if res.Rendered != "conf/a.conf: b=2\nconf/b.conf: a=1\n" {
+		t.Error("Result does not contain expected file listing.")
+		t.Error(res.Rendered)
+		t.Fail()
+	}
+}
+
+func TestListFilesWithSpecialCharactersInPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontemplate-[set]*")
+	if err != nil {
+		t.Fatalf("Could not create resource set folder: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "conf"), 0775)
+	for _, file := range []string{"conf/a.conf", "conf/b.conf", "conf/c.txt", "_helpers.tpl"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("{{ define \"x\" }}{{ end }}"), 0664); err != nil {
+			t.Fatalf("Could not write %s: %v\n", file, err)
+		}
+	}
+
+	resourceSet := context.ResourceSet{
+		Name: "test-set",
+		Path: dir,
+	}
+
+	files, err := listResourceSetFiles(&resourceSet, "conf/*.conf")
+	if err != nil || !reflect.DeepEqual([]string{"conf/a.conf", "conf/b.conf"}, files) {
+		t.Errorf("Expected files in a folder named %s to be listed, but got %v (%v)\n", dir, files, err)
+	}
+
+	files, err = listResourceSetFiles(&resourceSet, "*/[a-b].conf")
+	if err != nil || !reflect.DeepEqual([]string{"conf/a.conf", "conf/b.conf"}, files) {
+		t.Errorf("Expected pattern with a wildcard folder to match, but got %v (%v)\n", files, err)
+	}
+
+	tpl := template.New("test")
+	if err := loadPartials(tpl, dir); err != nil || tpl.Lookup("_helpers.tpl") == nil {
+		t.Errorf("Expected partials in a folder named %s to be loaded (%v)\n", dir, err)
+	}
+}
+
+func TestListFilesMalformedPattern(t *testing.T) {
+	resourceSet := context.ResourceSet{
+		Name: "test-set",
+		Path: "testdata",
+	}
+
+	_, err := listResourceSetFiles(&resourceSet, "conf/[")
+	if err == nil {
+		t.Error("Listing files with a malformed pattern should have failed.")
+	}
+}
+
+func TestHashFunctions(t *testing.T) {
+	ctx := context.Context{}
+	resourceSet := context.ResourceSet{
+		Path: "testdata",
+	}
+
+	res, err := templateFile(&ctx, &resourceSet, "testdata/test-hash.txt")
+
+	if err != nil {
+		t.Error(err)
+		t.Errorf("Templating with hash functions should have succeeded.\n")
+		t.Fail()
+	}
+
+	expected := "sha256: 9bc63f3e495030aa3f5f79539e766bf76251cf19dde377a844e5f4f5d1a14bb8\nsha1: 7aaa6be44c9cc4decfe8836578ce3639bcc3ed99\n"
+	if res.Rendered != expected {
+		t.Error("Result does not contain expected hashes.")
+		t.Error(res.Rendered)
+		t.Fail()
+	}
+}
+
+func TestAddLabels(t *testing.T) {
+	rs := RenderedResourceSet{
+		Name: "test-set",
+		Resources: []RenderedResource{
+			{
+				Filename: "multi.yaml",
+				Rendered: "---\nkind: ConfigMap\nmetadata:\n  name: test\n  labels:\n    team: existing\n---\nkind: Service\n",
+			},
+			{
+				Filename: "list.yaml",
+				Rendered: "- not\n- an object\n",
+			},
+			{
+				Filename: "empty.yaml",
+				Rendered: "# nothing to see here\n",
+			},
+		},
+	}
+
+	labels := map[string]string{
+		"team": "payments",
+		"env":  "prod",
+	}
+
+	if err := AddLabels(&rs, labels); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := []string{
+		"---\nkind: ConfigMap\nmetadata:\n  labels:\n    env: prod\n    team: existing\n  name: test\n---\nkind: Service\nmetadata:\n  labels:\n    env: prod\n    team: payments\n",
+		"- not\n- an object\n",
+		"# nothing to see here\n",
+	}
+
+	for i, r := range rs.Resources {
+		if r.Rendered != expected[i] {
+			t.Errorf("Labels were added incorrectly to %s:\n%s", r.Filename, r.Rendered)
+		}
+	}
+}
+
+func TestAddAnnotations(t *testing.T) {
+	rs := RenderedResourceSet{
+		Name: "test-set",
+		Resources: []RenderedResource{
+			{
+				Filename: "multi.yaml",
+				Rendered: "---\nkind: ConfigMap\nmetadata:\n  name: test\n  annotations:\n    owner: existing\n---\nkind: Service\n",
+			},
+			{
+				Filename: "invalid.yaml",
+				Rendered: "kind: Secret\nmetadata:\n  annotations: none\n",
+			},
+		},
+	}
+
+	annotations := map[string]string{
+		"owner":  "infra",
+		"commit": "abc123",
+	}
+
+	err := AddAnnotations(&rs, annotations)
+	if err == nil || !strings.Contains(err.Error(), "test-set/invalid.yaml: metadata.annotations is not a map") {
+		t.Errorf("Expected invalid annotations to fail, got %v\n", err)
+	}
+
+	expected := "---\nkind: ConfigMap\nmetadata:\n  annotations:\n    commit: abc123\n    owner: existing\n  name: test\n---\nkind: Service\nmetadata:\n  annotations:\n    commit: abc123\n    owner: infra\n"
+	if rs.Resources[0].Rendered != expected {
+		t.Errorf("Annotations were added incorrectly:\n%s", rs.Resources[0].Rendered)
+	}
+}
+
+func TestLintResourceSet(t *testing.T) {
+	rs := RenderedResourceSet{
+		Name: "test-set",
+		Resources: []RenderedResource{
+			{
+				Filename: "valid.yaml",
+				Rendered: "---\n# comment only\n---\napiVersion: v1\nkind: ConfigMap\n",
+			},
+			{
+				Filename: "invalid.yaml",
+				Rendered: "---\napiVersion: v1\nkind: Service\n---\nkind: Service\n---\napiVersion: v1\n kind: [\n",
+			},
+		},
+	}
+
+	problems := LintResourceSet(&rs)
+
+	if len(problems) != 2 {
+		t.Errorf("Expected 2 problems, but found %d: %v", len(problems), problems)
+		t.FailNow()
+	}
+
+	if !strings.Contains(problems[0].Error(), "test-set/invalid.yaml (document 2): missing required field 'apiVersion'") {
+		t.Errorf("Unexpected problem: %v", problems[0])
+	}
+
+	if !strings.Contains(problems[1].Error(), "test-set/invalid.yaml (document 3): invalid YAML") {
+		t.Errorf("Unexpected problem: %v", problems[1])
+	}
+}
+
+func TestDuplicateResources(t *testing.T) {
+	rs := RenderedResourceSet{
+		Name:      "test-set",
+		Namespace: "default",
+		Resources: []RenderedResource{
+			{
+				Filename: "deployments.yaml",
+				Rendered: `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+---
+apiVersion: apps/v1beta2
+kind: Deployment
+metadata:
+  name: api
+  namespace: default
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  namespace: staging
+`,
+			},
+			{
+				Filename: "cluster.yaml",
+				Rendered: `---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: reader
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: api
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  generateName: job-
+`,
+			},
+			{
+				Filename: "more.yaml",
+				Rendered: "apiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n  name: reader\n---\napiVersion: v1\nkind: Pod\nmetadata:\n  generateName: job-\n",
+			},
+		},
+	}
+
+	problems := DuplicateResources(&rs)
+	if len(problems) != 2 {
+		t.Fatalf("Expected 2 duplicates, but found %d: %v\n", len(problems), problems)
+	}
+
+	expected := "test-set: Deployment.apps api is defined more than once, in deployments.yaml (document 1), deployments.yaml (document 2)"
+	if problems[0].Error() != expected {
+		t.Errorf("Unexpected problem: %v\n", problems[0])
+	}
+
+	expected = "test-set: ClusterRole.rbac.authorization.k8s.io reader is defined more than once, in cluster.yaml (document 1), more.yaml (document 1)"
+	if problems[1].Error() != expected {
+		t.Errorf("Unexpected problem: %v\n", problems[1])
+	}
+
+	if lint := LintResourceSet(&rs); len(lint) != 2 {
+		t.Errorf("Expected duplicates to be reported by lint, got %v\n", lint)
+	}
+}
+
+func TestPipedDefaultTemplateFunction(t *testing.T) {
+	ctx := context.Context{}
+	resourceSet := context.ResourceSet{
+		Values: map[string]interface{}{
+			"replicas": float64(5),
+			"unset":    nil,
+			"zero":     float64(0),
+			"image":    "redis",
+			"empty":    "",
+			"enabled":  false,
+			"config":   map[string]interface{}{},
+		},
+	}
+
+	res, err := templateFile(&ctx, &resourceSet, "testdata/test-default-piped.txt")
+
+	if err != nil {
+		t.Error(err)
+		t.Errorf("Templating with piped default values should have succeeded.\n")
+		t.FailNow()
+	}
+
+	expected := "replicas: 5\nunset: 3\nmissing: 3\nnested: none\nzero: 3\nimage: redis\nempty: nginx\nenabled: true\nargument: 3\nnamed: 5\n"
+	if res.Rendered != expected {
+		t.Error("Result does not contain expected rendered default values.")
+		t.Error(res.Rendered)
+		t.Fail()
+	}
+}
+
+func TestSprigFunctions(t *testing.T) {
+	ctx := context.Context{}
+	resourceSet := context.ResourceSet{
+		Values: map[string]interface{}{
+			"name": "Some-API-app",
+			"labels": map[string]interface{}{
+				"team": "payments",
+				"app":  "some-api",
+			},
+			"resources": map[string]interface{}{
+				"limits": map[string]interface{}{
+					"memory": "128Mi",
+					"cpu":    "500m",
+				},
+			},
+		},
+	}
+
+	res, err := templateFile(&ctx, &resourceSet, "testdata/test-sprig.yaml")
+
+	if err != nil {
+		t.Error(err)
+		t.Errorf("Templating with sprig functions should have succeeded.\n")
+		t.FailNow()
+	}
+
+	expected := `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: some-api
+  labels:
+    app: some-api
+    team: payments
+spec:
+  template:
+    spec:
+      containers:
+        - name: "Some-API-app"
+          resources:
+            limits:
+              cpu: 500m
+              memory: 128Mi
+`
+
+	if res.Rendered != expected {
+		t.Error("Result does not contain expected rendered manifest.")
+		t.Error(res.Rendered)
+		t.Fail()
+	}
+}
+
+func TestBuiltinVariables(t *testing.T) {
+	Version = "1.2.3"
+	ctx := context.Context{
+		Name:        "k8s.prod.mydomain.com",
+		KubeContext: "gke_prod_europe-west1",
+		ResourceSets: []context.ResourceSet{
+			{Name: "monitoring/prometheus"},
+			{Name: "api"},
+			{Name: "monitoring/grafana"},
+		},
+	}
+	resourceSet := context.ResourceSet{
+		Name: "monitoring/grafana",
+		Values: map[string]interface{}{
+			"kontemplate": "overwritten",
+		},
+	}
+
+	res, err := templateFile(&ctx, &resourceSet, "testdata/test-builtins.txt")
+
+	if err != nil {
+		t.Error(err)
+		t.Errorf("Templating with built-in variables should have succeeded.\n")
+		t.FailNow()
+	}
+
+	expected := "cluster: k8s.prod.mydomain.com\nkubeContext: gke_prod_europe-west1\nset: monitoring/grafana\nversion: 1.2.3\nsets: api,monitoring/grafana,monitoring/prometheus\n"
+	if res.Rendered != expected {
+		t.Error("Result does not contain expected built-in variables.")
+		t.Error(res.Rendered)
+		t.Fail()
+	}
+}
+
+func TestApplyLimitsDeeplyNested(t *testing.T) {
+	resources := []context.ResourceSet{
+		{
+			Name:   "platform/monitoring/grafana",
+			Parent: "platform/monitoring",
+		},
+		{
+			Name:   "platform/logging/loki",
+			Parent: "platform/logging",
+		},
+		{
+			Name: "other",
+		},
+	}
+
+	result := applyLimits(&resources, &[]string{"platform"}, &[]string{"platform/logging"})
+
+	expected := []context.ResourceSet{
+		{
+			Name:   "platform/monitoring/grafana",
+			Parent: "platform/monitoring",
+		},
+	}
+
+	if !reflect.DeepEqual(expected, *result) {
+		t.Error("Result does not contain expected resource sets.")
+		t.Errorf("Expected: %v\nResult: %v\n", expected, *result)
+		t.Fail()
+	}
+}
+
+func TestMissingResourceSet(t *testing.T) {
+	ctx := context.Context{
+		ResourceSets: []context.ResourceSet{
+			{
+				Name: "typo-set",
+				Path: "testdata/does-not-exist",
+			},
+		},
+	}
+
+	_, err := LoadAndApplyTemplates(&[]string{}, &[]string{}, &ctx, 1)
+	if err == nil {
+		t.Error("Templating a missing resource set should have failed.")
+		t.FailNow()
+	}
+
+	abs, _ := filepath.Abs("testdata/does-not-exist")
+	if !strings.Contains(err.Error(), "Resource set 'typo-set' does not exist at "+abs) {
+		t.Errorf("Templating failed with unexpected error: %v\n", err)
+	}
+}
+
+func TestResourceSetFileFilters(t *testing.T) {
+	cases := []struct {
+		rs       context.ResourceSet
+		expected []string
+	}{
+		{
+			rs: context.ResourceSet{
+				SkipPrefixedFiles: true,
+			},
+			expected: []string{"configmap.yaml", "secret.yml", "service.yaml"},
+		},
+		{
+			rs: context.ResourceSet{
+				SkipPrefixedFiles: true,
+				ExcludeFiles:      []string{"secret.*"},
+			},
+			expected: []string{"configmap.yaml", "service.yaml"},
+		},
+		{
+			rs: context.ResourceSet{
+				IncludeFiles: []string{"*.yml", "service.yaml"},
+			},
+			expected: []string{"secret.yml", "service.yaml"},
+		},
+	}
+
+	for _, c := range cases {
+		c.rs.Name = "file-filters"
+		c.rs.Path = "testdata/file-filters"
+
+		result, err := processResourceSet(&context.Context{}, &c.rs)
+		if err != nil {
+			t.Errorf("Unexpected error templating %+v: %v\n", c.rs, err)
+			continue
+		}
+
+		var files []string
+		for _, r := range result.Resources {
+			files = append(files, r.Filename)
+		}
+
+		if !reflect.DeepEqual(c.expected, files) {
+			t.Errorf("Expected files %v to be templated, but got %v\n", c.expected, files)
+		}
+	}
+}
+
+func TestResourceSetFileFiltersMalformedPattern(t *testing.T) {
+	rs := context.ResourceSet{
+		Name:         "file-filters",
+		Path:         "testdata/file-filters",
+		ExcludeFiles: []string{"[secret"},
+	}
+
+	_, err := processResourceSet(&context.Context{}, &rs)
+	if err == nil || !strings.Contains(err.Error(), "Invalid file pattern") {
+		t.Errorf("Expected malformed file pattern to fail, but got %v\n", err)
+	}
+}
+
+func TestWorkloads(t *testing.T) {
+	rs := RenderedResourceSet{
+		Name:      "some-api",
+		Namespace: "api",
+		Resources: []RenderedResource{
+			{
+				Filename: "deployment.yaml",
+				Rendered: "kind: Deployment\nmetadata:\n  name: api\n---\nkind: Service\nmetadata:\n  name: api\n",
+			},
+			{
+				Filename: "workers.yaml",
+				Rendered: "kind: StatefulSet\nmetadata:\n  name: worker\n  namespace: jobs\n---\nkind: DaemonSet\nmetadata:\n  name: agent\n",
+			},
+		},
+	}
+
+	expected := []Workload{
+		{Kind: "Deployment", Name: "api", Namespace: "api"},
+		{Kind: "StatefulSet", Name: "worker", Namespace: "jobs"},
+		{Kind: "DaemonSet", Name: "agent", Namespace: "api"},
+	}
+
+	result := Workloads(&rs)
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected workloads %v, but got %v\n", expected, result)
+	}
+}
+
+func TestResourcesAreSortedByFilename(t *testing.T) {
+	rs := context.ResourceSet{
+		Name:         "file-filters",
+		Path:         "testdata/file-filters",
+		ExcludeFiles: []string{"_*", ".*"},
+	}
+
+	files, err := resourceFiles(&rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"configmap.yaml", "secret.yml", "service.yaml"}
+
+	for i := 0; i < 10; i++ {
+		rand.Shuffle(len(files), func(i, j int) {
+			files[i], files[j] = files[j], files[i]
+		})
+
+		resources, err := processFiles(&context.Context{}, &rs, files)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+
+		var result []string
+		for _, r := range resources {
+			result = append(result, r.Filename)
+		}
+
+		if !reflect.DeepEqual(expected, result) {
+			t.Errorf("Expected resources in order %v, but got %v\n", expected, result)
+		}
+	}
+}
+
+func TestLabelSelectors(t *testing.T) {
+	labels := map[string]string{
+		"app":  "api",
+		"tier": "backend",
+	}
+
+	cases := map[string]bool{
+		"app=api":                     true,
+		"app==api":                    true,
+		"app!=api":                    false,
+		"app=api,tier=frontend":       false,
+		"tier in (frontend, backend)": true,
+		"tier notin (backend)":        false,
+		"app":                         true,
+		"!canary":                     true,
+		"!app":                        false,
+		"canary!=true":                true,
+	}
+
+	for selector, expected := range cases {
+		parsed, err := ParseSelector(selector)
+		if err != nil {
+			t.Errorf("Unexpected error parsing selector '%s': %v\n", selector, err)
+			continue
+		}
+
+		if parsed.Matches(labels) != expected {
+			t.Errorf("Expected selector '%s' to match: %v\n", selector, expected)
+		}
+	}
+
+	for _, invalid := range []string{"", "app in frontend", "a b"} {
+		if _, err := ParseSelector(invalid); err == nil {
+			t.Errorf("Expected invalid selector '%s' to return an error\n", invalid)
+		}
+	}
+}
+
+func TestFilterResources(t *testing.T) {
+	rs := RenderedResourceSet{
+		Name: "some-api",
+		Resources: []RenderedResource{
+			{
+				Filename: "deployment.yaml",
+				Rendered: "kind: Deployment\nmetadata:\n  labels:\n    app: api\n---\nkind: Service\nmetadata:\n  labels:\n    app: web\n",
+			},
+			{
+				Filename: "other.yaml",
+				Rendered: "kind: ConfigMap\n---\n- not an object\n",
+			},
+		},
+	}
+
+	selector, _ := ParseSelector("app=api")
+	if err := FilterResources(&rs, selector); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []RenderedResource{
+		{
+			Filename: "deployment.yaml",
+			Rendered: "---\nkind: Deployment\nmetadata:\n  labels:\n    app: api\n",
+		},
+	}
+
+	if !reflect.DeepEqual(expected, rs.Resources) {
+		t.Errorf("Unexpected filtered resources: %v\n", rs.Resources)
+	}
+}
+
+func TestPartials(t *testing.T) {
+	rs := context.ResourceSet{
+		Name: "partials",
+		Path: "testdata/partials",
+		Values: map[string]interface{}{
+			"name": "api",
+			"tier": "backend",
+		},
+	}
+
+	result, err := processResourceSet(&context.Context{}, &rs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if len(result.Resources) != 1 {
+		t.Fatalf("Expected partials not to be rendered as resources, but got %v\n", result.Resources)
+	}
+
+	expected := "metadata:\n  labels:\n    app: api\n    tier: backend\nspec:\n  selector:\napp: api\ntier: backend\n"
+	if result.Resources[0].Rendered != expected {
+		t.Errorf("Unexpected rendered template with partials:\n%s\n", result.Resources[0].Rendered)
+	}
+}
+
+func TestKubectlArgs(t *testing.T) {
+	rs := context.ResourceSet{
+		Name:        "conf",
+		Path:        "testdata/conf",
+		KubectlArgs: []string{"--force-conflicts", "--record"},
+	}
+
+	result, err := processResourceSet(&context.Context{}, &rs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if !reflect.DeepEqual(rs.KubectlArgs, result.Args) {
+		t.Errorf("Expected kubectl args to be passed on, got %v\n", result.Args)
+	}
+}
+
+func TestSharedPartialsAreParsedOnce(t *testing.T) {
+	resetPartialCache()
+
+	first, err := partialsTemplate("testdata/shared-partials", "", "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	second, err := partialsTemplate("testdata/shared-partials", "", "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if first == second {
+		t.Errorf("Expected every caller to receive its own clone of the partials\n")
+	}
+
+	if first.Lookup("_helpers.tpl").Tree != second.Lookup("_helpers.tpl").Tree {
+		t.Errorf("Expected partials to be parsed only once\n")
+	}
+}
+
+func TestSharedPartialsUseResourceSetVariables(t *testing.T) {
+	resetPartialCache()
+
+	for _, owner := range []string{"team-a", "team-b"} {
+		rs := context.ResourceSet{
+			Name:   owner,
+			Path:   "testdata/shared-partials",
+			Values: map[string]interface{}{"owner": owner},
+		}
+
+		result, err := processResourceSet(&context.Context{}, &rs)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+
+		expected := "metadata:\n  annotations:\n    owner: " + owner + "\n"
+		if result.Resources[0].Rendered != expected {
+			t.Errorf("Expected partial to use the variables of resource set %s, but got:\n%s\n", owner, result.Resources[0].Rendered)
+		}
+	}
+}
+
+func BenchmarkParseTemplate(b *testing.B) {
+	rs := context.ResourceSet{Name: "partials", Path: "testdata/partials"}
+	resetPartialCache()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := parseTemplate(&context.Context{}, &rs, "testdata/partials/deployment.yaml"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseTemplateWithoutCache(b *testing.B) {
+	rs := context.ResourceSet{Name: "partials", Path: "testdata/partials"}
+
+	for i := 0; i < b.N; i++ {
+		resetPartialCache()
+		if _, err := parseTemplate(&context.Context{}, &rs, "testdata/partials/deployment.yaml"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBrokenPartial(t *testing.T) {
+	rs := context.ResourceSet{
+		Name: "broken-partials",
+		Path: "testdata/broken-partials",
+	}
+
+	_, err := processResourceSet(&context.Context{}, &rs)
+	if err == nil || !strings.Contains(err.Error(), "_broken.tpl") {
+		t.Errorf("Expected error naming the broken partial, but got %v\n", err)
+	}
+}
+
+func TestIgnoreFile(t *testing.T) {
+	rs := context.ResourceSet{
+		Name: "ignore",
+		Path: "testdata/ignore",
+	}
+
+	result, err := processResourceSet(&context.Context{}, &rs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	var files []string
+	for _, r := range result.Resources {
+		files = append(files, r.Filename)
+	}
+
+	expected := []string{"configmap.yaml", "fixture-service.yaml"}
+	if !reflect.DeepEqual(expected, files) {
+		t.Errorf("Expected files %v to be templated, but got %v\n", expected, files)
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	var rules ignoreRules
+	for _, line := range []string{"# comment", "", "*.tpl", "fixtures/", "/vendor/*.yaml", "docs/**/*.yaml", "!docs/keep/*.yaml", "!fixtures/keep.yaml"} {
+		if rule, ok, err := parseIgnoreRule(line); err != nil {
+			t.Fatalf("Unexpected error parsing '%s': %v\n", line, err)
+		} else if ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	cases := map[string]bool{
+		"deployment.yaml":          false,
+		"_helpers.tpl":             true,
+		"nested/_helpers.tpl":      true,
+		"fixtures/secret.yaml":     true,
+		"nested/fixtures/foo.yaml": true,
+		"fixtures/keep.yaml":       true, // parent directory is ignored
+		"fixtures":                 false,
+		"vendor/lib.yaml":          true,
+		"nested/vendor/lib.yaml":   false,
+		"docs/example.yaml":        true,
+		"docs/a/b/example.yaml":    true,
+		"docs/keep/example.yaml":   false,
+		"docs/keep/nested/ex.yaml": true,
+	}
+
+	for p, expected := range cases {
+		if result := rules.ignored(p, false); result != expected {
+			t.Errorf("Expected ignored(%s) to be %v, but got %v\n", p, expected, result)
+		}
+	}
+
+	if !rules.ignored("fixtures", true) {
+		t.Error("Expected directory pattern to match directory")
+	}
+}
+
+func TestEnabledConditions(t *testing.T) {
+	values := map[string]interface{}{
+		"debugTools": true,
+		"env":        "prod",
+		"replicas":   3,
+	}
+
+	cases := []struct {
+		condition interface{}
+		expected  bool
+	}{
+		{nil, true},
+		{false, false},
+		{"debugTools", true},
+		{".debugTools", true},
+		{`{{ eq .env "dev" }}`, false},
+		{`{{ not (eq .env "dev") }}`, true},
+	}
+
+	for _, c := range cases {
+		rs := context.ResourceSet{Name: "test", Values: values, Enabled: c.condition}
+		enabled, err := isEnabled(&context.Context{}, &rs)
+		if err != nil {
+			t.Errorf("Unexpected error for condition %v: %v\n", c.condition, err)
+		} else if enabled != c.expected {
+			t.Errorf("Expected condition %v to be %v, but got %v\n", c.condition, c.expected, enabled)
+		}
+	}
+
+	for _, condition := range []interface{}{"replicas", "missing", "{{ .env }}", 42} {
+		rs := context.ResourceSet{Name: "test", Values: values, Enabled: condition}
+		if _, err := isEnabled(&context.Context{}, &rs); err == nil {
+			t.Errorf("Expected invalid condition %v to fail\n", condition)
+		}
+	}
+}
+
+func TestDisabledResourceSetsAreSkipped(t *testing.T) {
+	ctx := context.Context{
+		ResourceSets: []context.ResourceSet{
+			{Name: "enabled", Path: "testdata/test-default.txt"},
+			{Name: "disabled", Path: "testdata/test-default.txt", Enabled: false},
+		},
+	}
+
+	result, err := LoadAndApplyTemplates(&[]string{}, &[]string{}, &ctx, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if len(result) != 1 || result[0].Name != "enabled" {
+		t.Errorf("Expected only enabled resource set to be templated, but got %v\n", result)
+	}
+}
+
+func TestEncodingFunctions(t *testing.T) {
+	ctx := context.Context{}
+	resourceSet := context.ResourceSet{
+		Values: map[string]interface{}{
+			"appConfig": map[string]interface{}{
+				"name":    "api",
+				"port":    float64(8080),
+				"workers": []interface{}{"a", "b"},
+			},
+		},
+	}
+
+	res, err := templateFile(&ctx, &resourceSet, "testdata/test-encoding.txt")
+	if err != nil {
+		t.Fatalf("Templating with encoding functions should have succeeded: %v\n", err)
+	}
+
+	expected := `data:
+  config.json: {"name":"api","port":8080,"workers":["a","b"]}
+  config.toml: |
+    name = "api"
+    port = 8080
+    workers = ["a", "b"]
+`
+	if res.Rendered != expected {
+		t.Errorf("Unexpected rendered encodings:\n%s\n", res.Rendered)
+	}
+}
+
+func TestToToml(t *testing.T) {
+	data := map[string]interface{}{
+		"title":   "Example \"config\"",
+		"ratio":   0.5,
+		"enabled": true,
+		"server": map[string]interface{}{
+			"hosts": []interface{}{"a.example.com"},
+			"tls":   map[string]interface{}{"cert.pem": "/etc/tls"},
+		},
+		"backends": []interface{}{
+			map[string]interface{}{"name": "one", "weight": 1},
+			map[string]interface{}{"name": "two", "weight": 2},
+		},
+		"mixed": []interface{}{1, map[string]interface{}{"inline": "table"}},
+	}
+
+	result, err := toToml(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := `enabled = true
+mixed = [1, {inline = "table"}]
+ratio = 0.5
+title = "Example \"config\""
+
+[server]
+hosts = ["a.example.com"]
+
+[server.tls]
+"cert.pem" = "/etc/tls"
+
+[[backends]]
+name = "one"
+weight = 1
+
+[[backends]]
+name = "two"
+weight = 2`
+
+	if result != expected {
+		t.Errorf("Unexpected TOML output:\n%s\n", result)
+	}
+
+	if _, err = toToml([]interface{}{"not", "a", "map"}); err == nil {
+		t.Error("Expected encoding a list as TOML to fail")
+	}
+
+	if _, err = toToml(map[string]interface{}{"missing": nil}); err == nil {
+		t.Error("Expected encoding a null value as TOML to fail")
+	}
+}
+
+func TestUnusedVariables(t *testing.T) {
+	rs := context.ResourceSet{
+		Name: "unused",
+		Path: "testdata/unused",
+		Values: map[string]interface{}{
+			"name":      "api",
+			"replicas":  2,
+			"debug":     false,
+			"labels":    map[string]interface{}{"app": "api"},
+			"image":     "api:latest",
+			"tag":       "v1",
+			"obsolete":  true,
+			"forgotten": "value",
+			"namespace": "default",
+		},
+		Namespace:    "default",
+		IncludeFiles: []string{"*.yaml"},
+	}
+
+	unused, err := UnusedVariables(&context.Context{}, &rs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []string{"forgotten", "obsolete"}
+	if !reflect.DeepEqual(expected, unused) {
+		t.Errorf("Expected unused variables %v, but got %v\n", expected, unused)
+	}
+}
+
+func TestUnusedVariablesWithRootReferences(t *testing.T) {
+	values := map[string]interface{}{
+		"ports":   []interface{}{80},
+		"config":  map[string]interface{}{},
+		"timeout": 10,
+		"debug":   true,
+		"env":     "prod",
+	}
+
+	cases := map[string][]string{
+		// All variables are passed on with '.'.
+		"range":    nil,
+		"variable": nil,
+		// The dot of range and with blocks is not the root, and
+		// fields of template variables count as used.
+		"field": {"debug", "env"},
+	}
+
+	for dir, expected := range cases {
+		rs := context.ResourceSet{Name: dir, Path: "testdata/unused-root/" + dir, Values: values}
+
+		unused, err := UnusedVariables(&context.Context{}, &rs)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+
+		if !reflect.DeepEqual(expected, unused) {
+			t.Errorf("Expected unused variables %v in %s, but got %v\n", expected, dir, unused)
+		}
+	}
+
+	// Variables used by the 'enabled' condition are used as well.
+	for _, condition := range []interface{}{"debug", `{{ and .debug (eq .env "prod") }}`} {
+		rs := context.ResourceSet{Name: "field", Path: "testdata/unused-root/field", Values: values, Enabled: condition}
+
+		unused, err := UnusedVariables(&context.Context{}, &rs)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+
+		for _, name := range unused {
+			if name == "debug" {
+				t.Errorf("Expected variable of 'enabled' condition %v to be used, but got %v\n", condition, unused)
+			}
+		}
+	}
+}
+
+func TestFilterKinds(t *testing.T) {
+	resources := func() *RenderedResourceSet {
+		return &RenderedResourceSet{
+			Name: "some-api",
+			Resources: []RenderedResource{
+				{
+					Filename: "api.yaml",
+					Rendered: "kind: Deployment\n---\nkind: Service\n",
+				},
+				{
+					Filename: "other.yaml",
+					Rendered: "kind: CustomResourceDefinition\n---\n- not an object\n",
+				},
+			},
+		}
+	}
+
+	rs := resources()
+	FilterKinds(rs, []string{"deployment", "Service"}, nil)
+	expected := []RenderedResource{
+		{Filename: "api.yaml", Rendered: "---\nkind: Deployment\n---\nkind: Service\n"},
+		{Filename: "other.yaml", Rendered: "---\n- not an object\n"},
+	}
+
+	if !reflect.DeepEqual(expected, rs.Resources) {
+		t.Errorf("Unexpected resources after including kinds: %v\n", rs.Resources)
+	}
+
+	rs = resources()
+	FilterKinds(rs, nil, []string{"CustomResourceDefinition"})
+	expected = []RenderedResource{
+		{Filename: "api.yaml", Rendered: "---\nkind: Deployment\n---\nkind: Service\n"},
+	}
+
+	if !reflect.DeepEqual(expected, rs.Resources) {
+		t.Errorf("Unexpected resources after excluding kinds: %v\n", rs.Resources)
+	}
+}
+
+func TestRecursiveResourceSet(t *testing.T) {
+	rs := context.ResourceSet{
+		Name:         "recursive",
+		Path:         "testdata/recursive",
+		Values:       map[string]interface{}{"name": "api"},
+		ExcludeFiles: []string{"services/secret.yaml"},
+	}
+
+	result, err := processResourceSet(&context.Context{}, &rs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if len(result.Resources) != 1 || result.Resources[0].Filename != "config.yaml" {
+		t.Errorf("Expected only top-level files without 'recursive', but got %v\n", result.Resources)
+	}
+
+	rs.Recursive = true
+	result, err = processResourceSet(&context.Context{}, &rs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	var filenames []string
+	for _, r := range result.Resources {
+		filenames = append(filenames, r.Filename)
+	}
+
+	expected := []string{"config.yaml", "deployments/api.yaml", "services/api.yaml"}
+	if !reflect.DeepEqual(expected, filenames) {
+		t.Errorf("Expected recursive resources %v, but got %v\n", expected, filenames)
+	}
+
+	if result.Resources[1].Rendered != "kind: Deployment\nname: api\n" {
+		t.Errorf("Unexpected rendered nested file: %s\n", result.Resources[1].Rendered)
+	}
+}
+
+func TestCustomDelimiters(t *testing.T) {
+	ctx := context.Context{}
+	resourceSet := context.ResourceSet{
+		Values: map[string]interface{}{
+			"name": "api",
+		},
+		Delimiters: []string{"[[", "]]"},
+	}
+
+	res, err := templateFile(&ctx, &resourceSet, "testdata/test-delimiters.txt")
+	if err != nil {
+		t.Fatalf("Templating with custom delimiters should have succeeded: %v\n", err)
+	}
+
+	expected := "data:\n  name: api\n  template: \"{{ .Values.name }}\"\n"
+	if res.Rendered != expected {
+		t.Errorf("Unexpected rendered template:\n%s\n", res.Rendered)
+	}
+}
+
+func TestInvalidDelimiters(t *testing.T) {
+	ctx := context.Context{}
+	resourceSet := context.ResourceSet{
+		Name:       "test-set",
+		Delimiters: []string{"[["},
+	}
+
+	_, err := templateFile(&ctx, &resourceSet, "testdata/test-delimiters.txt")
+	if err == nil {
+		t.Errorf("Expected invalid delimiters to return an error")
+	}
+}
+
+func TestKustomizeResourceSet(t *testing.T) {
+	defer func(kubectl string) { Kubectl = kubectl }(Kubectl)
+	Kubectl = "testdata/kustomize/fake-kubectl.sh"
+
+	rs := context.ResourceSet{
+		Name:        "kustomized",
+		Path:        "testdata/kustomize/base",
+		Type:        "kustomize",
+		KubectlArgs: []string{"--force-conflicts"},
+	}
+
+	result, err := processResourceSet(&context.Context{}, &rs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []RenderedResource{
+		{
+			Filename: "kustomization.yaml",
+			Rendered: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n",
+		},
+	}
+
+	if !reflect.DeepEqual(expected, result.Resources) {
+		t.Errorf("Unexpected kustomize output: %v\n", result.Resources)
+	}
+
+	if !reflect.DeepEqual([]string{"--force-conflicts"}, result.Args) {
+		t.Errorf("Expected kubectl args to be passed on, got %v\n", result.Args)
+	}
+
+	unused, err := UnusedVariables(&context.Context{}, &rs)
+	if err != nil || unused != nil {
+		t.Errorf("Expected kustomize resource sets not to be inspected for variables, but got %v, %v\n", unused, err)
+	}
+}
+
+func TestFailingKustomization(t *testing.T) {
+	defer func(kubectl string) { Kubectl = kubectl }(Kubectl)
+	Kubectl = "testdata/kustomize/fake-kubectl.sh"
+
+	rs := context.ResourceSet{
+		Name: "broken",
+		Path: "testdata/kustomize",
+		Type: "kustomize",
+	}
+
+	_, err := processResourceSet(&context.Context{}, &rs)
+	if err == nil || !strings.Contains(err.Error(), "unable to find one of 'kustomization.yaml'") {
+		t.Errorf("Expected kustomize error to be reported, but got %v\n", err)
+	}
+}
+
+func TestKustomizationTimeout(t *testing.T) {
+	defer func(kubectl string, timeout time.Duration) {
+		Kubectl = kubectl
+		KubectlTimeout = timeout
+	}(Kubectl, KubectlTimeout)
+	Kubectl = "testdata/kustomize/fake-kubectl.sh"
+	KubectlTimeout = 100 * time.Millisecond
+
+	rs := context.ResourceSet{
+		Name: "slow",
+		Path: "testdata/kustomize/slow",
+		Type: "kustomize",
+	}
+
+	start := time.Now()
+	_, err := processResourceSet(&context.Context{}, &rs)
+	if err == nil || !strings.Contains(err.Error(), "did not finish within 100ms") {
+		t.Errorf("Expected slow kustomization to time out, but got %v\n", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected kustomization to be aborted after the timeout, but it took %s\n", elapsed)
+	}
+}
+
+func TestUnknownResourceSetType(t *testing.T) {
+	rs := context.ResourceSet{
+		Name: "some-api",
+		Path: "testdata",
+		Type: "helm",
+	}
+
+	_, err := processResourceSet(&context.Context{}, &rs)
+	if err == nil || !strings.Contains(err.Error(), "unknown type 'helm'") {
+		t.Errorf("Expected unknown type to be rejected, but got %v\n", err)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	ctx := context.Context{
+		ResourceSets: []context.ResourceSet{
+			{Name: "recursive", Path: "testdata/recursive", Recursive: true},
+			{Name: "partials", Path: "testdata/partials"},
+			{Name: "single", Path: "testdata/test-template.txt"},
+			{Name: "disabled", Path: "testdata/partials", Enabled: false},
+			{Name: "empty", Path: "testdata/partials", ExcludeFiles: []string{"*.yaml"}},
+		},
+	}
+
+	result, err := ListFiles(&ctx, &[]string{}, &[]string{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []ResourceSetFiles{
+		{Name: "recursive", Path: "testdata/recursive", Enabled: true, Files: []string{"config.yaml", "deployments/api.yaml", "services/api.yaml", "services/secret.yaml"}},
+		{Name: "partials", Path: "testdata/partials", Enabled: true, Files: []string{"deployment.yaml"}},
+		{Name: "single", Path: "testdata/test-template.txt", Enabled: true, Files: []string{"test-template.txt"}},
+		{Name: "disabled", Path: "testdata/partials"},
+		{Name: "empty", Path: "testdata/partials", Enabled: true},
+	}
+
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Unexpected files:\n%+v\n", result)
+	}
+}
+
+func TestParseFieldTransforms(t *testing.T) {
+	transforms, err := ParseFieldTransforms([]string{
+		"Deployment:spec.replicas=3",
+		"metadata.annotations.owner=team:infra",
+		"spec.tolerations=[{key: dedicated, operator: Exists}]",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []FieldTransform{
+		{Kind: "Deployment", Path: []string{"spec", "replicas"}, Value: float64(3)},
+		{Path: []string{"metadata", "annotations", "owner"}, Value: "team:infra"},
+		{Path: []string{"spec", "tolerations"}, Value: []interface{}{
+			map[string]interface{}{"key": "dedicated", "operator": "Exists"},
+		}},
+	}
+
+	if !reflect.DeepEqual(expected, transforms) {
+		t.Errorf("Unexpected transforms: %v\n", transforms)
+	}
+
+	for _, invalid := range []string{"spec.replicas", "spec..replicas=3", "Deployment:=3"} {
+		if _, err := ParseFieldTransforms([]string{invalid}); err == nil {
+			t.Errorf("Expected field transform '%s' to be invalid\n", invalid)
+		}
+	}
+}
+
+func TestSetFields(t *testing.T) {
+	rs := RenderedResourceSet{
+		Name: "test",
+		Resources: []RenderedResource{{
+			Filename: "resources.yaml",
+			Rendered: `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+spec:
+  template:
+    spec:
+      containers:
+        - name: api
+        - name: sidecar
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: api
+`,
+		}, {
+			Filename: "configmap.yaml",
+			Rendered: "# Untouched\nkind: ConfigMap\n",
+		}},
+	}
+
+	transforms, _ := ParseFieldTransforms([]string{
+		"Deployment:spec.template.spec.containers.*.imagePullPolicy=Always",
+		"Deployment:spec.replicas=2",
+		"Deployment:spec.replicas=3",
+		"Service:metadata.labels.exposed=true",
+	})
+
+	if err := SetFields(&rs, transforms); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - imagePullPolicy: Always
+        name: api
+      - imagePullPolicy: Always
+        name: sidecar
+---
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    exposed: true
+  name: api
+`
+	if rs.Resources[0].Rendered != expected {
+		t.Errorf("Unexpected result of setting fields:\n%s\n", rs.Resources[0].Rendered)
+	}
+
+	if rs.Resources[1].Rendered != "# Untouched\nkind: ConfigMap\n" {
+		t.Errorf("Expected files without matching documents to be passed through as-is\n")
+	}
+}
+
+func TestSetFieldsOfNonMap(t *testing.T) {
+	rs := RenderedResourceSet{
+		Name:      "test",
+		Resources: []RenderedResource{{Filename: "a.yaml", Rendered: "kind: ConfigMap\ndata: foo\n"}},
+	}
+
+	transforms, _ := ParseFieldTransforms([]string{"data.key=value"})
+	if err := SetFields(&rs, transforms); err == nil {
+		t.Errorf("Expected setting a key of a string to fail\n")
+	}
+}
+
+func TestCommandTemplateFunctions(t *testing.T) {
+	ctx := context.Context{
+		BaseDir: "testdata/functions",
+		TemplateFunctions: map[string]string{
+			"dns":         "./dnsname.sh",
+			"resourceSet": "./resource-set.sh",
+		},
+	}
+	rs := context.ResourceSet{
+		Name:   "functions",
+		Path:   "testdata/functions",
+		Values: map[string]interface{}{"app": "API"},
+	}
+
+	result, err := processResourceSet(&ctx, &rs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []RenderedResource{
+		{Filename: "labels.yaml", Rendered: "label: label-api\n"},
+		{Filename: "service.yaml", Rendered: "name: api-backend\nset: functions\n"},
+	}
+
+	if !reflect.DeepEqual(expected, result.Resources) {
+		t.Errorf("Unexpected output of template functions: %v\n", result.Resources)
+	}
+}
+
+func TestFailingTemplateFunctions(t *testing.T) {
+	defer func(timeout time.Duration) { FunctionTimeout = timeout }(FunctionTimeout)
+	FunctionTimeout = 100 * time.Millisecond
+
+	ctx := context.Context{BaseDir: "testdata/functions"}
+	rs := context.ResourceSet{Name: "functions", Path: "testdata/functions"}
+
+	_, err := runFunctionCommand(&ctx, &rs, "lookup", "./fail.sh", []interface{}{"db"})
+	if err == nil || !strings.Contains(err.Error(), "unknown service db") {
+		t.Errorf("Expected error output of a failing function, got %v\n", err)
+	}
+
+	// The script does not replace itself with 'sleep', so killing
+	// only the shell would leave the output open until it exits.
+	start := time.Now()
+	_, err = runFunctionCommand(&ctx, &rs, "slow", "./slow.sh", nil)
+	if err == nil || !strings.Contains(err.Error(), "did not finish within 100ms") {
+		t.Errorf("Expected slow function to time out, got %v\n", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected slow function to be killed with its children, took %s\n", elapsed)
+	}
+}
+
+func TestTemplateFunctionsCanNotReplaceBuiltins(t *testing.T) {
+	ctx := context.Context{
+		TemplateFunctions: map[string]string{"toYaml": "./to-yaml.sh"},
+		ResourceSets:      []context.ResourceSet{{Name: "conf", Path: "testdata/conf"}},
+	}
+
+	_, err := LoadAndApplyTemplates(&[]string{}, &[]string{}, &ctx, 1)
+	if err == nil || !strings.Contains(err.Error(), "'toYaml' can not be defined") {
+		t.Errorf("Expected built-in function to be protected, got %v\n", err)
+	}
+}
+
+func templateError(t *testing.T, rs context.ResourceSet) TemplateError {
+	ctx := context.Context{ResourceSets: []context.ResourceSet{rs}}
+
+	_, err := LoadAndApplyTemplates(&[]string{}, &[]string{}, &ctx, 1)
+	templateErr, ok := err.(*TemplateError)
+	if !ok {
+		t.Fatalf("Expected a template error, got %v\n", err)
+	}
+
+	if templateErr.Err == nil || !strings.Contains(err.Error(), templateErr.Err.Error()) {
+		t.Errorf("Expected underlying error to be included in %q\n", err.Error())
+	}
+
+	result := *templateErr
+	result.Err = nil
+	return result
+}
+
+func TestUnknownFunctionError(t *testing.T) {
+	err := templateError(t, context.ResourceSet{
+		Name:   "unknown-function",
+		Path:   "testdata/template-errors/unknown-function",
+		Values: map[string]interface{}{"name": "test"},
+	})
+
+	expected := TemplateError{
+		ResourceSet: "unknown-function",
+		File:        "testdata/template-errors/unknown-function/configmap.yaml",
+		Line:        4,
+		Kind:        ParseError,
+		Summary:     `unknown function "tolower"`,
+	}
+
+	if !reflect.DeepEqual(expected, err) {
+		t.Errorf("Unexpected error for unknown function: %+v\n", err)
+	}
+
+	if !strings.HasPrefix(err.Error(), `resource set 'unknown-function', file testdata/template-errors/unknown-function/configmap.yaml, line 4: unknown function "tolower" (parse error: `) {
+		t.Errorf("Unexpected error message: %s\n", err.Error())
+	}
+}
+
+func TestUndefinedVariableError(t *testing.T) {
+	err := templateError(t, context.ResourceSet{
+		Name:   "undefined-variable",
+		Path:   "testdata/template-errors/undefined-variable",
+		Values: map[string]interface{}{"name": "test"},
+	})
+
+	expected := TemplateError{
+		ResourceSet: "undefined-variable",
+		File:        "testdata/template-errors/undefined-variable/configmap.yaml",
+		Line:        6,
+		Kind:        ExecutionError,
+		Summary:     `variable "version" is not set (in .version)`,
+	}
+
+	if !reflect.DeepEqual(expected, err) {
+		t.Errorf("Unexpected error for undefined variable: %+v\n", err)
+	}
+}
+
+func TestRawResourceSet(t *testing.T) {
+	rs := context.ResourceSet{
+		Name: "crds",
+		Path: "testdata/raw",
+	}
+
+	if _, err := processResourceSet(&context.Context{}, &rs); err == nil {
+		t.Fatal("Expected templating the raw manifest to fail")
+	}
+
+	rs.Type = "raw"
+	result, err := processResourceSet(&context.Context{}, &rs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []RenderedResource{
+		{
+			Filename: "crd.yaml",
+			Rendered: "apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: issuers.example.com\nspec:\n  description: Renders {{ .Name }} with {{ template \"name\" }}\n",
+		},
+	}
+
+	if !reflect.DeepEqual(expected, result.Resources) {
+		t.Errorf("Expected raw files to be used verbatim, got %v\n", result.Resources)
+	}
+
+	unused, err := UnusedVariables(&context.Context{}, &rs)
+	if err != nil || unused != nil {
+		t.Errorf("Expected raw resource sets not to be inspected for variables, but got %v, %v\n", unused, err)
+	}
+}
+
+func TestResourceSetPathDiffersFromName(t *testing.T) {
+	// The resource set lives in a sibling directory of the cluster
+	// configuration, outside of its directory tree.
+	ctx, err := context.LoadContext("testdata/path-override/config/cluster.yaml", &context.LoadOptions{})
+	if err != nil {
+		t.Fatalf("Could not load context: %v\n", err)
+	}
+
+	result, err := LoadAndApplyTemplates(&[]string{"edge/ingress"}, &[]string{}, ctx, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if len(result) != 1 || result[0].Name != "edge/ingress" {
+		t.Fatalf("Expected resource set 'edge/ingress', got %v\n", result)
+	}
+
+	if len(result[0].Resources) != 1 || result[0].Resources[0].Filename != "deployment.yaml" {
+		t.Fatalf("Expected the files of the resource set path to be templated, got %v\n", result[0].Resources)
+	}
+
+	if !strings.Contains(result[0].Resources[0].Rendered, "replicas: 3") {
+		t.Errorf("Unexpected rendered resource:\n%s\n", result[0].Resources[0].Rendered)
+	}
+}
+
+func TestDefaultWithVariableName(t *testing.T) {
+	ctx := context.Context{}
+	resourceSet := context.ResourceSet{
+		Name:   "test",
+		Values: map[string]interface{}{"replicas": float64(5)},
+	}
+
+	_, err := templateFile(&ctx, &resourceSet, "testdata/template-errors/default-by-name/deployment.yaml")
+	if err == nil || !strings.Contains(err.Error(), "use '{{ defaultVar ... \"replicas\" }}'") {
+		t.Errorf("Expected 'default' with a variable name to be rejected, got %v\n", err)
+	}
+}
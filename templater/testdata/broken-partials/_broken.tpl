@@ -0,0 +1 @@
+{{ define "broken" }}{{ .name 
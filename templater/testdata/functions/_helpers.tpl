@@ -0,0 +1 @@
+{{ define "label" }}{{ dns "label" .app }}{{ end }}
@@ -0,0 +1,4 @@
+#!/bin/sh
+# Joins its arguments into a DNS label, as an example of a template
+# function defined in the cluster configuration.
+echo "$*" | tr ' ' '-' | tr 'A-Z' 'a-z'
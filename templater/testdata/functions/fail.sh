@@ -0,0 +1,3 @@
+#!/bin/sh
+echo "unknown service $1" >&2
+exit 1
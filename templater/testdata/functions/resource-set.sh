@@ -0,0 +1,2 @@
+#!/bin/sh
+echo "$KONTEMPLATE_RESOURCE_SET"
@@ -0,0 +1,15 @@
+#!/bin/sh
+# Fake kubectl that builds the kustomization in testdata/kustomize/base.
+
+case "$*" in
+  "kustomize testdata/kustomize/base")
+    printf 'apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n'
+    ;;
+  "kustomize testdata/kustomize/slow")
+    sleep 5
+    ;;
+  *)
+    echo "error: unable to find one of 'kustomization.yaml' in $*" >&2
+    exit 1
+    ;;
+esac
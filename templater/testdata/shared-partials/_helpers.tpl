@@ -0,0 +1,3 @@
+{{- define "owner" -}}
+owner: {{ defaultVar "nobody" "owner" }}
+{{- end -}}
@@ -0,0 +1,219 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of the 'toToml' template
+// function, which encodes variables as TOML.
+
+package templater
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var bareTomlKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Encodes a map as a TOML document with sorted keys. Values are
+// normalised through JSON first, which leaves only maps, slices,
+// strings, numbers and booleans to handle.
+func toToml(data interface{}) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+
+	var normalised interface{}
+	if err = decoder.Decode(&normalised); err != nil {
+		return "", err
+	}
+
+	table, ok := normalised.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("toToml requires a map, but got %T", data)
+	}
+
+	var b bytes.Buffer
+	if err = writeTomlTable(&b, nil, table); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Writes the key/value pairs of a table, followed by its sub-tables
+// and arrays of tables, which TOML requires to come last.
+func writeTomlTable(b *bytes.Buffer, path []string, table map[string]interface{}) error {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var tables, arrays []string
+
+	for _, k := range keys {
+		switch v := table[k].(type) {
+		case map[string]interface{}:
+			tables = append(tables, k)
+			continue
+		case []interface{}:
+			if isTomlArrayOfTables(v) {
+				arrays = append(arrays, k)
+				continue
+			}
+		}
+
+		value, err := tomlValue(table[k])
+		if err != nil {
+			return fmt.Errorf("toToml: %s: %v", strings.Join(append(path, k), "."), err)
+		}
+
+		fmt.Fprintf(b, "%s = %s\n", tomlKey(k), value)
+	}
+
+	for _, k := range tables {
+		subPath := append(append([]string{}, path...), k)
+		fmt.Fprintf(b, "\n[%s]\n", tomlKeyPath(subPath))
+
+		if err := writeTomlTable(b, subPath, table[k].(map[string]interface{})); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range arrays {
+		subPath := append(append([]string{}, path...), k)
+
+		for _, element := range table[k].([]interface{}) {
+			fmt.Fprintf(b, "\n[[%s]]\n", tomlKeyPath(subPath))
+
+			if err := writeTomlTable(b, subPath, element.(map[string]interface{})); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func isTomlArrayOfTables(array []interface{}) bool {
+	for _, element := range array {
+		if _, ok := element.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+
+	return len(array) > 0
+}
+
+// Encodes a value inline, using inline tables for maps nested in
+// arrays.
+func tomlValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", fmt.Errorf("TOML has no null values")
+
+	case bool:
+		return fmt.Sprintf("%t", v), nil
+
+	case json.Number:
+		return v.String(), nil
+
+	case string:
+		return tomlString(v), nil
+
+	case []interface{}:
+		elements := make([]string, len(v))
+		for i, element := range v {
+			encoded, err := tomlValue(element)
+			if err != nil {
+				return "", err
+			}
+			elements[i] = encoded
+		}
+
+		return "[" + strings.Join(elements, ", ") + "]", nil
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		pairs := make([]string, len(keys))
+		for i, k := range keys {
+			encoded, err := tomlValue(v[k])
+			if err != nil {
+				return "", err
+			}
+			pairs[i] = fmt.Sprintf("%s = %s", tomlKey(k), encoded)
+		}
+
+		return "{" + strings.Join(pairs, ", ") + "}", nil
+	}
+
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+func tomlKey(key string) string {
+	if bareTomlKey.MatchString(key) {
+		return key
+	}
+
+	return tomlString(key)
+}
+
+func tomlKeyPath(path []string) string {
+	keys := make([]string, len(path))
+	for i, k := range path {
+		keys[i] = tomlKey(k)
+	}
+
+	return strings.Join(keys, ".")
+}
+
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,316 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of finding variables that are
+// not referenced by any template of a resource set.
+
+package templater
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/tazjin/kontemplate/context"
+)
+
+// Variables referenced by templates, determined by inspecting the
+// parsed templates instead of rendering them.
+type variableUsage struct {
+	names map[string]bool
+
+	// Set if a template passes all variables to a function (e.g.
+	// '{{ toYaml . }}'), which makes every variable count as used.
+	all bool
+
+	// Number of enclosing range and with blocks, in which the dot
+	// refers to something other than the variables.
+	depth int
+
+	// Files included with insertTemplate that have been inspected.
+	visited map[string]bool
+}
+
+// Returns the sorted names of the variables of a resource set that are
+// not referenced by any of its templates. Templates are parsed but not
+// executed, so references are found regardless of conditionals.
+//
+// The analysis errs on the side of reporting too few variables:
+// fields accessed inside 'range' or 'with' blocks or through template
+// variables are counted as top level variables as well, and passing all
+// variables somewhere (e.g. '{{ range $k, $v := . }}') counts all of
+// them as used.
+func UnusedVariables(c *context.Context, rs *context.ResourceSet) ([]string, error) {
+	usage := variableUsage{
+		names:   make(map[string]bool),
+		visited: make(map[string]bool),
+	}
+
+	// Kustomize and raw resource sets are not templated.
+	if rs.Type == KustomizeType || rs.Type == RawType {
+		return nil, nil
+	}
+
+	fileInfo, err := os.Stat(rs.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{rs.Path}
+	if fileInfo.IsDir() {
+		files, err := resourceFiles(rs)
+		if err != nil {
+			return nil, err
+		}
+
+		paths = nil
+		for _, file := range files {
+			paths = append(paths, path.Join(rs.Path, file))
+		}
+	}
+
+	for _, p := range paths {
+		if err = usage.inspectFile(c, rs, p); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = usage.inspectEnabled(c, rs); err != nil {
+		return nil, err
+	}
+
+	var unused []string
+	if usage.all {
+		return unused, nil
+	}
+
+	for name := range rs.Values {
+		// The namespace variable is set by kontemplate itself.
+		if usage.names[name] || (name == "namespace" && rs.Namespace != "") {
+			continue
+		}
+
+		unused = append(unused, name)
+	}
+
+	sort.Strings(unused)
+	return unused, nil
+}
+
+func (u *variableUsage) inspectFile(c *context.Context, rs *context.ResourceSet, filepath string) error {
+	if u.visited[filepath] {
+		return nil
+	}
+	u.visited[filepath] = true
+
+	tpl, err := parseTemplate(c, rs, filepath)
+	if err != nil {
+		return err
+	}
+
+	var inserted []string
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil {
+			inserted = append(inserted, u.inspect(t.Tree.Root)...)
+		}
+	}
+
+	// Templates inserted with insertTemplate are rendered with the
+	// same variables.
+	for _, file := range inserted {
+		if err = u.inspectFile(c, rs, path.Join(rs.Path, file)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Records the variables referenced in a template node and returns the
+// files it inserts with insertTemplate.
+func (u *variableUsage) inspect(node parse.Node) []string {
+	var inserted []string
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			inserted = append(inserted, u.inspect(child)...)
+		}
+
+	case *parse.ActionNode:
+		inserted = u.inspect(n.Pipe)
+
+	case *parse.IfNode:
+		inserted = u.inspectBranch(&n.BranchNode, false)
+
+	case *parse.RangeNode:
+		inserted = u.inspectBranch(&n.BranchNode, true)
+
+	case *parse.WithNode:
+		inserted = u.inspectBranch(&n.BranchNode, true)
+
+	case *parse.TemplateNode:
+		// Templates invoked with all variables are inspected like
+		// all other templates.
+		if !isRootPipe(n.Pipe) {
+			inserted = u.inspect(n.Pipe)
+		}
+
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			inserted = append(inserted, u.inspect(cmd)...)
+		}
+
+	case *parse.CommandNode:
+		inserted = u.inspectCommand(n)
+
+	case *parse.ChainNode:
+		inserted = u.inspect(n.Node)
+
+	case *parse.FieldNode:
+		u.names[n.Ident[0]] = true
+
+	case *parse.DotNode:
+		// All variables are passed on, e.g. in '{{ toYaml . }}' or
+		// '{{ range $k, $v := . }}', unless the dot was changed by
+		// 'range' or 'with'.
+		if u.depth == 0 {
+			u.all = true
+		}
+
+	case *parse.VariableNode:
+		// Fields of any variable are counted as top level variables,
+		// as the variable may hold the root (e.g. '$all := .').
+		if len(n.Ident) > 1 {
+			u.names[n.Ident[1]] = true
+		} else if n.Ident[0] == "$" {
+			u.all = true
+		}
+	}
+
+	return inserted
+}
+
+// Inspects an if, range or with block. The dot of the body of range and
+// with blocks is not the root of the variables.
+func (u *variableUsage) inspectBranch(n *parse.BranchNode, changesDot bool) []string {
+	inserted := u.inspect(n.Pipe)
+
+	if changesDot {
+		u.depth++
+	}
+	inserted = append(inserted, u.inspect(n.List)...)
+	if changesDot {
+		u.depth--
+	}
+
+	return append(inserted, u.inspect(n.ElseList)...)
+}
+
+// Function calls can refer to variables by name, for example with
+// '{{ defaultVar "fallback" "name" }}' or '{{ index . "name" }}'.
+func (u *variableUsage) inspectCommand(n *parse.CommandNode) []string {
+	function, ok := n.Args[0].(*parse.IdentifierNode)
+	if !ok {
+		return u.inspectArgs(n.Args)
+	}
+
+	args := n.Args[1:]
+
+	switch function.Ident {
+	case "defaultVar":
+		if len(args) == 2 {
+			if name, ok := args[1].(*parse.StringNode); ok {
+				u.names[name.Text] = true
+				return u.inspect(args[0])
+			}
+		}
+
+	case "index", optionalFieldFunc:
+		if len(args) >= 2 && isRootNode(args[0]) && u.depth == 0 {
+			if name, ok := args[1].(*parse.StringNode); ok {
+				u.names[name.Text] = true
+				return u.inspectArgs(args[2:])
+			}
+		}
+
+	case "insertTemplate":
+		if len(args) == 1 {
+			if file, ok := args[0].(*parse.StringNode); ok {
+				return []string{file.Text}
+			}
+		}
+
+	case "include":
+		// Partials are inspected like all other templates.
+		if len(args) == 2 && isRootNode(args[1]) {
+			return u.inspect(args[0])
+		}
+	}
+
+	return u.inspectArgs(n.Args)
+}
+
+func (u *variableUsage) inspectArgs(args []parse.Node) []string {
+	var inserted []string
+	for _, arg := range args {
+		inserted = append(inserted, u.inspect(arg)...)
+	}
+
+	return inserted
+}
+
+// Records the variables referenced by the 'enabled' condition of a
+// resource set, which is either a template or the name of a variable.
+func (u *variableUsage) inspectEnabled(c *context.Context, rs *context.ResourceSet) error {
+	condition, ok := rs.Enabled.(string)
+	if !ok {
+		return nil
+	}
+
+	if !strings.Contains(condition, "{{") {
+		u.names[strings.Split(strings.TrimPrefix(condition, "."), ".")[0]] = true
+		return nil
+	}
+
+	tpl, err := template.New("enabled").Funcs(templateFuncs(c, rs)).Parse(condition)
+	if err == nil {
+		err = rewriteDefaults(tpl, nil)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Invalid 'enabled' condition of resource set %s: %v", rs.Name, err)
+	}
+
+	u.inspect(tpl.Tree.Root)
+	return nil
+}
+
+func isRootNode(node parse.Node) bool {
+	if _, ok := node.(*parse.DotNode); ok {
+		return true
+	}
+
+	v, ok := node.(*parse.VariableNode)
+	return ok && len(v.Ident) == 1 && v.Ident[0] == "$"
+}
+
+func isRootPipe(pipe *parse.PipeNode) bool {
+	return pipe != nil && len(pipe.Decl) == 0 && len(pipe.Cmds) == 1 && len(pipe.Cmds[0].Args) == 1 && isRootNode(pipe.Cmds[0].Args[0])
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of discovering the workloads
+// in rendered resources whose rollout can be waited on.
+
+package templater
+
+import (
+	"github.com/ghodss/yaml"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Kinds of resources that support `kubectl rollout status`.
+var workloadKinds = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+}
+
+// A workload resource whose rollout can be waited on.
+type Workload struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+// Returns all workloads contained in a rendered resource set, in the
+// order in which they appear. Documents that can not be parsed are
+// ignored, as kubectl reports them when applying.
+func Workloads(rs *RenderedResourceSet) []Workload {
+	var workloads []Workload
+
+	for _, r := range rs.Resources {
+		for _, doc := range util.SplitDocuments(r.Rendered) {
+			var resource struct {
+				Kind     string `json:"kind"`
+				Metadata struct {
+					Name      string `json:"name"`
+					Namespace string `json:"namespace"`
+				} `json:"metadata"`
+			}
+
+			if err := yaml.Unmarshal([]byte(doc), &resource); err != nil {
+				continue
+			}
+
+			if !workloadKinds[resource.Kind] || resource.Metadata.Name == "" {
+				continue
+			}
+
+			namespace := resource.Metadata.Namespace
+			if namespace == "" {
+				namespace = rs.Namespace
+			}
+
+			workloads = append(workloads, Workload{
+				Kind:      resource.Kind,
+				Name:      resource.Metadata.Name,
+				Namespace: namespace,
+			})
+		}
+	}
+
+	return workloads
+}
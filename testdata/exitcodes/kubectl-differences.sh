@@ -0,0 +1,4 @@
+#!/bin/sh
+# Behaves like 'kubectl diff' when differences are found.
+cat > /dev/null
+exit 1
@@ -0,0 +1,4 @@
+#!/bin/sh
+# Exits without reading the resources passed on stdin.
+echo "error: the server is unavailable" >&2
+exit 1
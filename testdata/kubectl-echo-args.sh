@@ -0,0 +1,4 @@
+#!/bin/sh
+# Prints the arguments kubectl was called with.
+cat > /dev/null
+echo "$@"
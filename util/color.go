@@ -0,0 +1,97 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of coloured diagnostic output.
+// Colours are only used when writing to a terminal and can be disabled
+// with --no-color or the NO_COLOR environment variable.
+
+package util
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+type Style string
+
+const (
+	Bold   Style = "1"
+	Red    Style = "31"
+	Green  Style = "32"
+	Yellow Style = "33"
+	Cyan   Style = "36"
+)
+
+// Disables colours regardless of the output, set from the command line
+// flags.
+var NoColor = false
+
+// Returns whether coloured output should be written to w, which is only
+// the case for terminals.
+func ColorEnabled(w io.Writer) bool {
+	if NoColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+
+	f, ok := w.(*os.File)
+	return ok && IsTerminal(f)
+}
+
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Applies a style to text that is written to w, if colours are enabled
+// for it.
+func Colorize(w io.Writer, style Style, text string) string {
+	if !ColorEnabled(w) {
+		return text
+	}
+
+	return style.apply(text)
+}
+
+// Highlights text in a log message, for example a file name.
+func Highlight(text string) string {
+	return Colorize(LogOutput, Bold, text)
+}
+
+func (s Style) apply(text string) string {
+	return "\x1b[" + string(s) + "m" + text + "\x1b[0m"
+}
+
+// Returns a writer that applies a style to everything written to w, for
+// example to colour the error messages printed by kingpin.
+func StyledWriter(w io.Writer, style Style) io.Writer {
+	return &styledWriter{w, style}
+}
+
+type styledWriter struct {
+	w     io.Writer
+	style Style
+}
+
+func (s *styledWriter) Write(p []byte) (int, error) {
+	if !ColorEnabled(s.w) {
+		return s.w.Write(p)
+	}
+
+	// The trailing newline is written after the reset sequence, so
+	// that the style does not leak into the next line.
+	text := string(p)
+	trimmed := strings.TrimSuffix(text, "\n")
+
+	if _, err := io.WriteString(s.w, s.style.apply(trimmed)+text[len(trimmed):]); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,269 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of line-based unified diffs.
+
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A single line of an edit script, marked with ' ', '-' or '+'.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// Computes a unified diff between two texts with the given number of
+// lines of context around each change. An empty string is returned if
+// the texts are equal.
+func UnifiedDiff(from string, to string, fromName string, toName string, context int) string {
+	lines := editScript(splitLines(from), splitLines(to))
+
+	var b strings.Builder
+	for _, h := range hunks(lines, context) {
+		if b.Len() == 0 {
+			fmt.Fprintf(&b, "--- %s\n+++ %s\n", fromName, toName)
+		}
+
+		b.WriteString(h)
+	}
+
+	return b.String()
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Computes the edit script between two lists of lines using the
+// linear-space variant of Myers' algorithm, which recursively splits
+// both lists at the middle of a shortest edit path.
+func editScript(a []string, b []string) []diffLine {
+	return appendEdits(nil, a, b)
+}
+
+func appendEdits(lines []diffLine, a []string, b []string) []diffLine {
+	// Lines shared at the start and the end are unchanged:
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		lines = append(lines, diffLine{' ', a[prefix]})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-suffix-1] == b[len(b)-suffix-1] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	if x, y, ok := middleSnake(a, b); ok {
+		lines = appendEdits(lines, a[:x], b[:y])
+		lines = appendEdits(lines, a[x:], b[y:])
+	} else {
+		for _, l := range a {
+			lines = append(lines, diffLine{'-', l})
+		}
+		for _, l := range b {
+			lines = append(lines, diffLine{'+', l})
+		}
+	}
+
+	for _, l := range common {
+		lines = append(lines, diffLine{' ', l})
+	}
+
+	return lines
+}
+
+// Searches for a shortest edit path from both ends of the two lists at
+// once and returns the point at which the searches meet. The boolean is
+// false if one of the lists is empty or they have no line in common.
+func middleSnake(a []string, b []string) (int, int, bool) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+
+	// vf[offset+k] and vb[offset+k] hold the furthest x reached on
+	// diagonal k by the forward and the backward search, where the
+	// backward search counts from the end of both lists.
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	vf := make([]int, 2*offset+1)
+	vb := make([]int, 2*offset+1)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[offset+1], vb[offset+1] = 0, 0
+
+	delta := n - m
+	odd := delta%2 != 0
+
+	// Diagonals that left the edit graph are excluded from further
+	// searches by these bounds.
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+
+	for d := 0; d < maxD; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[offset+k] = x
+
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case odd:
+				kb := offset + delta - k
+				if kb >= 0 && kb < len(vb) && vb[kb] != -1 && x >= n-vb[kb] {
+					return x, y, true
+				}
+			}
+		}
+
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vb[offset+k-1] < vb[offset+k+1]) {
+				x = vb[offset+k+1]
+			} else {
+				x = vb[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			vb[offset+k] = x
+
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !odd:
+				kf := offset + delta - k
+				if kf >= 0 && kf < len(vf) && vf[kf] != -1 && vf[kf] >= n-x {
+					return vf[kf], vf[kf] - (delta - k), true
+				}
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// Groups an edit script into hunks of changes with surrounding context.
+// Changes whose context overlaps are merged into a single hunk.
+func hunks(lines []diffLine, context int) []string {
+	var result []string
+
+	for start := 0; start < len(lines); {
+		// Find the next change:
+		first := start
+		for first < len(lines) && lines[first].op == ' ' {
+			first++
+		}
+
+		if first == len(lines) {
+			break
+		}
+
+		// Extend the hunk until there are more than 2*context
+		// unchanged lines between two changes:
+		last := first
+		for next := first + 1; next < len(lines); next++ {
+			if lines[next].op != ' ' {
+				if next-last-1 > 2*context {
+					break
+				}
+				last = next
+			}
+		}
+
+		from := max(first-context, 0)
+		to := min(last+context+1, len(lines))
+		result = append(result, formatHunk(lines, from, to))
+		start = to
+	}
+
+	return result
+}
+
+func formatHunk(lines []diffLine, from int, to int) string {
+	// Determine the line numbers at which the hunk starts in both
+	// texts by counting the lines before it.
+	fromLine, toLine := 1, 1
+	for _, l := range lines[:from] {
+		if l.op != '+' {
+			fromLine++
+		}
+		if l.op != '-' {
+			toLine++
+		}
+	}
+
+	var body strings.Builder
+	fromCount, toCount := 0, 0
+
+	for _, l := range lines[from:to] {
+		if l.op != '+' {
+			fromCount++
+		}
+		if l.op != '-' {
+			toCount++
+		}
+
+		fmt.Fprintf(&body, "%c%s\n", l.op, l.text)
+	}
+
+	// Empty ranges start at the line before the hunk, as in GNU diff.
+	if fromCount == 0 {
+		fromLine--
+	}
+	if toCount == 0 {
+		toLine--
+	}
+
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@\n%s", fromLine, fromCount, toLine, toCount, body.String())
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
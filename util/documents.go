@@ -0,0 +1,103 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of multi-document YAML files,
+// whose documents are deep-merged in order. Aliases may refer to anchors
+// defined in earlier documents of the same file.
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+var unknownAnchor = regexp.MustCompile(`unknown anchor '([^']*)' referenced`)
+
+// Merges the documents of a multi-document YAML file into a single JSON
+// object, in which later documents are deep-merged onto earlier ones.
+func mergeDocuments(data []byte) ([]byte, error) {
+	converted, err := yaml.YAMLToJSON([]byte(documentsAsSequence(string(data))))
+	if err != nil {
+		return nil, anchorError(data, err)
+	}
+
+	var documents []interface{}
+	if err = json.Unmarshal(converted, &documents); err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]interface{})
+	for i, doc := range documents {
+		if doc == nil {
+			continue
+		}
+
+		values, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("document %d is not a map and can not be merged with the other documents", i+1)
+		}
+
+		merged = DeepMerge(merged, values)
+	}
+
+	return json.Marshal(merged)
+}
+
+// Rewrites a multi-document YAML stream into a single document with
+// one sequence entry per document, in which anchors remain visible to
+// later entries. Every line stays on the same line number, so that
+// errors point at the right location.
+func documentsAsSequence(data string) string {
+	lines := strings.Split(data, "\n")
+	started := false
+
+	for i, line := range lines {
+		switch {
+		case documentSeparator.MatchString(line):
+			lines[i] = "-"
+			started = true
+		case strings.TrimRight(line, " \t") == "...":
+			lines[i] = ""
+		case !started:
+			lines[i] = "- " + line
+			started = true
+		default:
+			lines[i] = "  " + line
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Replaces the error for aliases that refer to an undefined anchor with
+// one naming the line of the alias.
+func anchorError(data []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	match := unknownAnchor.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+
+	alias := "*" + match[1]
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.Contains(line, alias) {
+			return fmt.Errorf("alias %s at line %d refers to an anchor that is not defined before it", alias, i+1)
+		}
+	}
+
+	return fmt.Errorf("alias %s refers to an anchor that is not defined before it", alias)
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of the logger used for all
+// diagnostic output. Diagnostics are always written to stderr, so that
+// stdout only contains rendered resources and command results.
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+type LogLevel int
+
+const (
+	// Only warnings are logged.
+	LogQuiet LogLevel = iota
+
+	// Progress messages and warnings are logged.
+	LogNormal
+
+	// Additionally logs details such as resolved paths and timings.
+	LogVerbose
+)
+
+// Current log level, set from the command line flags.
+var Level LogLevel = LogNormal
+
+// Destination of all log messages.
+var LogOutput io.Writer = os.Stderr
+
+// Logs details that are only of interest when debugging.
+func Debugf(format string, args ...interface{}) {
+	logf(LogVerbose, "", format, args...)
+}
+
+// Logs progress messages.
+func Infof(format string, args ...interface{}) {
+	logf(LogNormal, "", format, args...)
+}
+
+// Logs warnings, which are shown at every log level.
+func Warnf(format string, args ...interface{}) {
+	logf(LogQuiet, Colorize(LogOutput, Yellow, "Warning: "), format, args...)
+}
+
+func logf(level LogLevel, prefix string, format string, args ...interface{}) {
+	if Level >= level {
+		fmt.Fprintf(LogOutput, prefix+format+"\n", args...)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of running subprocesses with
+// a timeout.
+
+package util
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Returned by commands that were killed after exceeding their timeout.
+type TimeoutError struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s did not finish within %s and was killed", e.Command, e.Timeout)
+}
+
+// Starts a command and returns a function that waits for it to exit,
+// like cmd.Wait. If a timeout is set, the command runs in its own
+// process group and the whole group is killed once the timeout is
+// exceeded, so that no child processes are left behind. Waiting then
+// returns a *TimeoutError.
+func StartCommand(cmd *exec.Cmd, timeout time.Duration) (func() error, error) {
+	if timeout <= 0 {
+		return cmd.Wait, cmd.Start()
+	}
+
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		killProcessGroup(cmd)
+	})
+
+	wait := func() error {
+		err := cmd.Wait()
+		timer.Stop()
+
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return &TimeoutError{Command: filepath.Base(cmd.Path), Timeout: timeout}
+		}
+
+		return err
+	}
+
+	return wait, nil
+}
+
+// Runs a command to completion, see StartCommand.
+func RunCommand(cmd *exec.Cmd, timeout time.Duration) error {
+	wait, err := StartCommand(cmd, timeout)
+	if err != nil {
+		return err
+	}
+
+	return wait()
+}
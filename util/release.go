@@ -0,0 +1,99 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of checking for newer
+// releases of Kontemplate on GitHub.
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver"
+)
+
+// Repository whose releases are checked by `kontemplate version --check`.
+const ReleaseRepository string = "judev/kontemplate"
+
+// HTTPClient is the subset of http.Client used for release checks. It
+// exists so that the check can be tested without network access.
+type HTTPClient interface {
+	Get(url string) (*http.Response, error)
+}
+
+// Queries the GitHub releases API for the tag name of the latest
+// release of the given repository.
+func LatestRelease(client HTTPClient, repo string) (string, error) {
+	url := fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", repo)
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response from GitHub: %s", resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", fmt.Errorf("could not parse release information: %v", err)
+	}
+
+	if release.TagName == "" {
+		return "", fmt.Errorf("release information contains no version")
+	}
+
+	return release.TagName, nil
+}
+
+// Compares two semantic versions (optionally prefixed with 'v') and
+// returns -1, 0 or 1 if the first is older than, equal to or newer
+// than the second. Pre-release versions are older than the
+// corresponding release.
+func CompareVersions(a string, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return va.Compare(vb), nil
+}
+
+// Pre-release identifiers ending in a number, such as 'rc10'.
+var numberedPrerelease = regexp.MustCompile(`^([0-9A-Za-z-]*[A-Za-z-])([0-9]+)$`)
+
+// Parses a semantic version. Release tags such as 'v2.0.0-rc10' do not
+// separate the pre-release number with a dot, which would order 'rc10'
+// before 'rc2', so such identifiers are split in two ('rc.10').
+func parseVersion(version string) (*semver.Version, error) {
+	v, err := semver.NewVersion(version)
+	if err != nil || v.Prerelease() == "" {
+		return v, err
+	}
+
+	identifiers := strings.Split(v.Prerelease(), ".")
+	for i, identifier := range identifiers {
+		identifiers[i] = numberedPrerelease.ReplaceAllString(identifier, "$1.$2")
+	}
+
+	return semver.NewVersion(fmt.Sprintf("%d.%d.%d-%s", v.Major(), v.Minor(), v.Patch(), strings.Join(identifiers, ".")))
+}
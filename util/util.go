@@ -10,7 +10,12 @@
 package util
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"regexp"
+	"strings"
 
 	"github.com/ghodss/yaml"
 )
@@ -41,18 +46,126 @@ func Merge(in1 *map[string]interface{}, in2 *map[string]interface{}) *map[string
 	return &new
 }
 
+// Merges two maps recursively. Nested maps present in both are merged,
+// all other values (including lists) from the second map replace those
+// in the first. Neither input map is modified.
+func DeepMerge(in1 map[string]interface{}, in2 map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(in1)+len(in2))
+	for k, v := range in1 {
+		merged[k] = v
+	}
+
+	for k, v := range in2 {
+		existing, ok1 := merged[k].(map[string]interface{})
+		override, ok2 := v.(map[string]interface{})
+
+		if ok1 && ok2 {
+			merged[k] = DeepMerge(existing, override)
+		} else {
+			merged[k] = v
+		}
+	}
+
+	return merged
+}
+
 // Loads either a YAML or JSON file from the specified path and
 // deserialises it into the provided interface.
+//
+// Files with a `.json` extension are parsed as JSON, which allows
+// errors to be reported with their line and column. All other files
+// are parsed as YAML (of which JSON is a subset). The documents of
+// multi-document YAML files are deep-merged in order.
 func LoadData(filename string, addr interface{}) error {
 	file, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return err
 	}
 
-	err = yaml.Unmarshal(file, addr)
-	if err != nil {
-		return err
+	return UnmarshalData(filename, file, addr)
+}
+
+// Deserialises the contents of a YAML or JSON file in the same way as
+// LoadData, using the filename only to determine the format.
+func UnmarshalData(filename string, file []byte, addr interface{}) error {
+	var err error
+
+	if strings.HasSuffix(filename, ".json") {
+		return unmarshalJSON(file, addr)
+	}
+
+	if len(SplitDocuments(string(file))) > 1 {
+		file, err = mergeDocuments(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	// JSON is valid YAML, so merged documents are loaded in the same
+	// way, which converts scalars according to the target type.
+	return anchorError(file, yaml.Unmarshal(file, addr))
+}
+
+func unmarshalJSON(data []byte, addr interface{}) error {
+	err := json.Unmarshal(data, addr)
+
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		line, col := position(data, e.Offset)
+		return fmt.Errorf("JSON syntax error at line %d, column %d: %v", line, col, e)
+	case *json.UnmarshalTypeError:
+		line, col := position(data, e.Offset)
+		return fmt.Errorf("JSON type error at line %d, column %d: %v", line, col, e)
+	}
+
+	return err
+}
+
+// Determines the line and column of a byte offset in the input data.
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	col := int(offset) - bytes.LastIndexByte(data[:offset], '\n') - 1
+
+	return line, col
+}
+
+var documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
+// Splits a multi-document YAML stream into its individual documents.
+// Documents that contain only whitespace are omitted.
+func SplitDocuments(data string) []string {
+	documents := make([]string, 0)
+
+	for _, doc := range documentSeparator.Split(data, -1) {
+		if strings.TrimSpace(doc) != "" {
+			documents = append(documents, strings.Trim(doc, "\n"))
+		}
+	}
+
+	return documents
+}
+
+// Converts every document of a multi-document YAML stream to JSON.
+// Documents that contain only comments are omitted.
+func DocumentsToJSON(data string) ([]json.RawMessage, error) {
+	documents := make([]json.RawMessage, 0)
+
+	for i, doc := range SplitDocuments(data) {
+		// SplitDocuments strips the final line break, which is
+		// significant for block scalars such as 'key: |'.
+		converted, err := yaml.YAMLToJSON([]byte(doc + "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %v", i+1, err)
+		}
+
+		if string(converted) != "null" {
+			documents = append(documents, json.RawMessage(converted))
+		}
 	}
 
-	return nil
+	return documents, nil
 }
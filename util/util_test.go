@@ -10,8 +10,19 @@
 package util
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMergeWithEmptyMap(t *testing.T) {
@@ -81,3 +92,449 @@ func TestMergeMapsPrecedence(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestLoadDataFormatsMatch(t *testing.T) {
+	var fromYAML, fromJSON map[string]interface{}
+
+	if err := LoadData("testdata/valid.yaml", &fromYAML); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadData("testdata/valid.json", &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("YAML and JSON data deserialised differently:\n%v\n%v", fromYAML, fromJSON)
+	}
+}
+
+func TestLoadMalformedJSONPosition(t *testing.T) {
+	var data map[string]interface{}
+	err := LoadData("testdata/malformed.json", &data)
+
+	if err == nil || !strings.Contains(err.Error(), "line 4, column 27") {
+		t.Errorf("Expected error with line and column, got: %v", err)
+	}
+}
+
+func TestLoadMalformedYAMLPosition(t *testing.T) {
+	var data map[string]interface{}
+	err := LoadData("testdata/malformed.yaml", &data)
+
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("Expected error with line number, got: %v", err)
+	}
+}
+
+func TestSplitDocuments(t *testing.T) {
+	input := "---\nkind: ConfigMap\n---   \n\n---\nkind: Service\ndata: |\n  ---not a separator\n"
+	expected := []string{
+		"kind: ConfigMap",
+		"kind: Service\ndata: |\n  ---not a separator",
+	}
+
+	result := SplitDocuments(input)
+
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Documents were split incorrectly: %q", result)
+	}
+}
+
+type fakeHTTPClient struct {
+	status int
+	body   string
+	err    error
+	url    string
+}
+
+func (c *fakeHTTPClient) Get(url string) (*http.Response, error) {
+	c.url = url
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return &http.Response{
+		StatusCode: c.status,
+		Status:     http.StatusText(c.status),
+		Body:       ioutil.NopCloser(strings.NewReader(c.body)),
+	}, nil
+}
+
+func TestLatestRelease(t *testing.T) {
+	client := &fakeHTTPClient{status: 200, body: `{"tag_name": "v1.9.0", "name": "Kontemplate 1.9"}`}
+
+	latest, err := LatestRelease(client, "judev/kontemplate")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if latest != "v1.9.0" {
+		t.Errorf("Expected latest release v1.9.0, but got %s\n", latest)
+	}
+
+	if client.url != "https://api.github.com/repos/judev/kontemplate/releases/latest" {
+		t.Errorf("Unexpected release URL: %s\n", client.url)
+	}
+}
+
+func TestLatestReleaseErrors(t *testing.T) {
+	clients := []*fakeHTTPClient{
+		{err: errors.New("network is unreachable")},
+		{status: 403, body: `{"message": "rate limited"}`},
+		{status: 200, body: `not json`},
+		{status: 200, body: `{}`},
+	}
+
+	for _, client := range clients {
+		if _, err := LatestRelease(client, ReleaseRepository); err == nil {
+			t.Errorf("Expected an error for response %+v\n", client)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.8.0", "v1.8.0", 0},
+		{"1.8.0", "1.9.0", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"1.8", "1.8.1", -1},
+		{"2.0.0-rc1", "2.0.0", -1},
+		{"2.0.0", "1.99.99", 1},
+		{"2.0.0-rc10", "2.0.0-rc2", 1},
+		{"v2.0.0-rc.2", "2.0.0-rc.10", -1},
+		{"2.0.0-beta2", "2.0.0-rc1", -1},
+		{"2.0.0-alpha", "2.0.0-alpha1", -1},
+		{"1.8.0+build.5", "1.8.0", 0},
+	}
+
+	for _, c := range cases {
+		result, err := CompareVersions(c.a, c.b)
+		if err != nil {
+			t.Errorf("Unexpected error comparing %s and %s: %v\n", c.a, c.b, err)
+		}
+
+		if result != c.expected {
+			t.Errorf("Expected comparison of %s and %s to be %d, but got %d\n", c.a, c.b, c.expected, result)
+		}
+	}
+
+	if _, err := CompareVersions("1.8.0", "latest"); err == nil {
+		t.Error("Expected invalid version to return an error")
+	}
+}
+
+func TestDocumentsToJSON(t *testing.T) {
+	data := `---
+kind: ConfigMap
+data:
+  script: |
+    echo "hello"
+    exit 0
+---
+# only a comment
+---
+ports:
+  80: http
+  443: https
+`
+
+	result, err := DocumentsToJSON(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []string{
+		`{"data":{"script":"echo \"hello\"\nexit 0\n"},"kind":"ConfigMap"}`,
+		`{"ports":{"443":"https","80":"http"}}`,
+	}
+
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %d documents, but got %d\n", len(expected), len(result))
+	}
+
+	for i, doc := range result {
+		if string(doc) != expected[i] {
+			t.Errorf("Expected document %d to be %s, but got %s\n", i+1, expected[i], doc)
+		}
+	}
+
+	if _, err := DocumentsToJSON("foo: [bar"); err == nil {
+		t.Error("Expected invalid YAML to return an error")
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "a\nb\nc\nd\ne\nf\ng\nh\ni\n"
+	to := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\n"
+
+	expected := `--- live
++++ rendered
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+@@ -9,1 +9,2 @@
+ i
++j
+`
+
+	if result := UnifiedDiff(from, to, "live", "rendered", 1); result != expected {
+		t.Errorf("Unexpected diff with one line of context:\n%s\n", result)
+	}
+
+	// With more context the two changes are merged into one hunk:
+	result := UnifiedDiff(from, to, "live", "rendered", 4)
+	if strings.Count(result, "@@ -") != 1 || !strings.HasPrefix(result, "--- live\n+++ rendered\n@@ -1,9 +1,10 @@\n") {
+		t.Errorf("Unexpected diff with four lines of context:\n%s\n", result)
+	}
+
+	if result := UnifiedDiff(from, from, "live", "rendered", 3); result != "" {
+		t.Errorf("Expected no diff for equal texts, but got:\n%s\n", result)
+	}
+
+	if result := UnifiedDiff("", "a\n", "live", "rendered", 3); result != "--- live\n+++ rendered\n@@ -0,0 +1,1 @@\n+a\n" {
+		t.Errorf("Unexpected diff against an empty text:\n%s\n", result)
+	}
+}
+
+func TestEditScriptIsMinimal(t *testing.T) {
+	words := []string{"a", "b", "c"}
+	random := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, random.Intn(30))
+		for i := range lines {
+			lines[i] = words[random.Intn(len(words))]
+		}
+		return lines
+	}
+
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(), randomLines()
+
+		var from, to []string
+		edits := 0
+		for _, l := range editScript(a, b) {
+			if l.op != '+' {
+				from = append(from, l.text)
+			}
+			if l.op != '-' {
+				to = append(to, l.text)
+			}
+			if l.op != ' ' {
+				edits++
+			}
+		}
+
+		if strings.Join(from, ",") != strings.Join(a, ",") || strings.Join(to, ",") != strings.Join(b, ",") {
+			t.Fatalf("Edit script does not transform %v into %v", a, b)
+		}
+
+		// The number of edits of a shortest edit script follows from
+		// the length of the longest common subsequence:
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+
+		if expected := len(a) + len(b) - 2*lcs[0][0]; edits != expected {
+			t.Fatalf("Expected %d edits between %v and %v, but got %d", expected, a, b, edits)
+		}
+	}
+}
+
+func TestDeepMerge(t *testing.T) {
+	base := map[string]interface{}{
+		"image": map[string]interface{}{
+			"name": "api",
+			"tag":  "v1",
+		},
+		"ports":    []interface{}{80, 443},
+		"replicas": 1,
+	}
+
+	overlay := map[string]interface{}{
+		"image": map[string]interface{}{
+			"tag": "v2",
+		},
+		"ports":    []interface{}{8080},
+		"replicas": map[string]interface{}{"min": 2},
+	}
+
+	expected := map[string]interface{}{
+		"image": map[string]interface{}{
+			"name": "api",
+			"tag":  "v2",
+		},
+		"ports":    []interface{}{8080},
+		"replicas": map[string]interface{}{"min": 2},
+	}
+
+	result := DeepMerge(base, overlay)
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Deep merge did not match expected result: %v\n", result)
+	}
+
+	if base["image"].(map[string]interface{})["tag"] != "v1" {
+		t.Error("Deep merge modified its input")
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	defer func(level LogLevel, output io.Writer) {
+		Level = level
+		LogOutput = output
+	}(Level, LogOutput)
+
+	expected := map[LogLevel]string{
+		LogQuiet:   "Warning: warn 3\n",
+		LogNormal:  "info 2\nWarning: warn 3\n",
+		LogVerbose: "debug 1\ninfo 2\nWarning: warn 3\n",
+	}
+
+	for level, output := range expected {
+		var b strings.Builder
+		Level = level
+		LogOutput = &b
+
+		Debugf("debug %d", 1)
+		Infof("info %d", 2)
+		Warnf("warn %d", 3)
+
+		if b.String() != output {
+			t.Errorf("Unexpected output at log level %d:\n%s\n", level, b.String())
+		}
+	}
+}
+
+func TestColorizeWithoutTerminal(t *testing.T) {
+	var buf bytes.Buffer
+
+	if result := Colorize(&buf, Red, "error"); result != "error" {
+		t.Errorf("Expected output that is not a terminal not to be coloured, but got %q\n", result)
+	}
+
+	w := StyledWriter(&buf, Red)
+	if _, err := io.WriteString(w, "error\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "error\n" {
+		t.Errorf("Expected styled writer to pass output through unchanged, but got %q\n", buf.String())
+	}
+}
+
+func TestStyleApply(t *testing.T) {
+	if result := Bold.apply("file.yaml"); result != "\x1b[1mfile.yaml\x1b[0m" {
+		t.Errorf("Unexpected styled text: %q\n", result)
+	}
+}
+
+func TestNoColorDisablesColors(t *testing.T) {
+	defer func() { NoColor = false }()
+	NoColor = true
+
+	if ColorEnabled(os.Stderr) {
+		t.Errorf("Expected --no-color to disable colours\n")
+	}
+}
+
+func TestLoadMultiDocumentYAML(t *testing.T) {
+	var data map[string]interface{}
+	if err := LoadData("testdata/multi-doc.yaml", &data); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	defaults := map[string]interface{}{
+		"replicas": float64(2),
+		"image": map[string]interface{}{
+			"registry": "registry.example.com",
+			"tag":      "v1",
+		},
+	}
+
+	expected := map[string]interface{}{
+		"defaults": defaults,
+		"api": map[string]interface{}{
+			"replicas": float64(2),
+			"image": map[string]interface{}{
+				"registry": "registry.example.com",
+				"tag":      "v2",
+			},
+		},
+		"worker": defaults,
+	}
+
+	if !reflect.DeepEqual(expected, data) {
+		t.Errorf("Unexpected merged documents: %v\n", data)
+	}
+}
+
+func TestLoadUndefinedAnchor(t *testing.T) {
+	var data map[string]interface{}
+	err := LoadData("testdata/undefined-anchor.yaml", &data)
+
+	expected := "alias *defaults at line 5 refers to an anchor that is not defined before it"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, but got %v\n", expected, err)
+	}
+}
+
+func TestDocumentsAsSequence(t *testing.T) {
+	input := "a: 1\nb:\n  c: 2\n---\nd: 3\n...\n"
+	expected := "- a: 1\n  b:\n    c: 2\n-\n  d: 3\n\n  "
+
+	if result := documentsAsSequence(input); result != expected {
+		t.Errorf("Unexpected sequence:\n%q\n", result)
+	}
+}
+
+func TestCommandTimeoutKillsProcessGroup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process groups are not supported on Windows")
+	}
+
+	// The background process keeps stdout open, so waiting for the
+	// command only returns early if it was killed as well.
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", "sleep 30 & sleep 30")
+	cmd.Stdout = &stdout
+
+	start := time.Now()
+	err := RunCommand(cmd, 100*time.Millisecond)
+
+	if err == nil || !strings.Contains(err.Error(), "did not finish within 100ms") {
+		t.Errorf("Expected timeout error, but got %v\n", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Command was not killed after timeout, took %s\n", elapsed)
+	}
+}
+
+func TestCommandWithoutTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a POSIX shell")
+	}
+
+	if err := RunCommand(exec.Command("sh", "-c", "exit 3"), 0); err == nil {
+		t.Error("Expected failing command to return an error")
+	}
+
+	if err := RunCommand(exec.Command("sh", "-c", "true"), time.Minute); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+}
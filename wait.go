@@ -0,0 +1,57 @@
+// Copyright (C) 2016-2019  Vincent Ambo <mail@tazj.in>
+//
+// This file is part of Kontemplate.
+//
+// Kontemplate is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This file contains the implementation of waiting for the rollout of
+// applied workloads.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/tazjin/kontemplate/context"
+	"github.com/tazjin/kontemplate/templater"
+	"github.com/tazjin/kontemplate/util"
+)
+
+// Waits until all workloads of a resource set have been rolled out by
+// running 'kubectl rollout status' for each of them.
+func waitForWorkloads(c *context.Context, rs *templater.RenderedResourceSet, waitTimeout time.Duration) error {
+	for _, w := range templater.Workloads(rs) {
+		resource := fmt.Sprintf("%s/%s", strings.ToLower(w.Kind), w.Name)
+		util.Infof("Waiting for rollout of %s in resource set '%s'", resource, rs.Name)
+
+		args := []string{"rollout", "status", resource, fmt.Sprintf("--timeout=%s", waitTimeout)}
+		if w.Namespace != "" {
+			args = append(args, fmt.Sprintf("--namespace=%s", w.Namespace))
+		}
+		args = append(args, clusterArgs(c)...)
+
+		kubectl := exec.Command(*kubectlBin, args...)
+		kubectl.Stdout = clusterWriter(c, os.Stderr)
+		kubectl.Stderr = clusterWriter(c, os.Stderr)
+
+		// 'kubectl rollout status' gives up after the wait timeout, so
+		// --timeout only limits how long kubectl may hang beyond it.
+		killAfter := time.Duration(0)
+		if *timeout > 0 {
+			killAfter = waitTimeout + *timeout
+		}
+
+		if err := util.RunCommand(kubectl, killAfter); err != nil {
+			return fmt.Errorf("%s in resource set '%s' did not become ready within %s: %v", resource, rs.Name, waitTimeout, err)
+		}
+	}
+
+	return nil
+}